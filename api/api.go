@@ -27,18 +27,40 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/Nicknamezz00/naive-distributed-kv/config"
 	"github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/gossip"
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
 	"github.com/Nicknamezz00/naive-distributed-kv/replica"
 )
 
 type Server struct {
 	db     *db.Database
 	shards *config.Shards
+
+	durability Durability
+	ackTimeout time.Duration
+
+	raft *raft.Node // nil unless writes are replicated through Raft
+
+	stats *replica.Stats // nil unless the node runs the replication client
+
+	gossip *gossip.Gossip // nil unless gossip membership is enabled
+
+	readRouting ReadRouting
+	router      router
+
+	reshardMu sync.Mutex
+	migration *migration // nil unless a reshard is in progress
 }
 
 func NewServer(db *db.Database, s *config.Shards) *Server {
@@ -50,76 +72,577 @@ func NewServer(db *db.Database, s *config.Shards) *Server {
 
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
+	if r.Header.Get(reshardReadHeader) == "" && !s.checkEpoch(w, r) {
+		return
+	}
 	key := r.Form.Get("key")
 
 	shard := s.shards.Index(key)
-	if shard != s.shards.CurIdx {
-		s.redirect(shard, w, r)
+	if shard != s.shards.CurrentIdx() && r.Header.Get(reshardReadHeader) == "" {
+		s.redirectRead(shard, w, r)
+		return
+	}
+
+	f, err := requestFreshness(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if ok, err := s.waitFresh(r, f); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	} else if !ok {
+		s.replyStale(w, r, f)
 		return
 	}
 
-	value, err := s.db.Get(key)
-	fmt.Fprintf(w, "Shard = %d, current = %d, addr = %q, Value = %q, error = %v\n", shard, s.shards.CurIdx, s.shards.Addrs[shard], value, err)
+	e, err := s.db.GetEntry(key)
+	if e == nil && err == nil && r.Header.Get(reshardReadHeader) == "" {
+		if addr := s.previousOwner(key); addr != "" {
+			h := http.Header{}
+			h.Set(reshardReadHeader, "1")
+			if err := s.forward(addr, shard, w, r, h); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprintf(w, "Error reading from the previous owner %q: %v", addr, err)
+			}
+			return
+		}
+	}
+	var value []byte
+	var version uint64
+	if e != nil {
+		value, version = e.Value, e.Version
+		setEntityHeaders(w, version, e.Modified)
+	}
+	if err == nil && !checkReadPreconditions(w, r, e != nil, version) {
+		return
+	}
+	fmt.Fprintf(w, "Shard = %d, current = %d, addr = %q, Value = %q, error = %v\n", shard, s.shards.CurrentIdx(), s.shards.Leader(shard), value, err)
 }
 
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
+	if !s.checkEpoch(w, r) {
+		return
+	}
 	key := r.Form.Get("key")
 	value := r.Form.Get("value")
 
 	shard := s.shards.Index(key)
-	if shard != s.shards.CurIdx {
+	if shard != s.shards.CurrentIdx() {
 		s.redirect(shard, w, r)
 		return
 	}
 
-	err := s.db.Set(key, []byte(value))
-	fmt.Fprintf(w, "Error = %v, shard = %d, current shard = %d", err, shard, s.shards.CurIdx)
+	expiresAt, err := requestExpiry(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	cond, conditional, err := requestCondition(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if conditional && !s.checkConditional(w, key) {
+		return
+	}
+
+	if s.raft != nil {
+		var raftCond *db.Condition
+		if conditional {
+			raftCond = &cond
+		}
+		if expiresAt.IsZero() {
+			s.raftWrite(w, r, db.OpSet, key, []byte(value), raftCond, shard)
+		} else {
+			s.raftWrite(w, r, db.OpSetExpiring, key, db.ExpiringValue([]byte(value), expiresAt), raftCond, shard)
+		}
+		return
+	}
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	seq, err := s.db.SetIf(key, []byte(value), expiresAt, cond)
+	if err == nil {
+		w.Header().Set(VersionHeader, strconv.FormatUint(seq, 10))
+		w.Header().Set("ETag", etag(seq))
+	}
+	s.replyWrite(w, r, durability, seq, err, shard)
+}
+
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if !s.checkEpoch(w, r) {
+		return
+	}
+	key := r.Form.Get("key")
+
+	shard := s.shards.Index(key)
+	if shard != s.shards.CurrentIdx() {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	cond, conditional, err := requestCondition(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if conditional && !s.checkConditional(w, key) {
+		return
+	}
+
+	if s.raft != nil {
+		var raftCond *db.Condition
+		if conditional {
+			raftCond = &cond
+		}
+		s.raftWrite(w, r, db.OpDelete, key, nil, raftCond, shard)
+		return
+	}
+
+	durability, err := s.requestDurability(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	seq, err := s.deleteKey(key, cond)
+	s.replyWrite(w, r, durability, seq, err, shard)
+}
+
+// replyWrite waits for the committed write to become durable and reports the result.
+// The sequence number of the write is also returned in LogPositionHeader,
+// clients pass it as min_seq to read their own writes from replicas.
+// A write that is committed on the leader but not acknowledged in time by replicas
+// is reported with http.StatusGatewayTimeout, a conditional write whose condition
+// does not hold with the status of conditionFailedStatus.
+func (s *Server) replyWrite(w http.ResponseWriter, r *http.Request, d Durability, seq uint64, err error, shard int) {
+	if errors.Is(err, db.ErrConditionFailed) {
+		w.WriteHeader(conditionFailedStatus(r))
+	}
+	if err == nil {
+		w.Header().Set(replica.LogPositionHeader, strconv.FormatUint(seq, 10))
+		if err = s.waitForReplicas(r, d, seq); err != nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}
+	fmt.Fprintf(w, "Error = %v, shard = %d, current shard = %d, seq = %d", err, shard, s.shards.CurrentIdx(), seq)
 }
 
 func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Error = %v", s.db.DeleteExtraKeys(func(key string) bool {
-		return s.shards.Index(key) != s.shards.CurIdx
-	}))
+	if s.resharding() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = reshard in progress, misplaced keys are deleted once migrated")
+		return
+	}
+	isExtra := func(key string) bool {
+		return s.shards.Index(key) != s.shards.CurrentIdx()
+	}
+	if s.raft != nil {
+		s.raftDeleteExtraKeys(w, r, isExtra)
+		return
+	}
+	fmt.Fprintf(w, "Error = %v", s.db.DeleteExtraKeys(isExtra))
 }
 
 func (s *Server) ListenAndServe(addr string) error {
 	return http.ListenAndServe(addr, nil)
 }
 
+// redirect forwards the request to the leader of the shard, relaying its status code and body.
 func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	fmt.Fprintf(w, "\nredirecting from shard %d to shard %d (%q)\n", s.shards.CurIdx, shard, url)
-
-	resp, err := http.Get(url)
-	if err != nil {
+	if err := s.forward(s.shards.Leader(shard), shard, w, r, nil); err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintf(w, "Error redirecting request: %v", err)
-		return
+	}
+}
+
+// forward sends the request with the extra header h to addr and relays the response.
+// The request carries the config epoch it was routed with and the preconditions of the original.
+// Nothing is written to w if addr cannot be reached, so the caller may retry elsewhere.
+func (s *Server) forward(addr string, shard int, w http.ResponseWriter, r *http.Request, h http.Header) error {
+	url := "http://" + addr + r.RequestURI
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{"If-Match", "If-None-Match"} {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	req.Header.Set(ConfigEpochHeader, strconv.FormatUint(s.shards.CurrentEpoch(), 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
+	for _, k := range []string{replica.LogPositionHeader, VersionHeader, "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	fmt.Fprintf(w, "\nredirecting from shard %d to shard %d (%q)\n", s.shards.CurrentIdx(), shard, url)
 	io.Copy(w, resp.Body)
+	return nil
 }
 
-func (s *Server) GetOldKey(w http.ResponseWriter, r *http.Request) {
+// maxLogBatch is the largest number of log entries returned by a single LogEntries request.
+const maxLogBatch = 1000
+
+func (s *Server) LogEntries(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	limit := maxLogBatch
+	if l := r.Form.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid limit %q", l)
+			return
+		}
+		if limit > maxLogBatch {
+			limit = maxLogBatch
+		}
+	}
+
+	entries, err := s.db.LogEntries(after, limit)
+	if errors.Is(err, db.ErrLogTruncated) || errors.Is(err, db.ErrLogAhead) {
+		w.WriteHeader(http.StatusGone)
+	}
+	e := json.NewEncoder(w)
+	res := &replica.LogEntries{Entries: entries}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	e.Encode(res)
+}
+
+// streamHeartbeat is how often an empty batch is sent over an idle replication stream,
+// so that both sides can detect a broken connection. It also bounds how stale an idle
+// replica is: it is below staleReadWait, so reads with any max_staleness on a caught up
+// replica are served after waiting for at most one heartbeat.
+const streamHeartbeat = staleReadWait / 2
+
+// StreamLog pushes log entries after the given position to the replica as they commit.
+// The response is a never ending stream of JSON encoded replica.LogEntries batches.
+// If the log cannot continue from the position, it responds with http.StatusGone
+// and the replica must bootstrap from Snapshot.
+func (s *Server) StreamLog(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	after, err := strconv.ParseUint(r.Form.Get("after"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: streaming is not supported")
+		return
+	}
+	if _, err := s.db.LogEntries(after, 1); err != nil {
+		if errors.Is(err, db.ErrLogTruncated) || errors.Is(err, db.ErrLogAhead) {
+			w.WriteHeader(http.StatusGone)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	// Connected replicas are registered, so that the log they need is kept.
+	if name := config.NormalizeAddr(r.Form.Get("replica")); name != "" {
+		if err := s.db.AckReplica(name, after); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	e := json.NewEncoder(w)
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		changed := s.db.Changed()
+		entries, err := s.db.LogEntries(after, maxLogBatch)
+		if err != nil {
+			e.Encode(&replica.LogEntries{Err: err.Error()})
+			return
+		}
+
+		if len(entries) > 0 {
+			if err := e.Encode(&replica.LogEntries{Entries: entries}); err != nil {
+				return
+			}
+			flusher.Flush()
+			after = entries[len(entries)-1].Seq
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if err := e.Encode(&replica.LogEntries{}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Snapshot streams all keys and values of a consistent snapshot as JSON encoded
+// replica.SnapshotEntry values. The log position of the snapshot is sent in
+// the replica.LogPositionHeader header, replicas resume streaming the log from it.
+func (s *Server) Snapshot(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := config.NormalizeAddr(r.Form.Get("replica"))
+
+	// Register the replica before taking the snapshot,
+	// so that the log after the snapshot position is not truncated.
+	if name != "" {
+		if err := s.db.RegisterReplica(name); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+	}
+
+	snap, err := s.db.Snapshot()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(replica.LogPositionHeader, strconv.FormatUint(snap.Seq, 10))
 	e := json.NewEncoder(w)
-	k, v, err := s.db.GetOldKey()
-	e.Encode(&replica.NextKeyValue{
-		Key:   string(k),
-		Value: string(v),
-		Err:   err,
+	err = snap.ForEach(func(kv db.KeyValue) error {
+		return e.Encode(&replica.SnapshotEntry{Key: kv.Key, Value: kv.Value, ExpiresAt: kv.ExpiresAt, Version: kv.Version, Modified: kv.Modified})
 	})
+	// The snapshot must be closed before acknowledging,
+	// as writes may block on the read transaction.
+	snap.Close()
+
+	if err == nil && name != "" {
+		if err := s.db.AckReplica(name, snap.Seq); err != nil {
+			log.Printf("AckReplica(%q, %d) after snapshot: %v", name, snap.Seq, err)
+		}
+	}
 }
 
-func (s *Server) DeleteReplicaKey(w http.ResponseWriter, r *http.Request) {
+func (s *Server) AckLog(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	key := r.Form.Get("key")
-	value := r.Form.Get("value")
-	if err := s.db.DeleteReplicaKey([]byte(key), []byte(value)); err != nil {
+	name := config.NormalizeAddr(r.Form.Get("replica"))
+	seq, err := strconv.ParseUint(r.Form.Get("seq"), 10, 64)
+	if err != nil || name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: must provide replica and seq")
+		return
+	}
+	if err := s.db.AckReplica(name, seq); err != nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		fmt.Fprintf(w, "error: %v", err)
 		return
 	}
 	fmt.Fprintf(w, "ok")
 }
+
+// Position reports the log position of this node, the last written sequence number
+// on a leader and the last applied one on a replica.
+func (s *Server) Position(w http.ResponseWriter, r *http.Request) {
+	var res replica.Position
+	var err error
+	if res.ReadOnly = s.db.ReadOnly(); res.ReadOnly {
+		res.Seq, err = s.db.AppliedSeq()
+	} else {
+		res.Seq, err = s.db.LastSeq()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// SetReplicaStats makes ReplicationStatus report the statistics of the replication client.
+func (s *Server) SetReplicaStats(stats *replica.Stats) {
+	s.stats = stats
+}
+
+// ReplicationStatus reports the log position of this node. The leader also reports
+// how far each replica is behind, a replica the state of its replication client.
+func (s *Server) ReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	res := replica.Status{ReadOnly: s.db.ReadOnly()}
+	var err error
+	if res.ReadOnly {
+		res.Seq, err = s.db.AppliedSeq()
+	} else {
+		var acks map[string]uint64
+		res.Seq, err = s.db.LastSeq()
+		if err == nil {
+			acks, res.QueueDepth, err = s.db.ReplicaAcks()
+		}
+		res.Replicas = make(map[string]replica.ReplicaStatus, len(acks))
+		for name, acked := range acks {
+			st := replica.ReplicaStatus{Acked: acked}
+			if err == nil {
+				st.Lag, err = s.db.PendingEntries(acked)
+			}
+			res.Replicas[name] = st
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	if s.stats != nil {
+		stats := s.stats.Get()
+		res.Client = &stats
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// SetLeader updates the leader address of a shard after a failover. The announcement
+// carries the term of the new leader: the leader of the shard steps down if the term is
+// newer than its own and rejects the announcement otherwise, see db.Demote.
+func (s *Server) SetLeader(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	addr := r.Form.Get("addr")
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil || shard < 0 || shard >= s.shards.ShardCount() || addr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: must provide valid shard and addr")
+		return
+	}
+
+	if shard == s.shards.CurrentIdx() && !s.db.ReadOnly() && s.raft == nil {
+		term, _ := strconv.ParseUint(r.Form.Get("term"), 10, 64)
+		seq, err := s.db.LastSeq()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if term <= db.Term(seq) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "error: term %d is not newer than the term %d of this leader", term, db.Term(seq))
+			return
+		}
+		if err := s.db.Demote(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		log.Printf("Stepped down for %q, the leader of term %d", addr, term)
+	}
+
+	log.Printf("Leader of shard %d changed from %q to %q", shard, s.shards.Leader(shard), addr)
+	s.shards.SetLeader(shard, addr)
+	fmt.Fprintf(w, "ok")
+}
+
+// Vote asks a replica to vote for the candidate as the leader of a term, see db.Vote.
+// Replicas that heard from their leader within replica.LeaderTimeout refuse to vote,
+// so a replica cut off from a live leader cannot replace it.
+func (s *Server) Vote(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	candidate := config.NormalizeAddr(r.Form.Get("candidate"))
+	term, termErr := strconv.ParseUint(r.Form.Get("term"), 10, 64)
+	seq, seqErr := strconv.ParseUint(r.Form.Get("seq"), 10, 64)
+	if termErr != nil || seqErr != nil || candidate == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: must provide candidate, term and seq")
+		return
+	}
+
+	var res replica.Vote
+	switch {
+	case !s.db.ReadOnly():
+		res.Reason = "not a replica"
+	case s.stats != nil && time.Since(s.stats.Get().LastPull) < replica.LeaderTimeout:
+		res.Reason = "the leader is alive"
+	default:
+		var err error
+		if res.Granted, res.Term, err = s.db.Vote(term, candidate, seq); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+		if !res.Granted {
+			res.Reason = fmt.Sprintf("voted in term %d or ahead of the candidate", res.Term)
+		}
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// MerkleTree returns the hash summary of all keys and values for anti-entropy.
+func (s *Server) MerkleTree(w http.ResponseWriter, r *http.Request) {
+	tree, err := s.db.MerkleTree()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(tree)
+}
+
+// MerkleLeaf returns all keys and values of the leaves of MerkleTree
+// given by the repeated leaf parameter.
+func (s *Server) MerkleLeaf(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var leaves []int
+	for _, v := range r.Form["leaf"] {
+		leaf, err := strconv.Atoi(v)
+		if err != nil || leaf < 0 || leaf >= db.MerkleLeaves {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error: invalid leaf %q", v)
+			return
+		}
+		leaves = append(leaves, leaf)
+	}
+	if len(leaves) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: leaf is required")
+		return
+	}
+
+	seq, entries, err := s.db.MerkleLeafEntries(leaves...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(&replica.MerkleLeaf{Seq: seq, Entries: entries})
+}
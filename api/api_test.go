@@ -27,6 +27,9 @@ package api_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -39,6 +42,7 @@ import (
 	"github.com/Nicknamezz00/naive-distributed-kv/api"
 	"github.com/Nicknamezz00/naive-distributed-kv/config"
 	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
 )
 
 func createShardDB(t *testing.T, idx int) *internalDB.Database {
@@ -78,8 +82,8 @@ func createShardServer(t *testing.T, idx int, addrs map[int]string) (*internalDB
 }
 
 func TestAPIServer(t *testing.T) {
-	var ts1GetHandler, ts1SetHandler func(w http.ResponseWriter, r *http.Request)
-	var ts2GetHandler, ts2SetHandler func(w http.ResponseWriter, r *http.Request)
+	var ts1GetHandler, ts1SetHandler, ts1DeleteHandler func(w http.ResponseWriter, r *http.Request)
+	var ts2GetHandler, ts2SetHandler, ts2DeleteHandler func(w http.ResponseWriter, r *http.Request)
 
 	// test server
 	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -87,6 +91,8 @@ func TestAPIServer(t *testing.T) {
 			ts1GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts1SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts1DeleteHandler(w, r)
 		}
 	}))
 	defer ts1.Close()
@@ -96,6 +102,8 @@ func TestAPIServer(t *testing.T) {
 			ts2GetHandler(w, r)
 		} else if strings.HasPrefix(r.RequestURI, "/set") {
 			ts2SetHandler(w, r)
+		} else if strings.HasPrefix(r.RequestURI, "/delete") {
+			ts2DeleteHandler(w, r)
 		}
 	}))
 	defer ts2.Close()
@@ -117,6 +125,8 @@ func TestAPIServer(t *testing.T) {
 	ts1SetHandler = api1.SetHandler
 	ts2GetHandler = api2.GetHandler
 	ts2SetHandler = api2.SetHandler
+	ts1DeleteHandler = api1.DeleteHandler
+	ts2DeleteHandler = api2.DeleteHandler
 
 	for key := range keys {
 		// Send all to first shard to test redirects.
@@ -164,4 +174,263 @@ func TestAPIServer(t *testing.T) {
 	if !bytes.Equal(value2, []byte(want2)) {
 		t.Errorf("Unexpected value of Apple key: got %q, want %q", value2, want2)
 	}
+
+	for key := range keys {
+		// Send all to first shard to test redirects.
+		_, err := http.Get(fmt.Sprintf(ts1.URL+"/delete?key=%s", key))
+		if err != nil {
+			t.Fatalf("Could not delete the key %q: %v", key, err)
+		}
+	}
+
+	if value, err := db1.Get("Banana"); err != nil || value != nil {
+		t.Errorf("Banana key after delete: got %q, %v; want nil, nil", value, err)
+	}
+	if value, err := db2.Get("Apple"); err != nil || value != nil {
+		t.Errorf("Apple key after delete: got %q, %v; want nil, nil", value, err)
+	}
+}
+
+func TestLogEntries(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := db.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.LogEntries))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/log-entries?after=1&limit=5")
+	if err != nil {
+		t.Fatalf("LogEntries request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var res replica.LogEntries
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode LogEntries response: %v", err)
+	}
+	if res.Err != "" {
+		t.Fatalf("LogEntries returned error: %s", res.Err)
+	}
+	if len(res.Entries) != 2 || res.Entries[0].Seq != 2 || res.Entries[1].Key != "c" {
+		t.Errorf("Unexpected log entries: got %+v, want entries 2 and 3", res.Entries)
+	}
+}
+
+func TestStreamLog(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	if _, err := db.Set("a", []byte("value-a")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.StreamLog))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/replication/stream?after=0")
+	if err != nil {
+		t.Fatalf("StreamLog request error: %v", err)
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(resp.Body)
+
+	var res replica.LogEntries
+	if err := d.Decode(&res); err != nil {
+		t.Fatalf("Could not decode the first batch: %v", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Key != "a" {
+		t.Fatalf("Unexpected first batch: got %+v, want key %q", res.Entries, "a")
+	}
+
+	// New writes must be pushed without reconnecting.
+	if _, err := db.Set("b", []byte("value-b")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "b", err)
+	}
+	res = replica.LogEntries{}
+	if err := d.Decode(&res); err != nil {
+		t.Fatalf("Could not decode the second batch: %v", err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Seq != 2 || res.Entries[0].Key != "b" {
+		t.Errorf("Unexpected second batch: got %+v, want seq 2 with key %q", res.Entries, "b")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	for _, key := range []string{"a", "b"} {
+		if _, err := db.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.Snapshot))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/replication/snapshot?replica=r1")
+	if err != nil {
+		t.Fatalf("Snapshot request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get(replica.LogPositionHeader); got != "2" {
+		t.Errorf("Snapshot log position: got %q, want %q", got, "2")
+	}
+	d := json.NewDecoder(resp.Body)
+	var keys []string
+	for d.More() {
+		var e replica.SnapshotEntry
+		if err := d.Decode(&e); err != nil {
+			t.Fatalf("Could not decode snapshot entry: %v", err)
+		}
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, ",") != "a,b" {
+		t.Errorf("Snapshot keys: got %q, want %q", keys, []string{"a", "b"})
+	}
+
+	// The replica is registered at the snapshot position.
+	if err := db.WaitForAcks(context.Background(), 2, -1); err != nil {
+		t.Errorf("WaitForAcks(2, -1) after snapshot: got %v, want nil error", err)
+	}
+}
+
+func TestAckLogReplicaName(t *testing.T) {
+	db := createShardDB(t, 0)
+	shards := &config.Shards{
+		Addrs:    map[int]string{0: "localhost:8080"},
+		Replicas: map[int][]string{0: {"localhost:8090"}},
+		Count:    1,
+		CurIdx:   0,
+	}
+	srv := api.NewServer(db, shards)
+	if err := replica.RegisterReplicas(db, shards, nil, "localhost:8080"); err != nil {
+		t.Fatalf("RegisterReplicas: got %v, want nil error", err)
+	}
+	if _, err := db.Set("a", []byte("value-a")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.AckLog))
+	defer ts.Close()
+
+	// The config lists the replica as localhost, it acknowledges with its -http-addr.
+	resp, err := http.Get(ts.URL + "/ack-log?replica=127.0.0.1:8090&seq=1")
+	if err != nil {
+		t.Fatalf("AckLog request error: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := db.LogEntries(0, 1); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(0, 1) after the ack: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+}
+
+func TestSetLeaderTerm(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:1"})
+	if _, err := db.Set("a", []byte("b")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(srv.SetLeader))
+	defer ts.Close()
+
+	// An announcement without a newer term does not depose the leader.
+	if status, _ := get(t, ts.URL+"/cluster/leader?shard=0&addr=127.0.0.1:2&term=0"); status != http.StatusConflict {
+		t.Errorf("Announcement of term 0: got status %d, want %d", status, http.StatusConflict)
+	}
+	if db.ReadOnly() {
+		t.Fatalf("Leader stepped down for term 0")
+	}
+
+	if status, _ := get(t, ts.URL+"/cluster/leader?shard=0&addr=127.0.0.1:2&term=1"); status != http.StatusOK {
+		t.Errorf("Announcement of term 1: got status %d, want %d", status, http.StatusOK)
+	}
+	if !db.ReadOnly() {
+		t.Errorf("ReadOnly() after the announcement of term 1: got false, want true")
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	for _, name := range []string{"r1", "r2"} {
+		if err := db.RegisterReplica(name); err != nil {
+			t.Fatalf("RegisterReplica(%q): got %v, want nil error", name, err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := db.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+	}
+	if err := db.AckReplica("r1", 3); err != nil {
+		t.Fatalf("AckReplica(r1, 3): got %v, want nil error", err)
+	}
+	if err := db.AckReplica("r2", 1); err != nil {
+		t.Fatalf("AckReplica(r2, 1): got %v, want nil error", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.ReplicationStatus))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/replication/status")
+	if err != nil {
+		t.Fatalf("ReplicationStatus request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var res replica.Status
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode ReplicationStatus response: %v", err)
+	}
+	if res.ReadOnly || res.Seq != 3 || res.QueueDepth != 2 {
+		t.Errorf("Unexpected status: got %+v, want seq 3 and queue depth 2", res)
+	}
+	if got := res.Replicas["r2"]; got.Acked != 1 || got.Lag != 2 {
+		t.Errorf("Unexpected status of r2: got %+v, want acked 1 and lag 2", got)
+	}
+	if got := res.Replicas["r1"]; got.Acked != 3 || got.Lag != 0 {
+		t.Errorf("Unexpected status of r1: got %+v, want acked 3 and lag 0", got)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0", 1: "127.0.0.1:1"})
+	ts := httptest.NewServer(http.HandlerFunc(srv.LocateHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/admin/locate?key=Apple")
+	if err != nil {
+		t.Fatalf("Locate request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var loc config.Location
+	if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
+		t.Fatalf("Could not decode Locate response: %v", err)
+	}
+	if loc.Key != "Apple" || loc.Shard != 1 || loc.Leader != "127.0.0.1:1" || loc.Placement != config.PlacementModulo || loc.Hash == 0 {
+		t.Errorf("Locate(Apple): got %+v, want shard 1 with leader 127.0.0.1:1 and its hash", loc)
+	}
+
+	resp, err = http.Get(ts.URL + "/admin/locate")
+	if err != nil {
+		t.Fatalf("Locate request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Locate without a key: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Get(ts.URL + "/admin/locate?key=")
+	if err != nil {
+		t.Fatalf("Locate request error: %v", err)
+	}
+	defer resp.Body.Close()
+	loc = config.Location{}
+	if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
+		t.Fatalf("Could not decode Locate response of the empty key: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || loc.Key != "" || loc.Leader == "" {
+		t.Errorf("Locate of the empty key: got status %d and %+v, want status %d and its shard", resp.StatusCode, loc, http.StatusOK)
+	}
 }
@@ -0,0 +1,217 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+// VersionHeader carries the version of a key: the sequence number of its last write.
+// It is returned by reads of existing keys that have one and by successful sets,
+// and can be passed back as if-version for a compare-and-set.
+const VersionHeader = "X-Key-Version"
+
+// The entity tag of a key is its version in double quotes. It is returned in the ETag header
+// together with Last-Modified by reads of existing keys, and in ETag by successful sets.
+// Reads and writes accept the If-Match and If-None-Match preconditions on it.
+// Keys written before versions were kept have version 0 and no entity tag,
+// only the * preconditions apply to them.
+
+// etag returns the entity tag of the version.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETags parses an If-Match or If-None-Match header, either * or a list of entity tags.
+// Weak tags compare like strong ones: a version identifies the exact value.
+func parseETags(h string) (wildcard bool, versions []uint64, err error) {
+	if strings.TrimSpace(h) == "*" {
+		return true, nil, nil
+	}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		v, err := strconv.ParseUint(strings.Trim(t, `"`), 10, 64)
+		if len(t) < 3 || t[0] != '"' || t[len(t)-1] != '"' || err != nil || v == 0 {
+			return false, nil, fmt.Errorf("invalid entity tag %q", t)
+		}
+		versions = append(versions, v)
+	}
+	return false, versions, nil
+}
+
+// matchETags reports whether the key, if it exists, with the version
+// matches the parsed If-Match or If-None-Match header.
+func matchETags(wildcard bool, versions []uint64, exists bool, version uint64) bool {
+	if !exists {
+		return false
+	}
+	if wildcard {
+		return true
+	}
+	// Parsed entity tags are never 0, keys without a version match no tag.
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReadPreconditions evaluates the If-Match and If-None-Match headers of a read
+// of the key, if it exists, with the version. It replies with
+// http.StatusPreconditionFailed or http.StatusNotModified if they do not hold.
+func checkReadPreconditions(w http.ResponseWriter, r *http.Request, exists bool, version uint64) bool {
+	if h := r.Header.Get("If-Match"); h != "" {
+		wildcard, versions, err := parseETags(h)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error = %v", err)
+			return false
+		}
+		if !matchETags(wildcard, versions, exists, version) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprintf(w, "Error = the key does not match If-Match %s", h)
+			return false
+		}
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		wildcard, versions, err := parseETags(h)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error = %v", err)
+			return false
+		}
+		if matchETags(wildcard, versions, exists, version) {
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+	}
+	return true
+}
+
+// setEntityHeaders sets the VersionHeader, ETag and Last-Modified headers of the key,
+// keys without a version get none of them.
+func setEntityHeaders(w http.ResponseWriter, version uint64, modified int64) {
+	if version == 0 {
+		return
+	}
+	w.Header().Set(VersionHeader, strconv.FormatUint(version, 10))
+	w.Header().Set("ETag", etag(version))
+	if modified != 0 {
+		w.Header().Set("Last-Modified", time.Unix(0, modified).UTC().Format(http.TimeFormat))
+	}
+}
+
+// Write modes requested with the mode parameter.
+const (
+	modeIfAbsent = "if-absent"
+	modeIfExists = "if-exists"
+)
+
+// requestCondition returns the precondition of a conditional write and whether there is one.
+// The parameters are mode (if-absent or if-exists), if-value, the expected current value,
+// and if-version, the expected current version. The If-Match header takes * or the
+// entity tag of the current version, If-None-Match * or an entity tag the key must not have.
+func requestCondition(r *http.Request) (cond db.Condition, ok bool, err error) {
+	switch mode := r.Form.Get("mode"); mode {
+	case "":
+	case modeIfAbsent:
+		cond.Absent = true
+	case modeIfExists:
+		cond.Exists = true
+	default:
+		return cond, false, fmt.Errorf("unknown mode %q, must be %s or %s", mode, modeIfAbsent, modeIfExists)
+	}
+	if _, set := r.Form["if-value"]; set {
+		cond.Value = []byte(r.Form.Get("if-value"))
+	}
+	if v := r.Form.Get("if-version"); v != "" {
+		if cond.Version, err = strconv.ParseUint(v, 10, 64); err != nil || cond.Version == 0 {
+			return cond, false, fmt.Errorf("invalid if-version %q", v)
+		}
+	}
+	if h := r.Header.Get("If-Match"); h != "" {
+		wildcard, versions, err := parseETags(h)
+		switch {
+		case err != nil:
+			return cond, false, err
+		case wildcard:
+			cond.Exists = true
+		case len(versions) > 1:
+			return cond, false, fmt.Errorf("If-Match of a write takes a single entity tag")
+		case cond.Version != 0 && cond.Version != versions[0]:
+			return cond, false, fmt.Errorf("If-Match %s contradicts if-version %d", h, cond.Version)
+		default:
+			cond.Version = versions[0]
+		}
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		wildcard, versions, err := parseETags(h)
+		switch {
+		case err != nil:
+			return cond, false, err
+		case wildcard:
+			cond.Absent = true
+		case len(versions) > 1:
+			return cond, false, fmt.Errorf("If-None-Match of a write takes * or a single entity tag")
+		default:
+			cond.NotVersion = versions[0]
+		}
+	}
+	if cond.Absent && (cond.Exists || cond.Value != nil || cond.Version != 0) {
+		return cond, false, fmt.Errorf("mode %s cannot be combined with if-value, if-version or If-Match", modeIfAbsent)
+	}
+	return cond, cond.Absent || cond.Exists || cond.Value != nil || cond.Version != 0 || cond.NotVersion != 0, nil
+}
+
+// conditionFailedStatus returns the status of a conditional write whose condition does not hold:
+// http.StatusPreconditionFailed if the request has an If-Match or If-None-Match header,
+// as HTTP defines for them, otherwise http.StatusConflict for the mode, if-value
+// and if-version parameters, which are not HTTP preconditions.
+func conditionFailedStatus(r *http.Request) int {
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusConflict
+}
+
+// checkConditional reports whether the conditional write of the key can be decided by this node,
+// otherwise it replies with an error. During a reshard the current value of the key
+// may still be on its previous owner.
+func (s *Server) checkConditional(w http.ResponseWriter, key string) bool {
+	if s.previousOwner(key) != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Error = key %q is being migrated, retry once the reshard is done", key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+// set sends a set request with the extra parameters and returns the status and version.
+func set(t *testing.T, base, key, value string, params url.Values) (status int, version string) {
+	t.Helper()
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("key", key)
+	params.Set("value", value)
+	resp, err := http.Get(base + "/set?" + params.Encode())
+	if err != nil {
+		t.Fatalf("Set request error: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get(api.VersionHeader)
+}
+
+func TestConditionalSet(t *testing.T) {
+	var handlers [2]*api.Server
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) { handlers[i].GetHandler(w, r) })
+		mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) { handlers[i].SetHandler(w, r) })
+		mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) { handlers[i].DeleteHandler(w, r) })
+		servers[i] = httptest.NewServer(mux)
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	_, handlers[0] = createShardServer(t, 0, addrs)
+	_, handlers[1] = createShardServer(t, 1, addrs)
+
+	// Apple belongs to shard 1, requests to shard 0 are redirected.
+	base := servers[0].URL
+	if status, _ := set(t, base, "Apple", "v1", url.Values{"mode": {"bogus"}}); status != http.StatusBadRequest {
+		t.Errorf("Set with an unknown mode: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	status, version := set(t, base, "Apple", "v1", url.Values{"mode": {"if-absent"}})
+	if status != http.StatusOK || version == "" {
+		t.Fatalf("Set if-absent of a new key: got status %d and version %q, want %d and a version", status, version, http.StatusOK)
+	}
+	if status, _ := set(t, base, "Apple", "v2", url.Values{"mode": {"if-absent"}}); status != http.StatusConflict {
+		t.Errorf("Set if-absent of an existing key: got status %d, want %d", status, http.StatusConflict)
+	}
+	if status, _ := set(t, base, "Banana", "v1", url.Values{"mode": {"if-exists"}}); status != http.StatusConflict {
+		t.Errorf("Set if-exists of a missing key: got status %d, want %d", status, http.StatusConflict)
+	}
+
+	resp, err := http.Get(base + "/get?key=Apple")
+	if err != nil {
+		t.Fatalf("Get request error: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(api.VersionHeader); got != version {
+		t.Errorf("Version of Apple: got %q, want %q", got, version)
+	}
+
+	status, next := set(t, base, "Apple", "v2", url.Values{"if-version": {version}})
+	if status != http.StatusOK || next == version {
+		t.Errorf("Compare-and-set with the current version: got status %d and version %q, want %d and a new version", status, next, http.StatusOK)
+	}
+	if status, _ := set(t, base, "Apple", "v3", url.Values{"if-version": {version}}); status != http.StatusConflict {
+		t.Errorf("Compare-and-set with an old version: got status %d, want %d", status, http.StatusConflict)
+	}
+	if status, _ := set(t, base, "Apple", "v3", url.Values{"if-value": {"v2"}}); status != http.StatusOK {
+		t.Errorf("Compare-and-set with the current value: got status %d, want %d", status, http.StatusOK)
+	}
+
+	status, body := get(t, base+"/delete?key=Apple&if-value=v2")
+	if status != http.StatusConflict {
+		t.Errorf("Delete with an old value: got status %d (%s), want %d", status, body, http.StatusConflict)
+	}
+	if _, body := get(t, base+"/get?key=Apple"); !strings.Contains(body, fmt.Sprintf("Value = %q", "v3")) {
+		t.Errorf("Get after failed delete: got %q, want the value", body)
+	}
+}
+
+// getWithHeader sends a get request with the header and returns the response.
+func getWithHeader(t *testing.T, url, header, value string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest(%q): %v", url, err)
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get request error: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestETag(t *testing.T) {
+	var handlers [2]*api.Server
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) { handlers[i].GetHandler(w, r) })
+		mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) { handlers[i].SetHandler(w, r) })
+		servers[i] = httptest.NewServer(mux)
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	_, handlers[0] = createShardServer(t, 0, addrs)
+	_, handlers[1] = createShardServer(t, 1, addrs)
+
+	// Apple belongs to shard 1, requests to shard 0 are redirected.
+	base := servers[0].URL
+	if resp := getWithHeader(t, base+"/get?key=Apple", "If-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Get of a missing key with If-Match *: got status %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if resp := getWithHeader(t, base+"/set?key=Apple&value=v1", "If-None-Match", "*"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Set of a new key with If-None-Match *: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := getWithHeader(t, base+"/set?key=Apple&value=v2", "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Set of an existing key with If-None-Match *: got status %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	resp := getWithHeader(t, base+"/get?key=Apple", "", "")
+	tag := resp.Header.Get("ETag")
+	if want := `"` + resp.Header.Get(api.VersionHeader) + `"`; tag != want {
+		t.Fatalf("ETag of Apple: got %q, want %q", tag, want)
+	}
+	if resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("Get of Apple: got no Last-Modified header")
+	}
+
+	if resp := getWithHeader(t, base+"/get?key=Apple", "If-None-Match", `"1", W/`+tag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != tag {
+		t.Errorf("Get with a matching If-None-Match: got status %d and ETag %q, want %d and %q", resp.StatusCode, resp.Header.Get("ETag"), http.StatusNotModified, tag)
+	}
+	if resp := getWithHeader(t, base+"/get?key=Apple", "If-Match", tag); resp.StatusCode != http.StatusOK {
+		t.Errorf("Get with a matching If-Match: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := getWithHeader(t, base+"/get?key=Apple", "If-Match", "bogus"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Get with an invalid If-Match: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp = getWithHeader(t, base+"/set?key=Apple&value=v2", "If-Match", tag)
+	next := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || next == "" || next == tag {
+		t.Errorf("Set with a matching If-Match: got status %d and ETag %q, want %d and a new ETag", resp.StatusCode, next, http.StatusOK)
+	}
+	if resp := getWithHeader(t, base+"/set?key=Apple&value=v3", "If-Match", tag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Set with an old If-Match: got status %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if resp := getWithHeader(t, base+"/get?key=Apple", "If-None-Match", tag); resp.StatusCode != http.StatusOK {
+		t.Errorf("Get with an old If-None-Match: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestETagWithoutVersion(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	// Keys written before versions were kept have none.
+	err := db.RestoreSnapshot(1, func(put func(e internalDB.KeyValue) error) error {
+		return put(internalDB.KeyValue{Key: "old", Value: []byte("value")})
+	})
+	if err != nil {
+		t.Fatalf("RestoreSnapshot: got %v, want nil error", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(srv.GetHandler))
+	defer ts.Close()
+
+	resp := getWithHeader(t, ts.URL+"/get?key=old", "", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != "" || resp.Header.Get(api.VersionHeader) != "" {
+		t.Errorf("Get of a key without a version: got status %d, ETag %q and version %q, want %d without either",
+			resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get(api.VersionHeader), http.StatusOK)
+	}
+	if resp := getWithHeader(t, ts.URL+"/get?key=old", "If-Match", "*"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Get of a key without a version with If-Match *: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := getWithHeader(t, ts.URL+"/get?key=old", "If-None-Match", "*"); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Get of a key without a version with If-None-Match *: got status %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+	if resp := getWithHeader(t, ts.URL+"/get?key=old", "If-Match", `"1"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Get of a key without a version with If-Match \"1\": got status %d, want %d", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+// StatusTooStale is returned by GetHandler when the node cannot satisfy
+// the requested freshness in time and the client did not ask to forward the read.
+const StatusTooStale = http.StatusTooEarly
+
+// staleReadWait is how long a read waits for the node to catch up
+// before it is forwarded to the leader or rejected.
+const staleReadWait = 500 * time.Millisecond
+
+// stalePollInterval is how often the staleness of a replica is rechecked
+// while no new log entries are applied.
+const stalePollInterval = 50 * time.Millisecond
+
+// Freshness is the freshness a client requires from a read.
+type Freshness struct {
+	// MinSeq is the lowest log position the node must have applied,
+	// typically the seq returned for an earlier write of the client.
+	MinSeq uint64
+	// MaxStaleness is how long ago a replica may have last heard from the leader.
+	// An idle replica hears from the leader every streamHeartbeat, so smaller values
+	// make reads wait for the next heartbeat, up to staleReadWait.
+	MaxStaleness time.Duration
+}
+
+// requestFreshness parses the min_seq and max_staleness parameters of a read.
+func requestFreshness(r *http.Request) (f Freshness, err error) {
+	if v := r.Form.Get("min_seq"); v != "" {
+		if f.MinSeq, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return f, fmt.Errorf("invalid min_seq %q: %w", v, err)
+		}
+	}
+	if v := r.Form.Get("max_staleness"); v != "" {
+		if f.MaxStaleness, err = time.ParseDuration(v); err != nil {
+			return f, fmt.Errorf("invalid max_staleness %q: %w", v, err)
+		}
+	}
+	return f, nil
+}
+
+// position returns the last written sequence number on a leader
+// and the last applied one otherwise.
+func (s *Server) position() (uint64, error) {
+	if s.db.ReadOnly() {
+		return s.db.AppliedSeq()
+	}
+	return s.db.LastSeq()
+}
+
+// fresh reports whether the node satisfies f. A replica is as stale as the
+// last message received from the leader, which sends heartbeats when idle.
+func (s *Server) fresh(f Freshness) (bool, error) {
+	seq, err := s.position()
+	if err != nil || seq < f.MinSeq {
+		return false, err
+	}
+	if f.MaxStaleness <= 0 || !s.db.ReadOnly() {
+		return true, nil
+	}
+	if s.raft != nil {
+		return s.raft.Role() == raft.Leader, nil
+	}
+	if s.stats == nil {
+		return false, nil
+	}
+	return time.Since(s.stats.Get().LastPull) <= f.MaxStaleness, nil
+}
+
+// waitFresh waits up to staleReadWait for the node to satisfy f.
+func (s *Server) waitFresh(r *http.Request, f Freshness) (bool, error) {
+	if f == (Freshness{}) {
+		return true, nil
+	}
+
+	deadline := time.NewTimer(staleReadWait)
+	defer deadline.Stop()
+	for {
+		changed := s.db.Changed()
+		if ok, err := s.fresh(f); ok || err != nil {
+			return ok, err
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(stalePollInterval):
+		case <-deadline.C:
+			return false, nil
+		case <-r.Context().Done():
+			return false, r.Context().Err()
+		}
+	}
+}
+
+// replyStale handles a read the node is too stale for. Replicas forward it
+// to the shard leader if the client passed on_stale=forward.
+func (s *Server) replyStale(w http.ResponseWriter, r *http.Request, f Freshness) {
+	if r.Form.Get("on_stale") == "forward" && s.db.ReadOnly() && s.raft == nil {
+		s.redirect(s.shards.CurrentIdx(), w, r)
+		return
+	}
+
+	seq, _ := s.position()
+	w.Header().Set(replica.LogPositionHeader, strconv.FormatUint(seq, 10))
+	w.WriteHeader(StatusTooStale)
+	fmt.Fprintf(w, "Error = node is too stale: seq = %d, min_seq = %d, max_staleness = %v", seq, f.MinSeq, f.MaxStaleness)
+}
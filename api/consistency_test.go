@@ -0,0 +1,190 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+func createReplicaServer(t *testing.T, leader string) (*internalDB.Database, *api.Server) {
+	t.Helper()
+
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "replica")
+	if err != nil {
+		t.Fatalf("Could not create a temp db: %v", err)
+	}
+	tmpFile.Close()
+
+	name := tmpFile.Name()
+	t.Cleanup(func() { os.Remove(name) })
+
+	db, closeFunc, err := internalDB.NewDatabase(name, true)
+	if err != nil {
+		t.Fatalf("Could not create new database %q: %v", name, err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	return db, api.NewServer(db, &config.Shards{Addrs: map[int]string{0: leader}, Count: 1})
+}
+
+func get(t *testing.T, url string) (status int, body string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Get request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	return resp.StatusCode, string(res)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	leaderDB, leader := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	leaderTS := httptest.NewServer(http.HandlerFunc(leader.GetHandler))
+	defer leaderTS.Close()
+
+	db, srv := createReplicaServer(t, strings.TrimPrefix(leaderTS.URL, "http://"))
+	ts := httptest.NewServer(http.HandlerFunc(srv.GetHandler))
+	defer ts.Close()
+
+	if _, err := leaderDB.Set("a", []byte("b")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+	entries, err := leaderDB.LogEntries(0, 10)
+	if err != nil {
+		t.Fatalf("LogEntries(0, 10): got %v, want nil error", err)
+	}
+
+	// The read waits for the replica to apply the write.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.ApplyLogEntries(entries)
+	}()
+	if status, body := get(t, ts.URL+"/get?key=a&min_seq=1"); status != http.StatusOK || !strings.Contains(body, `Value = "b"`) {
+		t.Errorf("Get with min_seq=1: got %d %q, want %d with value %q", status, body, http.StatusOK, "b")
+	}
+
+	if status, _ := get(t, ts.URL+"/get?key=a&min_seq=2"); status != api.StatusTooStale {
+		t.Errorf("Get with min_seq=2: got status %d, want %d", status, api.StatusTooStale)
+	}
+	if status, _ := get(t, ts.URL+"/get?key=a&max_staleness=1s"); status != api.StatusTooStale {
+		t.Errorf("Get with max_staleness without replication: got status %d, want %d", status, api.StatusTooStale)
+	}
+	if status, _ := get(t, ts.URL+"/get?key=a&min_seq=x"); status != http.StatusBadRequest {
+		t.Errorf("Get with invalid min_seq: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Reads forwarded to the leader see the latest writes.
+	if _, err := leaderDB.Set("a", []byte("c")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+	if status, body := get(t, ts.URL+"/get?key=a&min_seq=2&on_stale=forward"); status != http.StatusOK || !strings.Contains(body, `Value = "c"`) {
+		t.Errorf("Forwarded get with min_seq=2: got %d %q, want %d with value %q", status, body, http.StatusOK, "c")
+	}
+	if status, _ := get(t, ts.URL+"/get?key=a&min_seq=3&on_stale=forward"); status != api.StatusTooStale {
+		t.Errorf("Forwarded get with min_seq=3: got status %d, want %d", status, api.StatusTooStale)
+	}
+}
+
+func TestWriteLogPosition(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	ts := httptest.NewServer(http.HandlerFunc(srv.SetHandler))
+	defer ts.Close()
+
+	for _, want := range []string{"1", "2"} {
+		resp, err := http.Get(ts.URL + "/set?key=a&value=b")
+		if err != nil {
+			t.Fatalf("Set request error: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(replica.LogPositionHeader); got != want {
+			t.Errorf("Set log position: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMaxStalenessIdleReplica(t *testing.T) {
+	leaderDB, leader := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/stream", leader.StreamLog)
+	mux.HandleFunc("/replication/snapshot", leader.Snapshot)
+	mux.HandleFunc("/ack-log", leader.AckLog)
+	leaderTS := httptest.NewServer(mux)
+	defer leaderTS.Close()
+	leaderAddr := strings.TrimPrefix(leaderTS.URL, "http://")
+
+	if _, err := leaderDB.Set("a", []byte("b")); err != nil {
+		t.Fatalf("Could not set the key %q: %v", "a", err)
+	}
+
+	db, srv := createReplicaServer(t, leaderAddr)
+	var stats replica.Stats
+	srv.SetReplicaStats(&stats)
+	ts := httptest.NewServer(http.HandlerFunc(srv.GetHandler))
+	defer ts.Close()
+
+	// The replication client idles once the replica is made the leader
+	// and its stream is closed.
+	shards := &config.Shards{Addrs: map[int]string{0: leaderAddr}, Count: 1}
+	go replica.ClientLoop(db, shards, "replica", &stats)
+	defer func() {
+		shards.SetLeader(0, "replica")
+		leaderTS.CloseClientConnections()
+	}()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if value, _ := db.Get("a"); string(value) == "b" {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Replica did not catch up")
+		}
+	}
+
+	// Nothing is written, the replica only hears heartbeats from the leader.
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if status, body := get(t, ts.URL+"/get?key=a&max_staleness=50ms"); status != http.StatusOK || !strings.Contains(body, `Value = "b"`) {
+			t.Errorf("Get with max_staleness=50ms from an idle replica: got %d %q, want %d with value %q", status, body, http.StatusOK, "b")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Durability defines when a write is acknowledged to the client.
+type Durability string
+
+const (
+	// DurabilityAsync acknowledges a write once the leader commits it.
+	DurabilityAsync Durability = "async"
+	// DurabilitySemiSync additionally waits for at least one replica.
+	DurabilitySemiSync Durability = "semi-sync"
+	// DurabilityAll additionally waits for all registered replicas.
+	DurabilityAll Durability = "all"
+)
+
+// DefaultAckTimeout is how long a write waits for replica acknowledgements by default.
+const DefaultAckTimeout = time.Second
+
+// ParseDurability parses the durability mode name.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityAsync, DurabilitySemiSync, DurabilityAll:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown durability mode %q", s)
+}
+
+// SetDurability sets the default durability mode of writes and
+// how long a write waits for replica acknowledgements.
+func (s *Server) SetDurability(d Durability, ackTimeout time.Duration) {
+	s.durability = d
+	s.ackTimeout = ackTimeout
+}
+
+// requestDurability returns the durability requested by the client,
+// or the server default if the request does not specify one.
+func (s *Server) requestDurability(r *http.Request) (Durability, error) {
+	if d := r.Form.Get("durability"); d != "" {
+		return ParseDurability(d)
+	}
+	if s.durability == "" {
+		return DurabilityAsync, nil
+	}
+	return s.durability, nil
+}
+
+// waitForReplicas blocks until the write with the given sequence number
+// satisfies the durability mode or the acknowledgement timeout expires.
+func (s *Server) waitForReplicas(r *http.Request, d Durability, seq uint64) error {
+	var n int
+	switch d {
+	case DurabilityAsync:
+		return nil
+	case DurabilitySemiSync:
+		n = 1
+	case DurabilityAll:
+		n = -1
+	}
+
+	timeout := s.ackTimeout
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	return s.db.WaitForAcks(ctx, seq, n)
+}
@@ -0,0 +1,90 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+)
+
+func TestParseDurability(t *testing.T) {
+	for _, s := range []string{"async", "semi-sync", "all"} {
+		if d, err := api.ParseDurability(s); err != nil || string(d) != s {
+			t.Errorf("ParseDurability(%q): got %q, %v; want %q, nil", s, d, err, s)
+		}
+	}
+	if _, err := api.ParseDurability("sync"); err == nil {
+		t.Errorf(`ParseDurability("sync"): got nil error, want non-nil error`)
+	}
+}
+
+func TestSetDurability(t *testing.T) {
+	db, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	srv.SetDurability(api.DurabilitySemiSync, 10*time.Millisecond)
+	if err := db.RegisterReplica("replica"); err != nil {
+		t.Fatalf("RegisterReplica: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.SetHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/set?key=a&value=b")
+	if err != nil {
+		t.Fatalf("Set request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Semi-sync set without replica acks: got status %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	resp, err = http.Get(ts.URL + "/set?key=a&value=b&durability=async")
+	if err != nil {
+		t.Fatalf("Set request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Async set: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Once the replica catches up, semi-sync writes succeed.
+	go func() {
+		time.Sleep(2 * time.Millisecond)
+		db.AckReplica("replica", 3)
+	}()
+	srv.SetDurability(api.DurabilitySemiSync, time.Second)
+	resp, err = http.Get(ts.URL + "/set?key=a&value=c")
+	if err != nil {
+		t.Fatalf("Set request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Semi-sync set with replica ack: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+// ConfigEpochHeader carries the config epoch of the node that routed a request.
+// Nodes reject requests routed with a different epoch, so a node with a stale
+// config cannot send keys to the wrong shard.
+const ConfigEpochHeader = "X-Config-Epoch"
+
+// ReloadConfig atomically switches the routing to next. A config with the same epoch
+// may only change addresses, a newer epoch starts a reshard, older epochs are rejected.
+// Leaders changed at runtime by a failover stay in place on a reload with the same epoch
+// as long as next still lists them as members of their shard.
+func (s *Server) ReloadConfig(next *config.Shards) error {
+	cur := s.shards.Clone()
+	switch {
+	case next.Epoch < cur.Epoch:
+		return fmt.Errorf("config epoch %d is older than the current epoch %d", next.Epoch, cur.Epoch)
+	case next.Epoch == cur.Epoch:
+		if !cur.SamePlacement(next) {
+			return fmt.Errorf("config moves keys between shards without a new epoch, current epoch is %d", cur.Epoch)
+		}
+		next = next.Clone()
+		next.KeepLeaders(cur)
+		if err := s.saveConfig(next); err != nil {
+			return fmt.Errorf("saving config epoch %d: %v", next.Epoch, err)
+		}
+		s.shards.Update(next)
+		s.registerReplicas(cur)
+		log.Printf("Reloaded config at epoch %d", next.Epoch)
+		return nil
+	}
+	return s.Reshard(cur, next)
+}
+
+// registerReplicas registers the replicas the current config lists for the shard this
+// node leads and unregisters those that prev listed but the current config does not,
+// so the log is neither kept for removed replicas nor dropped before new ones read it.
+// Raft groups keep their own log, replicas have none to keep.
+func (s *Server) registerReplicas(prev *config.Shards) {
+	if s.raft != nil || s.db.ReadOnly() {
+		return
+	}
+	self := s.shards.Leader(s.shards.CurrentIdx())
+	if err := replica.RegisterReplicas(s.db, s.shards, prev, self); err != nil {
+		log.Printf("Registering the replicas of epoch %d: %v", s.shards.CurrentEpoch(), err)
+	}
+}
+
+// saveConfig stores the config of next in the database,
+// a restarted node routes by it if its config file is older, see StartupConfig.
+func (s *Server) saveConfig(next *config.Shards) error {
+	data, err := config.Encode(next.Config())
+	if err != nil {
+		return err
+	}
+	return s.db.SaveConfig(data)
+}
+
+// StartupConfig returns the config a node starts with: the config saved by its last
+// reshard or reload if it has a newer epoch than the config file c, otherwise c.
+func StartupConfig(d *db.Database, c config.Config) (res config.Config, saved bool, err error) {
+	data, err := d.SavedConfig()
+	if err != nil || data == nil {
+		return c, false, err
+	}
+	res, err = config.Parse(data)
+	if err != nil {
+		return c, false, fmt.Errorf("parsing the saved config: %v", err)
+	}
+	if res.Epoch <= c.Epoch {
+		return c, false, nil
+	}
+	return res, true, nil
+}
+
+// ConfigHandler reloads the config in the request body.
+func (s *Server) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	c, err := config.Parse(data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	next, err := config.ParseNextConfig(c, s.shards.Clone().CurName)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	if err := s.ReloadConfig(next); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+// checkEpoch rejects a request routed by a node with a different config epoch
+// with http.StatusMisdirectedRequest and returns false, so that it cannot be
+// mistaken for a failed condition. The epoch of this node is returned in
+// ConfigEpochHeader either way.
+func (s *Server) checkEpoch(w http.ResponseWriter, r *http.Request) bool {
+	epoch := s.shards.CurrentEpoch()
+	w.Header().Set(ConfigEpochHeader, strconv.FormatUint(epoch, 10))
+
+	v := r.Header.Get(ConfigEpochHeader)
+	if v == "" || v == strconv.FormatUint(epoch, 10) {
+		return true
+	}
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	fmt.Fprintf(w, "Error = request routed with config epoch %s, current epoch is %d", v, epoch)
+	return false
+}
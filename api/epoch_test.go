@@ -0,0 +1,147 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+)
+
+func TestConfigEpoch(t *testing.T) {
+	const cfg = `
+	epoch = 3
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = "127.0.0.1:0"`
+	srv := api.NewServer(createShardDB(t, 0), parseConfig(t, cfg, "A"))
+	ts := httptest.NewServer(http.HandlerFunc(srv.GetHandler))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		epoch string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"3", http.StatusOK},
+		{"2", http.StatusMisdirectedRequest},
+		{"4", http.StatusMisdirectedRequest},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/get?key=a", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if tc.epoch != "" {
+			req.Header.Set(api.ConfigEpochHeader, tc.epoch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get request error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("Get routed with epoch %q: got status %d, want %d", tc.epoch, resp.StatusCode, tc.want)
+		}
+		if got := resp.Header.Get(api.ConfigEpochHeader); got != "3" {
+			t.Errorf("Get routed with epoch %q: got epoch header %q, want %q", tc.epoch, got, "3")
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	const cfg = `
+	epoch = 3
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = "127.0.0.1:0"
+	[[shards]]
+		name = "B"
+		idx = 1
+		address = "127.0.0.1:1"`
+	shards := parseConfig(t, cfg, "A")
+	srv := api.NewServer(createShardDB(t, 0), shards)
+
+	if err := srv.ReloadConfig(parseConfig(t, strings.Replace(cfg, "127.0.0.1:1", "127.0.0.1:2", 1), "A")); err != nil {
+		t.Errorf("ReloadConfig with a new address: got %v, want nil error", err)
+	}
+	if got := shards.Leader(1); got != "127.0.0.1:2" {
+		t.Errorf("Leader(1) after reload: got %q, want %q", got, "127.0.0.1:2")
+	}
+
+	if err := srv.ReloadConfig(parseConfig(t, strings.Replace(cfg, "epoch = 3", "epoch = 2", 1), "A")); err == nil {
+		t.Errorf("ReloadConfig with an older epoch: got nil error, want non-nil error")
+	}
+	if err := srv.ReloadConfig(parseConfig(t, `placement = "ring"`+cfg, "A")); err == nil {
+		t.Errorf("ReloadConfig with a new placement and the same epoch: got nil error, want non-nil error")
+	}
+}
+
+func TestReloadConfigKeepsLeaders(t *testing.T) {
+	const cfg = `
+	epoch = 3
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = "127.0.0.1:0"
+	[[shards]]
+		name = "B"
+		idx = 1
+		address = "127.0.0.1:1"
+		replicas = ["127.0.0.1:2"]`
+	shards := parseConfig(t, cfg, "A")
+	srv := api.NewServer(createShardDB(t, 0), shards)
+
+	// The replica of B was promoted by a failover.
+	shards.SetLeader(1, "127.0.0.1:2")
+	if err := srv.ReloadConfig(parseConfig(t, strings.Replace(cfg, "127.0.0.1:0", "127.0.0.1:3", 1), "A")); err != nil {
+		t.Fatalf("ReloadConfig with a new address: got %v, want nil error", err)
+	}
+	if got := shards.Leader(0); got != "127.0.0.1:3" {
+		t.Errorf("Leader(0) after reload: got %q, want %q", got, "127.0.0.1:3")
+	}
+	if got := shards.Leader(1); got != "127.0.0.1:2" {
+		t.Errorf("Leader(1) after reload: got %q, want the promoted %q", got, "127.0.0.1:2")
+	}
+	if err := srv.ReloadConfig(parseConfig(t, cfg, "A")); err != nil {
+		t.Fatalf("ReloadConfig: got %v, want nil error", err)
+	}
+	if got := shards.Leader(1); got != "127.0.0.1:2" {
+		t.Errorf("Leader(1) after the second reload: got %q, want the promoted %q", got, "127.0.0.1:2")
+	}
+
+	// A config that removes the promoted leader from the shard wins.
+	if err := srv.ReloadConfig(parseConfig(t, strings.Replace(cfg, "127.0.0.1:2", "127.0.0.1:4", 1), "A")); err != nil {
+		t.Fatalf("ReloadConfig without the promoted leader: got %v, want nil error", err)
+	}
+	if got := shards.Leader(1); got != "127.0.0.1:1" {
+		t.Errorf("Leader(1) after reload without the promoted leader: got %q, want %q", got, "127.0.0.1:1")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/gossip"
+)
+
+// SetGossip makes the server answer gossip pings of the other members.
+func (s *Server) SetGossip(g *gossip.Gossip) {
+	s.gossip = g
+}
+
+func (s *Server) GossipPing(w http.ResponseWriter, r *http.Request) {
+	var msg gossip.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(s.gossip.Ping(&msg))
+}
+
+// GossipPingReq pings the target member on behalf of the sender,
+// who could not reach it directly.
+func (s *Server) GossipPingReq(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("target")
+	if target == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: target is required")
+		return
+	}
+	var msg gossip.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	reply, err := s.gossip.PingReq(target, &msg)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// GossipMembers reports the members of the cluster as seen by this node.
+func (s *Server) GossipMembers(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.gossip.Members())
+}
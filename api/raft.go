@@ -0,0 +1,191 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+// raftForwardedHeader marks writes forwarded to the Raft leader,
+// they are not forwarded again if the leader changed in the meantime.
+const raftForwardedHeader = "X-Raft-Forwarded"
+
+// raftProposeTimeout is how long a write waits to be committed through Raft.
+const raftProposeTimeout = 5 * time.Second
+
+// maxExtraKeysBatch is the number of extra keys read at once to delete them through Raft.
+const maxExtraKeysBatch = 1000
+
+// SetRaft makes the server commit writes through the Raft group of the node.
+func (s *Server) SetRaft(n *raft.Node) {
+	s.raft = n
+}
+
+// raftWrite commits the write through Raft, writes received by a follower
+// are forwarded to the leader. The condition of a conditional write, if not nil,
+// is checked when the entry is applied.
+func (s *Server) raftWrite(w http.ResponseWriter, r *http.Request, op db.Op, key string, value []byte, cond *db.Condition, shard int) {
+	ctx, cancel := context.WithTimeout(r.Context(), raftProposeTimeout)
+	defer cancel()
+
+	var seq uint64
+	var err error
+	if cond != nil {
+		seq, err = s.raft.ProposeIf(ctx, op, key, value, *cond)
+	} else {
+		seq, err = s.raft.Propose(ctx, op, key, value)
+	}
+
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) && notLeader.Leader != "" && r.Header.Get(raftForwardedHeader) == "" {
+		s.forwardToRaftLeader(notLeader.Leader, w, r)
+		return
+	}
+	switch {
+	case errors.Is(err, db.ErrConditionFailed):
+		w.WriteHeader(conditionFailedStatus(r))
+	case err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.Header().Set(replica.LogPositionHeader, strconv.FormatUint(seq, 10))
+		if op != db.OpDelete {
+			w.Header().Set(VersionHeader, strconv.FormatUint(seq, 10))
+			w.Header().Set("ETag", etag(seq))
+		}
+	}
+	fmt.Fprintf(w, "Error = %v, shard = %d, current shard = %d, seq = %d", err, shard, s.shards.CurrentIdx(), seq)
+}
+
+// raftDeleteExtraKeys commits a delete through Raft for every key that does not
+// belong to this shard, so that all members of the group delete them.
+// Requests received by a follower are forwarded to the leader.
+func (s *Server) raftDeleteExtraKeys(w http.ResponseWriter, r *http.Request, isExtra func(string) bool) {
+	var after string
+	err := func() error {
+		for {
+			entries, err := s.db.ExtraKeys(after, maxExtraKeysBatch, isExtra)
+			if err != nil || len(entries) == 0 {
+				return err
+			}
+			for _, e := range entries {
+				ctx, cancel := context.WithTimeout(r.Context(), raftProposeTimeout)
+				_, err := s.raft.Propose(ctx, db.OpDelete, e.Key, nil)
+				cancel()
+				if err != nil {
+					return err
+				}
+			}
+			after = entries[len(entries)-1].Key
+		}
+	}()
+
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) && notLeader.Leader != "" && r.Header.Get(raftForwardedHeader) == "" {
+		s.forwardToRaftLeader(notLeader.Leader, w, r)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
+
+func (s *Server) forwardToRaftLeader(leader string, w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, "http://"+leader+r.RequestURI, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error forwarding request: %v", err)
+		return
+	}
+	req.Header.Set(raftForwardedHeader, "1")
+	for _, h := range []string{"If-Match", "If-None-Match"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(ConfigEpochHeader, strconv.FormatUint(s.shards.CurrentEpoch(), 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error forwarding request to raft leader %q: %v", leader, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{replica.LogPositionHeader, VersionHeader, "ETag"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (s *Server) RaftRequestVote(w http.ResponseWriter, r *http.Request) {
+	var args raft.RequestVoteArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(s.raft.RequestVote(&args))
+}
+
+func (s *Server) RaftAppendEntries(w http.ResponseWriter, r *http.Request) {
+	var args raft.AppendEntriesArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(s.raft.AppendEntries(&args))
+}
+
+func (s *Server) RaftInstallSnapshot(w http.ResponseWriter, r *http.Request) {
+	reply, err := s.raft.InstallSnapshot(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (s *Server) RaftStatus(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.raft.Status())
+}
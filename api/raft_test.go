@@ -0,0 +1,119 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
+)
+
+// createRaftServer returns a server of shard 0 of two that commits writes through
+// a Raft group of a single node.
+func createRaftServer(t *testing.T) (*internalDB.Database, *raft.Node, *api.Server) {
+	t.Helper()
+
+	var paths []string
+	for _, prefix := range []string{"raftdb", "raftlog"} {
+		f, err := ioutil.TempFile(os.TempDir(), prefix)
+		if err != nil {
+			t.Fatalf("Cannot create temp file: %v", err)
+		}
+		f.Close()
+		t.Cleanup(func() { os.Remove(f.Name()) })
+		paths = append(paths, f.Name())
+	}
+
+	db, closeDB, err := internalDB.NewDatabase(paths[0], true)
+	if err != nil {
+		t.Fatalf("Cannot create a new database: %v", err)
+	}
+	node, closeNode, err := raft.Open(paths[1], "127.0.0.1:1", nil, db)
+	if err != nil {
+		t.Fatalf("raft.Open: %v", err)
+	}
+	t.Cleanup(func() {
+		closeNode()
+		closeDB()
+	})
+	go node.Run()
+
+	srv := api.NewServer(db, &config.Shards{
+		Addrs:  map[int]string{0: "127.0.0.1:1", 1: "127.0.0.1:2"},
+		Count:  2,
+		CurIdx: 0,
+	})
+	srv.SetRaft(node)
+	return db, node, srv
+}
+
+func TestRaftDeleteExtraKeys(t *testing.T) {
+	db, node, srv := createRaftServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Apple belongs to shard 1, the key is misplaced on shard 0.
+	for _, key := range []string{"Apple", "Banana"} {
+		for {
+			_, err := node.Propose(ctx, internalDB.OpSet, key, []byte("value"))
+			var notLeader *raft.NotLeaderError
+			if !errors.As(err, &notLeader) {
+				if err != nil {
+					t.Fatalf("Propose(%q): %v", key, err)
+				}
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	last := node.Status().LastIndex
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.DeleteExtraKeysHandler))
+	defer ts.Close()
+	if status, body := get(t, ts.URL+"/delete-extra"); status != http.StatusOK {
+		t.Fatalf("DeleteExtraKeys: got status %d %q, want %d", status, body, http.StatusOK)
+	}
+
+	// The delete is committed through the log, so every member applies it.
+	if value, err := db.Get("Apple"); err != nil || value != nil {
+		t.Errorf(`Get("Apple") after DeleteExtraKeys: got %q, %v, want nil`, value, err)
+	}
+	if value, err := db.Get("Banana"); err != nil || string(value) != "value" {
+		t.Errorf(`Get("Banana") after DeleteExtraKeys: got %q, %v, want %q`, value, err, "value")
+	}
+	if got := node.Status().LastIndex; got != last+1 {
+		t.Errorf("Raft log after DeleteExtraKeys: got last index %d, want %d", got, last+1)
+	}
+}
@@ -0,0 +1,488 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+// reshardReadHeader marks reads sent to the previous owner of a key during a reshard,
+// the previous owner serves them from its local data instead of redirecting.
+const reshardReadHeader = "X-Reshard-Read"
+
+// migrationBatch is the largest number of keys sent to a new owner at once.
+const migrationBatch = 1000
+
+// migrationRetry is how long a failed migration step waits before it is retried.
+const migrationRetry = time.Second
+
+// migration is the state of a reshard in progress. It is saved in the database,
+// a node restarted during a reshard resumes it with ResumeMigration.
+type migration struct {
+	prev    *config.Shards  // routing before the reshard
+	epoch   uint64          // epoch of the new config
+	done    map[int]bool    // shards of prev that moved all their misplaced keys
+	deleted map[string]bool // keys deleted during the reshard, they are not imported
+}
+
+// Reshard switches the routing from prev to next and moves the keys this shard
+// no longer owns to their new owners. Until every shard of prev has moved its keys,
+// reads of missing keys fall back to their previous owner.
+// Misplaced keys are only deleted once their new owners confirmed receipt.
+// The new config is saved before the routing switches to it.
+func (s *Server) Reshard(prev, next *config.Shards) error {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if err := s.canReshard(prev, next); err != nil {
+		return err
+	}
+	m := &migration{
+		prev:    prev,
+		epoch:   next.Epoch,
+		done:    make(map[int]bool),
+		deleted: make(map[string]bool),
+	}
+	// The migration is saved first: a node restarted in between resumes
+	// no migration for a config it has not switched to.
+	if err := s.saveMigration(m); err != nil {
+		return fmt.Errorf("saving the reshard to epoch %d: %v", next.Epoch, err)
+	}
+	if err := s.saveConfig(next); err != nil {
+		return fmt.Errorf("saving config epoch %d: %v", next.Epoch, err)
+	}
+
+	if next != s.shards {
+		s.shards.Update(next)
+	}
+	s.registerReplicas(prev)
+	s.migration = m
+	log.Printf("Resharding from epoch %d to epoch %d", prev.Epoch, next.Epoch)
+
+	if !s.db.ReadOnly() && prev.CurIdx >= 0 {
+		go s.migrate(m)
+	}
+	return nil
+}
+
+// savedMigration is the encoding of a migration in the database.
+// Deleted keys are saved one by one with db.MigrationDeleted.
+type savedMigration struct {
+	Epoch uint64
+	Prev  string // the encoded config before the reshard
+	Done  []int
+}
+
+// saveMigration stores m in the database, s.reshardMu must be held.
+func (s *Server) saveMigration(m *migration) error {
+	prev, err := config.Encode(m.prev.Config())
+	if err != nil {
+		return err
+	}
+	saved := savedMigration{Epoch: m.epoch, Prev: string(prev)}
+	for idx := range m.done {
+		saved.Done = append(saved.Done, idx)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return s.db.SaveMigration(data)
+}
+
+// ResumeMigration continues the reshard the node was in when it stopped.
+// A saved reshard to another epoch than the current config is dropped.
+// It must be called before the node serves requests.
+func (s *Server) ResumeMigration() error {
+	data, deleted, err := s.db.SavedMigration()
+	if err != nil || data == nil {
+		return err
+	}
+	var saved savedMigration
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("decoding the saved reshard: %v", err)
+	}
+	cur := s.shards.Clone()
+	if saved.Epoch != cur.Epoch {
+		log.Printf("Dropping the saved reshard to epoch %d, config epoch is %d", saved.Epoch, cur.Epoch)
+		return s.db.EndMigration()
+	}
+	c, err := config.Parse([]byte(saved.Prev))
+	if err != nil {
+		return fmt.Errorf("parsing the config before the saved reshard: %v", err)
+	}
+	prev, err := config.ParseNextConfig(c, cur.CurName)
+	if err != nil {
+		return fmt.Errorf("parsing the config before the saved reshard: %v", err)
+	}
+
+	m := &migration{
+		prev:    prev,
+		epoch:   saved.Epoch,
+		done:    make(map[int]bool),
+		deleted: make(map[string]bool),
+	}
+	for _, idx := range saved.Done {
+		m.done[idx] = true
+	}
+	for _, key := range deleted {
+		m.deleted[key] = true
+	}
+
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	s.migration = m
+	log.Printf("Resuming the reshard from epoch %d to epoch %d, %d of %d shards done", prev.Epoch, m.epoch, len(m.done), prev.ShardCount())
+	// A shard that finished before the restart only tells the other nodes again.
+	if !s.db.ReadOnly() && prev.CurIdx >= 0 {
+		go s.migrate(m)
+	}
+	return nil
+}
+
+// canReshard returns why a reshard from prev to next cannot start, s.reshardMu must be held.
+func (s *Server) canReshard(prev, next *config.Shards) error {
+	if s.raft != nil {
+		return errors.New("resharding is not supported in raft mode")
+	}
+	if s.migration != nil {
+		return fmt.Errorf("reshard to epoch %d is in progress", s.migration.epoch)
+	}
+	if next.Epoch <= prev.Epoch {
+		return fmt.Errorf("config epoch %d must be greater than %d", next.Epoch, prev.Epoch)
+	}
+	return nil
+}
+
+// ReshardHandler starts a reshard to the config in the request body.
+// It must be sent to every node of the old and the new config.
+// With the check parameter the node only reports whether it can start the reshard.
+// A node already on the config replies ok, so the request can be retried.
+func (s *Server) ReshardHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	c, err := config.Parse(data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	prev := s.shards.Clone()
+	next, err := config.ParseNextConfig(c, prev.CurName)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	if next.Epoch == prev.Epoch && next.SamePlacement(prev) {
+		fmt.Fprintf(w, "ok")
+		return
+	}
+
+	if r.URL.Query().Get("check") != "" {
+		s.reshardMu.Lock()
+		err = s.canReshard(prev, next)
+		s.reshardMu.Unlock()
+	} else {
+		err = s.Reshard(prev, next)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+// migrate sends all keys this shard no longer owns to their new owners,
+// deletes them once received and tells every node that this shard is done.
+func (s *Server) migrate(m *migration) {
+	isExtra := func(key string) bool {
+		return s.shards.Index(key) != s.shards.CurrentIdx()
+	}
+
+	var after string
+	var moved int
+	for {
+		if s.shards.CurrentEpoch() != m.epoch {
+			log.Printf("Config changed during the reshard to epoch %d, stopping the migration", m.epoch)
+			return
+		}
+
+		entries, err := s.db.ExtraKeys(after, migrationBatch, isExtra)
+		if err != nil {
+			log.Printf("Migration error: %v", err)
+			time.Sleep(migrationRetry)
+			continue
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		byShard := make(map[int][]db.KeyValue)
+		for _, e := range entries {
+			idx := s.shards.Index(e.Key)
+			byShard[idx] = append(byShard[idx], e)
+		}
+		var failed bool
+		for idx, batch := range byShard {
+			if err := s.sendKeys(s.shards.Leader(idx), m.epoch, batch); err != nil {
+				log.Printf("Migrating %d keys to shard %d failed: %v", len(batch), idx, err)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			time.Sleep(migrationRetry)
+			continue
+		}
+
+		moved += len(entries)
+		after = entries[len(entries)-1].Key
+	}
+
+	// Every misplaced key has been received by its new owner.
+	for {
+		err := s.db.DeleteExtraKeys(isExtra)
+		if err == nil {
+			break
+		}
+		log.Printf("DeleteExtraKeys error: %v", err)
+		time.Sleep(migrationRetry)
+	}
+	log.Printf("Migrated %d keys for the reshard to epoch %d", moved, m.epoch)
+
+	s.notifyMigrationDone(m)
+}
+
+// sendKeys imports the keys on the leader of their new shard.
+func (s *Server) sendKeys(addr string, epoch uint64, entries []db.KeyValue) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	u := url.Values{}
+	u.Set("epoch", strconv.FormatUint(epoch, 10))
+
+	resp, err := http.Post("http://"+addr+"/reshard/import?"+u.Encode(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return nil
+}
+
+// notifyMigrationDone tells all nodes of the old and the new config
+// that this shard has moved all its misplaced keys. Every node is retried
+// until it accepts the notification, a node that misses it would keep
+// reading from the previous owners forever.
+func (s *Server) notifyMigrationDone(m *migration) {
+	u := url.Values{}
+	u.Set("epoch", strconv.FormatUint(m.epoch, 10))
+	u.Set("shard", strconv.Itoa(m.prev.CurIdx))
+
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for _, addr := range append(s.shards.AllAddrs(), m.prev.AllAddrs()...) {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			for attempt := 0; ; attempt++ {
+				err := notifyDone(addr, u)
+				if err == nil {
+					return
+				}
+				if attempt == 0 {
+					log.Printf("Notifying %q about the finished migration failed, retrying until it succeeds: %v", addr, err)
+				}
+				time.Sleep(migrationRetry)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// notifyDone sends a finished migration to the node at addr.
+func notifyDone(addr string, u url.Values) error {
+	resp, err := http.Get("http://" + addr + "/reshard/done?" + u.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return nil
+}
+
+// ImportKeys stores keys migrated to this shard during a reshard.
+func (s *Server) ImportKeys(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	epoch, err := strconv.ParseUint(r.Form.Get("epoch"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if cur := s.shards.CurrentEpoch(); epoch != cur {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = config epoch is %d, not %d", cur, epoch)
+		return
+	}
+
+	var entries []db.KeyValue
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	s.reshardMu.Lock()
+	m := s.migration
+	imported, err := s.db.ImportKeys(entries, func(key string) bool {
+		return m != nil && m.deleted[key] || s.shards.Index(key) != s.shards.CurrentIdx()
+	})
+	s.reshardMu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	fmt.Fprintf(w, "imported = %d", imported)
+}
+
+// MigrationDone records that a shard of the previous config moved all its misplaced keys.
+// The reshard ends once all shards of the previous config are done.
+// A node that has not switched to the epoch yet rejects the notification,
+// so that the sender retries it.
+func (s *Server) MigrationDone(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	epoch, err := strconv.ParseUint(r.Form.Get("epoch"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	if cur := s.shards.CurrentEpoch(); epoch > cur {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = config epoch is %d, not %d", cur, epoch)
+		return
+	}
+	if m := s.migration; m != nil && m.epoch == epoch && !m.done[shard] {
+		m.done[shard] = true
+		if len(m.done) >= m.prev.ShardCount() {
+			err = s.db.EndMigration()
+			if err == nil {
+				log.Printf("Reshard to epoch %d is complete", epoch)
+				s.migration = nil
+			}
+		} else {
+			err = s.saveMigration(m)
+		}
+		if err != nil {
+			delete(m.done, shard)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error = %v", err)
+			return
+		}
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+// previousOwner returns the leader of the shard that owned the key before a reshard
+// in progress if the key may still be found there, or "" otherwise.
+func (s *Server) previousOwner(key string) string {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+
+	m := s.migration
+	if m == nil || m.deleted[key] {
+		return ""
+	}
+	idx := m.prev.Index(key)
+	if idx == m.prev.CurIdx || m.done[idx] {
+		return ""
+	}
+	return m.prev.Leader(idx)
+}
+
+// deleteKey deletes the key if cond holds, remembering it during a reshard
+// so that a migration does not bring it back.
+func (s *Server) deleteKey(key string, cond db.Condition) (seq uint64, err error) {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	seq, err = s.db.DeleteIf(key, cond)
+	if err == nil && s.migration != nil {
+		s.migration.deleted[key] = true
+		err = s.db.MigrationDeleted(key)
+	}
+	return seq, err
+}
+
+// resharding reports whether a reshard is in progress.
+func (s *Server) resharding() bool {
+	s.reshardMu.Lock()
+	defer s.reshardMu.Unlock()
+	return s.migration != nil
+}
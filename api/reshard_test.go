@@ -0,0 +1,408 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func reshardMux(srv *api.Server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", srv.GetHandler)
+	mux.HandleFunc("/delete", srv.DeleteHandler)
+	mux.HandleFunc("/delete-extra", srv.DeleteExtraKeysHandler)
+	mux.HandleFunc("/admin/reshard", srv.ReshardHandler)
+	mux.HandleFunc("/reshard/import", srv.ImportKeys)
+	mux.HandleFunc("/reshard/done", srv.MigrationDone)
+	mux.HandleFunc("/admin/split", srv.SplitHandler)
+	mux.HandleFunc("/admin/merge", srv.MergeHandler)
+	return mux
+}
+
+func parseConfig(t *testing.T, contents, shard string) *config.Shards {
+	t.Helper()
+	c, err := config.Parse([]byte(contents))
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", contents, err)
+	}
+	s, err := config.ParseConfig(c, shard)
+	if err != nil {
+		t.Fatalf("ParseConfig(%q): %v", shard, err)
+	}
+	return s
+}
+
+// waitForReshard waits until the reshard on the node is over,
+// which is when misplaced keys can be deleted again.
+func waitForReshard(t *testing.T, url string) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if status, _ := get(t, url+"/delete-extra"); status == http.StatusOK {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Reshard did not finish")
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	var handlerA, handlerB http.Handler
+	tsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerA.ServeHTTP(w, r) }))
+	defer tsA.Close()
+	tsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerB.ServeHTTP(w, r) }))
+	defer tsB.Close()
+
+	prevConfig := fmt.Sprintf(`
+	epoch = 1
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = %q`, strings.TrimPrefix(tsA.URL, "http://"))
+	nextConfig := fmt.Sprintf(`%s
+	[[shards]]
+		name = "B"
+		idx = 1
+		address = %q`, strings.Replace(prevConfig, "epoch = 1", "epoch = 2", 1), strings.TrimPrefix(tsB.URL, "http://"))
+
+	dbA := createShardDB(t, 0)
+	dbB := createShardDB(t, 1)
+	srvA := api.NewServer(dbA, parseConfig(t, prevConfig, "A"))
+	next := parseConfig(t, nextConfig, "B")
+	srvB := api.NewServer(dbB, next)
+	handlerA, handlerB = reshardMux(srvA), reshardMux(srvB)
+
+	var moved []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := dbA.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+		if next.Index(key) == 1 {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) < 2 {
+		t.Fatalf("Too few keys move to the new shard: %q", moved)
+	}
+
+	// The new shard starts in the middle of the reshard.
+	if err := srvB.Reshard(parseConfig(t, prevConfig, ""), next); err != nil {
+		t.Fatalf("Reshard on the new shard: got %v, want nil error", err)
+	}
+	if status, body := get(t, tsB.URL+"/get?key="+moved[0]); status != http.StatusOK || !strings.Contains(body, fmt.Sprintf("Value = %q", "value-"+moved[0])) {
+		t.Errorf("Dual read of %q before migration: got %d %q, want the value of the previous owner", moved[0], status, body)
+	}
+	if status, _ := get(t, tsB.URL+"/delete?key="+moved[1]); status != http.StatusOK {
+		t.Fatalf("Delete of %q: got status %d, want %d", moved[1], status, http.StatusOK)
+	}
+	if _, body := get(t, tsB.URL+"/get?key="+moved[1]); !strings.Contains(body, `Value = ""`) {
+		t.Errorf("Read of deleted %q: got %q, want no value", moved[1], body)
+	}
+
+	resp, err := http.Post(tsA.URL+"/admin/reshard", "application/toml", strings.NewReader(nextConfig))
+	if err != nil {
+		t.Fatalf("Reshard request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Reshard: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	waitForReshard(t, tsA.URL)
+
+	for _, key := range moved {
+		want := "value-" + key
+		if key == moved[1] {
+			want = ""
+		}
+		if value, err := dbB.Get(key); err != nil || string(value) != want {
+			t.Errorf("Key %q on the new shard: got %q, %v; want %q", key, value, err, want)
+		}
+		if value, err := dbA.Get(key); err != nil || value != nil {
+			t.Errorf("Key %q on the previous shard: got %q, %v; want no value", key, value, err)
+		}
+	}
+}
+
+func TestReshardRestart(t *testing.T) {
+	var handlerA, handlerB http.Handler
+	tsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerA.ServeHTTP(w, r) }))
+	defer tsA.Close()
+	// B rejects the first notifications that a shard finished its migration.
+	var dropped int32
+	tsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reshard/done" && atomic.AddInt32(&dropped, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handlerB.ServeHTTP(w, r)
+	}))
+	defer tsB.Close()
+
+	prevConfig := fmt.Sprintf(`
+	epoch = 1
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = %q`, strings.TrimPrefix(tsA.URL, "http://"))
+	nextConfig := fmt.Sprintf(`%s
+	[[shards]]
+		name = "B"
+		idx = 1
+		address = %q`, strings.Replace(prevConfig, "epoch = 1", "epoch = 2", 1), strings.TrimPrefix(tsB.URL, "http://"))
+
+	dbA := createShardDB(t, 0)
+	handlerA = reshardMux(api.NewServer(dbA, parseConfig(t, prevConfig, "A")))
+	next := parseConfig(t, nextConfig, "B")
+	var moved []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := dbA.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+		if next.Index(key) == 1 {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) < 2 {
+		t.Fatalf("Too few keys move to the new shard: %q", moved)
+	}
+
+	path := filepath.Join(t.TempDir(), "B")
+	dbB, closeB, err := internalDB.NewDatabase(path, false)
+	if err != nil {
+		t.Fatalf("NewDatabase(%q): %v", path, err)
+	}
+	srvB := api.NewServer(dbB, next)
+	handlerB = reshardMux(srvB)
+	if err := srvB.Reshard(parseConfig(t, prevConfig, ""), next); err != nil {
+		t.Fatalf("Reshard on the new shard: got %v, want nil error", err)
+	}
+	if status, _ := get(t, tsB.URL+"/delete?key="+moved[1]); status != http.StatusOK {
+		t.Fatalf("Delete of %q: got status %d, want %d", moved[1], status, http.StatusOK)
+	}
+
+	// B restarts before the migration and resumes the reshard from its database.
+	closeB()
+	dbB, closeB, err = internalDB.NewDatabase(path, false)
+	if err != nil {
+		t.Fatalf("NewDatabase(%q): %v", path, err)
+	}
+	defer closeB()
+	srvB = api.NewServer(dbB, parseConfig(t, nextConfig, "B"))
+	if err := srvB.ResumeMigration(); err != nil {
+		t.Fatalf("ResumeMigration: got %v, want nil error", err)
+	}
+	handlerB = reshardMux(srvB)
+	if status, body := get(t, tsB.URL+"/get?key="+moved[0]); status != http.StatusOK || !strings.Contains(body, fmt.Sprintf("Value = %q", "value-"+moved[0])) {
+		t.Errorf("Dual read of %q after the restart: got %d %q, want the value of the previous owner", moved[0], status, body)
+	}
+
+	resp, err := http.Post(tsA.URL+"/admin/reshard", "application/toml", strings.NewReader(nextConfig))
+	if err != nil {
+		t.Fatalf("Reshard request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Reshard: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	waitForReshard(t, tsA.URL)
+	waitForReshard(t, tsB.URL)
+	if value, err := dbB.Get(moved[1]); err != nil || value != nil {
+		t.Errorf("Key %q deleted before the restart: got %q, %v; want no value", moved[1], value, err)
+	}
+	if value, err := dbB.Get(moved[0]); err != nil || string(value) != "value-"+moved[0] {
+		t.Errorf("Key %q on the new shard: got %q, %v; want %q", moved[0], value, err, "value-"+moved[0])
+	}
+}
+
+func TestSplitMerge(t *testing.T) {
+	var handlerA, handlerB http.Handler
+	tsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerA.ServeHTTP(w, r) }))
+	defer tsA.Close()
+	tsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerB.ServeHTTP(w, r) }))
+	defer tsB.Close()
+	addrB := strings.TrimPrefix(tsB.URL, "http://")
+
+	cfg := fmt.Sprintf(`
+	epoch = 1
+	placement = "range"
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = %q`, strings.TrimPrefix(tsA.URL, "http://"))
+	c, err := config.Parse([]byte(cfg))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	joining, err := config.ParseNextConfig(c, "B")
+	if err != nil {
+		t.Fatalf("ParseNextConfig: %v", err)
+	}
+
+	dbA := createShardDB(t, 0)
+	dbB := createShardDB(t, 1)
+	handlerA = reshardMux(api.NewServer(dbA, parseConfig(t, cfg, "A")))
+	handlerB = reshardMux(api.NewServer(dbB, joining))
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := dbA.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+		keys = append(keys, key)
+	}
+
+	countKeys := func(db *internalDB.Database) int {
+		entries, err := db.Scan("", "", 100)
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		return len(entries)
+	}
+
+	if status, body := get(t, tsA.URL+"/admin/split?shard=0&name=B&addr="+addrB); status != http.StatusOK {
+		t.Fatalf("Split: got %d %q, want status %d", status, body, http.StatusOK)
+	}
+	waitForReshard(t, tsA.URL)
+	waitForReshard(t, tsB.URL)
+	if a, b := countKeys(dbA), countKeys(dbB); a != 5 || b != 5 {
+		t.Errorf("Keys after split: got %d and %d, want 5 and 5", a, b)
+	}
+
+	if status, body := get(t, tsA.URL+"/admin/merge?shard=1&into=0"); status != http.StatusOK {
+		t.Fatalf("Merge: got %d %q, want status %d", status, body, http.StatusOK)
+	}
+	waitForReshard(t, tsB.URL)
+	if a, b := countKeys(dbA), countKeys(dbB); a != 10 || b != 0 {
+		t.Errorf("Keys after merge: got %d and %d, want 10 and 0", a, b)
+	}
+}
+
+func TestSplitRestart(t *testing.T) {
+	var handlerA, handlerB http.Handler
+	tsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerA.ServeHTTP(w, r) }))
+	defer tsA.Close()
+	tsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlerB.ServeHTTP(w, r) }))
+	defer tsB.Close()
+
+	file, err := config.Parse([]byte(fmt.Sprintf(`
+	epoch = 1
+	placement = "range"
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = %q`, strings.TrimPrefix(tsA.URL, "http://"))))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	// start opens the database of the node and routes by the config it starts with.
+	dir := t.TempDir()
+	start := func(name string) (*internalDB.Database, http.Handler, func() error) {
+		t.Helper()
+		db, closeFunc, err := internalDB.NewDatabase(filepath.Join(dir, name), false)
+		if err != nil {
+			t.Fatalf("NewDatabase(%q): %v", name, err)
+		}
+		c, _, err := api.StartupConfig(db, file)
+		if err != nil {
+			t.Fatalf("StartupConfig(%q): %v", name, err)
+		}
+		shards, err := config.ParseNextConfig(c, name)
+		if err != nil {
+			t.Fatalf("ParseNextConfig(%q): %v", name, err)
+		}
+		return db, reshardMux(api.NewServer(db, shards)), closeFunc
+	}
+	epoch := func(url string) string {
+		t.Helper()
+		resp, err := http.Get(url + "/get?key=key-0")
+		if err != nil {
+			t.Fatalf("Get request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get(api.ConfigEpochHeader)
+	}
+
+	dbA, hA, closeA := start("A")
+	_, hB, closeB := start("B")
+	handlerA, handlerB = hA, hB
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := dbA.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set the key %q: %v", key, err)
+		}
+	}
+
+	// A split that one of the nodes cannot accept changes no node.
+	if status, body := get(t, tsA.URL+"/admin/split?shard=0&name=C&addr=127.0.0.1:1"); status != http.StatusBadGateway {
+		t.Errorf("Split to an unreachable node: got %d %q, want status %d", status, body, http.StatusBadGateway)
+	}
+	if got := epoch(tsA.URL); got != "1" {
+		t.Errorf("Epoch after the rejected split: got %q, want %q", got, "1")
+	}
+
+	if status, body := get(t, tsA.URL+"/admin/split?shard=0&name=B&addr="+strings.TrimPrefix(tsB.URL, "http://")); status != http.StatusOK {
+		t.Fatalf("Split: got %d %q, want status %d", status, body, http.StatusOK)
+	}
+	waitForReshard(t, tsA.URL)
+	waitForReshard(t, tsB.URL)
+
+	// Both nodes restart with the config file from before the split.
+	closeA()
+	closeB()
+	_, handlerA, closeA = start("A")
+	defer closeA()
+	_, handlerB, closeB = start("B")
+	defer closeB()
+
+	for _, url := range []string{tsA.URL, tsB.URL} {
+		if got := epoch(url); got != "2" {
+			t.Errorf("Epoch of %s after the restart: got %q, want %q", url, got, "2")
+		}
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if _, body := get(t, url+"/get?key="+key); !strings.Contains(body, fmt.Sprintf("Value = %q", "value-"+key)) {
+				t.Errorf("Get of %q from %s after the restart: got %q, want the value", key, url, body)
+			}
+		}
+	}
+}
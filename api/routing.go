@@ -0,0 +1,160 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadRouting defines where reads forwarded to another shard are sent.
+type ReadRouting string
+
+const (
+	// ReadRoutingLeader sends all reads to the shard leader.
+	ReadRoutingLeader ReadRouting = "leader"
+	// ReadRoutingRoundRobin spreads reads evenly across the replicas of the shard.
+	ReadRoutingRoundRobin ReadRouting = "round-robin"
+	// ReadRoutingLeastLoaded sends reads to the replica with the fewest reads
+	// in flight, preferring replicas that answer faster.
+	ReadRoutingLeastLoaded ReadRouting = "least-loaded"
+)
+
+// ParseReadRouting parses the read routing policy name.
+func ParseReadRouting(s string) (ReadRouting, error) {
+	switch p := ReadRouting(s); p {
+	case ReadRoutingLeader, ReadRoutingRoundRobin, ReadRoutingLeastLoaded:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown read routing policy %q", s)
+}
+
+// SetReadRouting sets where reads for other shards are forwarded to.
+// Replica reads are eventually consistent, clients that need fresh data
+// pass min_seq or max_staleness.
+func (s *Server) SetReadRouting(p ReadRouting) {
+	s.readRouting = p
+}
+
+// latencyWeight is the weight of the latest sample in the moving latency average.
+const latencyWeight = 0.2
+
+// unreachableLatency is the latency recorded for a replica that could not be reached,
+// so least-loaded routing avoids it while other replicas answer faster.
+const unreachableLatency = time.Second
+
+// router keeps the state of the read routing policies per target address.
+type router struct {
+	mu       sync.Mutex
+	next     map[int]int // next round-robin position per shard
+	inflight map[string]int
+	latency  map[string]time.Duration // moving average of forwarded reads
+}
+
+// pick returns the replica of the shard to read from according to p,
+// or the leader if the shard has no replicas.
+func (rt *router) pick(p ReadRouting, shard int, leader string, replicas []string) string {
+	if p == ReadRoutingLeader || p == "" || len(replicas) == 0 {
+		return leader
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if p == ReadRoutingRoundRobin {
+		if rt.next == nil {
+			rt.next = make(map[int]int)
+		}
+		i := rt.next[shard] % len(replicas)
+		rt.next[shard] = i + 1
+		return replicas[i]
+	}
+
+	best := replicas[0]
+	bestScore := rt.score(best)
+	for _, addr := range replicas[1:] {
+		if score := rt.score(addr); score < bestScore {
+			best, bestScore = addr, score
+		}
+	}
+	return best
+}
+
+// score estimates how long a new read on addr would take,
+// addresses without samples are tried first.
+func (rt *router) score(addr string) time.Duration {
+	return rt.latency[addr] * time.Duration(rt.inflight[addr]+1)
+}
+
+// start records a read forwarded to addr, the returned function must be called
+// with the forwarding error once it completes.
+func (rt *router) start(addr string) (done func(err error)) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.inflight == nil {
+		rt.inflight = make(map[string]int)
+		rt.latency = make(map[string]time.Duration)
+	}
+	rt.inflight[addr]++
+
+	start := time.Now()
+	return func(err error) {
+		took := time.Since(start)
+
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		rt.inflight[addr]--
+		if err != nil {
+			rt.latency[addr] = unreachableLatency
+		} else if avg, ok := rt.latency[addr]; ok {
+			rt.latency[addr] = avg + time.Duration(latencyWeight*float64(took-avg))
+		} else {
+			rt.latency[addr] = took
+		}
+	}
+}
+
+// redirectRead forwards a read to the shard according to the read routing policy.
+// If the chosen replica cannot be reached, the read falls back to the leader.
+func (s *Server) redirectRead(shard int, w http.ResponseWriter, r *http.Request) {
+	leader := s.shards.Leader(shard)
+	addr := s.router.pick(s.readRouting, shard, leader, s.shards.ReplicaAddrs(shard))
+	if addr == leader {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	done := s.router.start(addr)
+	err := s.forward(addr, shard, w, r, nil)
+	done(err)
+	if err != nil {
+		log.Printf("Read from replica %q of shard %d failed, falling back to the leader: %v", addr, shard, err)
+		s.redirect(shard, w, r)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+)
+
+func TestParseReadRouting(t *testing.T) {
+	for _, s := range []string{"leader", "round-robin", "least-loaded"} {
+		if p, err := api.ParseReadRouting(s); err != nil || string(p) != s {
+			t.Errorf("ParseReadRouting(%q): got %q, %v; want %q, nil", s, p, err, s)
+		}
+	}
+	if _, err := api.ParseReadRouting("nearest"); err == nil {
+		t.Errorf(`ParseReadRouting("nearest"): got nil error, want non-nil error`)
+	}
+}
+
+func namedServer(t *testing.T, name string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "served by %s", name)
+	}))
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+// keyOfShard returns a key that belongs to the shard.
+func keyOfShard(t *testing.T, shards *config.Shards, shard int) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("key-%d", i); shards.Index(key) == shard {
+			return key
+		}
+	}
+	t.Fatalf("No key found for shard %d", shard)
+	return ""
+}
+
+func TestReadRouting(t *testing.T) {
+	cfg := &config.Shards{
+		Count:  2,
+		CurIdx: 0,
+		Addrs:  map[int]string{0: "127.0.0.1:0", 1: namedServer(t, "leader")},
+		Replicas: map[int][]string{1: {
+			namedServer(t, "r1"),
+			namedServer(t, "r2"),
+			"127.0.0.1:1", // down
+		}},
+	}
+	srv := api.NewServer(createShardDB(t, 0), cfg)
+	ts := httptest.NewServer(http.HandlerFunc(srv.GetHandler))
+	defer ts.Close()
+	url := ts.URL + "/get?key=" + keyOfShard(t, cfg, 1)
+
+	read := func() string {
+		t.Helper()
+		status, body := get(t, url)
+		if status != http.StatusOK {
+			t.Fatalf("Get: got status %d, want %d", status, http.StatusOK)
+		}
+		return body[strings.LastIndex(body, " ")+1:]
+	}
+
+	if got := read(); got != "leader" {
+		t.Errorf("Read with the default policy: served by %q, want %q", got, "leader")
+	}
+
+	// Reads from the unreachable replica fall back to the leader.
+	srv.SetReadRouting(api.ReadRoutingRoundRobin)
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, read())
+	}
+	if want := "r1,r2,leader,r1"; strings.Join(got, ",") != want {
+		t.Errorf("Round-robin reads: served by %q, want %q", got, want)
+	}
+
+	srv.SetReadRouting(api.ReadRoutingLeastLoaded)
+	if got := read(); got == "leader" {
+		t.Errorf("Least-loaded read: served by %q, want a replica", got)
+	}
+}
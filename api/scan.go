@@ -0,0 +1,187 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+// scanLocalHeader marks scans sent by another shard, they only return local keys.
+const scanLocalHeader = "X-Scan-Local"
+
+// defaultScanLimit and maxScanLimit bound the number of keys returned by a scan.
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// ScanResult contains the response for ScanHandler.
+type ScanResult struct {
+	Entries []db.KeyValue
+}
+
+// ScanHandler returns keys in [start, end) across all shards in key order.
+// To continue a scan that returned limit keys, start the next one
+// right after the last returned key.
+// With range placement only the shards owning the range are asked, one after another,
+// otherwise all shards are asked and their results merged. Shards are asked with the
+// config epoch the scan was planned with, a shard on another epoch fails the scan.
+// During a reshard keys may still be on their previous owner, scans are rejected
+// with http.StatusServiceUnavailable until it is done.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if !s.checkEpoch(w, r) {
+		return
+	}
+	if s.resharding() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Error = reshard in progress, retry the scan once it is done")
+		return
+	}
+	start, end := r.Form.Get("start"), r.Form.Get("end")
+	limit := defaultScanLimit
+	if v := r.Form.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error = invalid limit %q", v)
+			return
+		}
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	if r.Header.Get(scanLocalHeader) != "" {
+		entries, err := s.scanLocal(start, end, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error = %v", err)
+			return
+		}
+		json.NewEncoder(w).Encode(&ScanResult{Entries: entries})
+		return
+	}
+
+	epoch := s.shards.CurrentEpoch()
+	shards, ordered := s.shards.ScanShards(start, end)
+	var res ScanResult
+	for _, idx := range shards {
+		// Unordered shards each return up to limit keys, the lowest ones are kept.
+		n := limit
+		if ordered {
+			n -= len(res.Entries)
+		}
+
+		var entries []db.KeyValue
+		var err error
+		if idx == s.shards.CurrentIdx() {
+			entries, err = s.scanLocal(start, end, n)
+			if cur := s.shards.CurrentEpoch(); err == nil && cur != epoch {
+				err = fmt.Errorf("config changed from epoch %d to %d during the scan", epoch, cur)
+			}
+		} else {
+			entries, err = s.scanRemote(idx, epoch, start, end, n)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "Error scanning shard %d: %v", idx, err)
+			return
+		}
+		res.Entries = append(res.Entries, entries...)
+
+		if ordered && len(res.Entries) >= limit {
+			break
+		}
+	}
+	if !ordered {
+		sort.Slice(res.Entries, func(i, j int) bool { return res.Entries[i].Key < res.Entries[j].Key })
+		if len(res.Entries) > limit {
+			res.Entries = res.Entries[:limit]
+		}
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// scanLocal scans the keys this shard owns, skipping keys left over from a reshard.
+func (s *Server) scanLocal(start, end string, limit int) ([]db.KeyValue, error) {
+	var res []db.KeyValue
+	for len(res) < limit {
+		n := limit - len(res)
+		entries, err := s.db.Scan(start, end, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if s.shards.Index(e.Key) == s.shards.CurrentIdx() {
+				res = append(res, e)
+			}
+		}
+		if len(entries) < n {
+			break
+		}
+		start = entries[len(entries)-1].Key + "\x00"
+	}
+	return res, nil
+}
+
+// scanRemote scans the keys owned by another shard, which must be on the config epoch.
+func (s *Server) scanRemote(shard int, epoch uint64, start, end string, limit int) ([]db.KeyValue, error) {
+	u := url.Values{}
+	u.Set("start", start)
+	u.Set("end", end)
+	u.Set("limit", strconv.Itoa(limit))
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.shards.Leader(shard)+"/scan?"+u.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(scanLocalHeader, "1")
+	req.Header.Set(ConfigEpochHeader, strconv.FormatUint(epoch, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	var res ScanResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
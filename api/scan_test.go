@@ -0,0 +1,135 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+)
+
+func TestScan(t *testing.T) {
+	for _, placement := range []string{"range", "modulo"} {
+		t.Run(placement, func(t *testing.T) {
+			var handlers [2]http.Handler
+			var addrs [2]string
+			for i := range handlers {
+				i := i
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i].ServeHTTP(w, r) }))
+				defer ts.Close()
+				addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+			}
+			cfg := fmt.Sprintf(`
+			placement = %q
+			[[shards]]
+				name = "A"
+				idx = 0
+				address = %q
+				end = "m"
+			[[shards]]
+				name = "B"
+				idx = 1
+				address = %q
+				start = "m"`, placement, addrs[0], addrs[1])
+
+			var servers [2]*api.Server
+			for i, name := range []string{"A", "B"} {
+				shards := parseConfig(t, cfg, name)
+				db := createShardDB(t, i)
+				for _, key := range []string{"apple", "kiwi", "mango", "pear", "zucchini", "banana"} {
+					if shards.Index(key) == i {
+						if _, err := db.Set(key, []byte("value-"+key)); err != nil {
+							t.Fatalf("Could not set the key %q: %v", key, err)
+						}
+					}
+				}
+				servers[i] = api.NewServer(db, shards)
+				handlers[i] = http.HandlerFunc(servers[i].ScanHandler)
+			}
+
+			for _, tc := range []struct {
+				query string
+				want  string
+			}{
+				{"", "apple,banana,kiwi,mango,pear,zucchini"},
+				{"start=b&end=p", "banana,kiwi,mango"},
+				{"start=k&limit=3", "kiwi,mango,pear"},
+			} {
+				_, body := get(t, "http://"+addrs[0]+"/scan?"+tc.query)
+				var res api.ScanResult
+				if err := json.Unmarshal([]byte(body), &res); err != nil {
+					t.Fatalf("Could not decode scan response %q: %v", body, err)
+				}
+				var keys []string
+				for _, e := range res.Entries {
+					keys = append(keys, e.Key)
+				}
+				if got := strings.Join(keys, ","); got != tc.want {
+					t.Errorf("Scan %q: got keys %q, want %q", tc.query, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestScanEpoch(t *testing.T) {
+	var handlers [2]http.Handler
+	var addrs [2]string
+	for i := range handlers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i].ServeHTTP(w, r) }))
+		defer ts.Close()
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	cfg := fmt.Sprintf(`
+	epoch = 1
+	placement = "range"
+	[[shards]]
+		name = "A"
+		idx = 0
+		address = %q
+		end = "m"
+	[[shards]]
+		name = "B"
+		idx = 1
+		address = %q
+		start = "m"`, addrs[0], addrs[1])
+
+	// B already switched to a config that gives it the whole keyspace.
+	handlers[0] = http.HandlerFunc(api.NewServer(createShardDB(t, 0), parseConfig(t, cfg, "A")).ScanHandler)
+	next := strings.Replace(strings.Replace(cfg, "epoch = 1", "epoch = 2", 1), `end = "m"`, `end = "a"`, 1)
+	next = strings.Replace(next, `start = "m"`, `start = "a"`, 1)
+	handlers[1] = http.HandlerFunc(api.NewServer(createShardDB(t, 1), parseConfig(t, next, "B")).ScanHandler)
+
+	if status, body := get(t, "http://"+addrs[0]+"/scan"); status != http.StatusBadGateway {
+		t.Errorf("Scan across epochs: got %d %q, want status %d", status, body, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+)
+
+// SplitHandler splits a shard with range placement in two. The new shard, given by
+// name, addr and the optional comma-separated replicas, takes over the keys from
+// the split key at to the end of the range. Without at the shard is split at its
+// middle key, so the request is served by the leader of the shard.
+// The new nodes must be running with -join before the split.
+func (s *Server) SplitHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = invalid shard %q", r.Form.Get("shard"))
+		return
+	}
+	newShard := config.Shard{Name: r.Form.Get("name"), Address: r.Form.Get("addr")}
+	if newShard.Name == "" || newShard.Address == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = name and addr of the new shard are required")
+		return
+	}
+	if v := r.Form.Get("replicas"); v != "" {
+		newShard.Replicas = strings.Split(v, ",")
+	}
+
+	at := r.Form.Get("at")
+	if at == "" && shard != s.shards.CurrentIdx() {
+		s.redirect(shard, w, r)
+		return
+	}
+
+	cur := s.shards.Config()
+	if at == "" {
+		var start, end string
+		for _, sh := range cur.Shards {
+			if sh.Idx == shard {
+				start, end = sh.Start, sh.End
+			}
+		}
+		at, err = s.db.SplitKey(start, end, func(key string) bool {
+			return s.shards.Index(key) == shard
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Error = %v", err)
+			return
+		}
+	}
+
+	next, err := config.Split(cur, shard, at, newShard)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if err := s.pushConfig(next, append([]string{newShard.Address}, newShard.Replicas...)); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	fmt.Fprintf(w, "Split shard %d at %q into shard %d, epoch = %d", shard, at, len(next.Shards)-1, next.Epoch)
+}
+
+// MergeHandler merges the shard with range placement into its neighbour into.
+// The merged shard moves all its keys to into and leaves the cluster.
+func (s *Server) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = invalid shard %q", r.Form.Get("shard"))
+		return
+	}
+	into, err := strconv.Atoi(r.Form.Get("into"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = invalid shard %q", r.Form.Get("into"))
+		return
+	}
+
+	next, err := config.Merge(s.shards.Config(), shard, into)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if err := s.pushConfig(next, nil); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	fmt.Fprintf(w, "Merged shard %d into shard %d, epoch = %d", shard, into, next.Epoch)
+}
+
+// pushAttempts is how often a node is sent a config that every node accepted.
+const pushAttempts = 5
+
+// pushConfig starts a reshard to the config on every node of the cluster and
+// on the extra nodes joining it. First every node checks that it can start the reshard,
+// if one cannot no node switches. Then the config is committed on every node, which saves it,
+// nodes that cannot be reached are retried. A node that stays unreachable is reported
+// and must be sent the config with /admin/reshard once it is back.
+func (s *Server) pushConfig(c config.Config, extra []string) error {
+	data, err := config.Encode(c)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append(s.shards.AllAddrs(), extra...) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var failed []string
+	for _, addr := range addrs {
+		if err := postConfig(addr, "/admin/reshard?check=1", data); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", addr, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("config epoch %d was rejected, no node switched to it: %s", c.Epoch, strings.Join(failed, "; "))
+	}
+
+	for attempt := 1; ; attempt++ {
+		var pending []string
+		failed = nil
+		for _, addr := range addrs {
+			if err := postConfig(addr, "/admin/reshard", data); err != nil {
+				pending = append(pending, addr)
+				failed = append(failed, fmt.Sprintf("%s: %v", addr, err))
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if attempt == pushAttempts {
+			return fmt.Errorf("config epoch %d is committed, but not on %s", c.Epoch, strings.Join(failed, "; "))
+		}
+		addrs = pending
+		time.Sleep(migrationRetry)
+	}
+}
+
+// postConfig sends the encoded config to the path on addr.
+func postConfig(addr, path string, data []byte) error {
+	resp, err := http.Post("http://"+addr+path, "application/toml", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	result, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, result)
+	}
+	return nil
+}
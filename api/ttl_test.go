@@ -0,0 +1,67 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetTTL(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", srv.GetHandler)
+	mux.HandleFunc("/set", srv.SetHandler)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, ttl := range []string{"abc", "-5s", "0"} {
+		if status, body := get(t, ts.URL+"/set?key=a&value=b&ttl="+ttl); status != http.StatusBadRequest {
+			t.Errorf("Set with ttl %q: got status %d (%s), want %d", ttl, status, body, http.StatusBadRequest)
+		}
+	}
+
+	if status, body := get(t, ts.URL+"/set?key=session&value=token&ttl=100ms"); status != http.StatusOK {
+		t.Fatalf("Set with ttl: got status %d (%s), want %d", status, body, http.StatusOK)
+	}
+	if status, body := get(t, ts.URL+"/set?key=cache&value=page&ttl=60"); status != http.StatusOK {
+		t.Fatalf("Set with ttl in seconds: got status %d (%s), want %d", status, body, http.StatusOK)
+	}
+	if _, body := get(t, ts.URL+"/get?key=session"); !strings.Contains(body, `Value = "token"`) {
+		t.Errorf("Get before expiry: got %q, want the value", body)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, body := get(t, ts.URL+"/get?key=session"); !strings.Contains(body, `Value = ""`) {
+		t.Errorf("Get after expiry: got %q, want no value", body)
+	}
+	if _, body := get(t, ts.URL+"/get?key=cache"); !strings.Contains(body, `Value = "page"`) {
+		t.Errorf("Get of a key with a longer ttl: got %q, want the value", body)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Command kvconfig checks sharding config files, prints the topology they
+// describe, shows which keys move between two of them and explains which
+// shard owns a key.
+//
+//	kvconfig check sharding.toml
+//	kvconfig topology sharding.toml
+//	kvconfig [-v] diff old.toml new.toml
+//	kvconfig locate sharding.toml key
+//	kvconfig -addr 127.0.0.1:3000 locate key
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+)
+
+var (
+	verbose = flag.Bool("v", false, "List every moving slot in diff instead of totals per pair of shards")
+	addr    = flag.String("addr", "", "Locate keys with the config of the node listening on this address instead of a config file")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  kvconfig check FILE          report all problems of the config
+  kvconfig topology FILE       print the shards, their addresses and key shares
+  kvconfig [-v] diff OLD NEW   show which keys move from OLD to NEW
+  kvconfig locate FILE KEY...  explain which shard owns the keys
+  kvconfig -addr ADDR locate KEY...
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "check" && len(args) == 1:
+		load(args[0])
+		fmt.Printf("%s: ok\n", args[0])
+	case cmd == "topology" && len(args) == 1:
+		topology(load(args[0]))
+	case cmd == "diff" && len(args) == 2:
+		diff(load(args[0]), load(args[1]))
+	case cmd == "locate" && *addr != "" && len(args) > 0:
+		for _, key := range args {
+			printLocation(locateRemote(*addr, key))
+		}
+	case cmd == "locate" && *addr == "" && len(args) > 1:
+		shards := load(args[0])
+		for _, key := range args[1:] {
+			printLocation(shards.Locate(key))
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// load parses and lints the config file, it exits listing all problems if there are any.
+func load(filename string) *config.Shards {
+	c, err := config.ParseFile(filename)
+	if err != nil {
+		log.Fatalf("Error parsing config %q: %v", filename, err)
+	}
+	if errs := config.Lint(c); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+		}
+		os.Exit(1)
+	}
+	shards, err := config.ParseConfig(c, "")
+	if err != nil {
+		log.Fatalf("Error parsing shards config %q: %v", filename, err)
+	}
+	return shards
+}
+
+func topology(shards *config.Shards) {
+	c := shards.Config()
+	placement := c.Placement
+	if placement == "" {
+		placement = config.PlacementModulo
+	}
+	fmt.Printf("Epoch %d, %s placement", c.Epoch, placement)
+	if placement == config.PlacementRing {
+		vnodes := c.VirtualNodes
+		if vnodes == 0 {
+			vnodes = config.DefaultVirtualNodes
+		}
+		fmt.Printf(", %d virtual nodes per weight", vnodes)
+	}
+	fmt.Printf(", %d shards\n\n", len(c.Shards))
+
+	sort.Slice(c.Shards, func(i, j int) bool { return c.Shards[i].Idx < c.Shards[j].Idx })
+	shares := shards.Shares()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IDX\tNAME\tLEADER\tREPLICAS\tKEYS")
+	for _, s := range c.Shards {
+		keys := fmt.Sprintf("%.1f%%", shares[s.Idx]*100)
+		switch {
+		case placement == config.PlacementRange:
+			keys = fmt.Sprintf("[%q, %q)", s.Start, s.End)
+			if s.End == "" {
+				keys = fmt.Sprintf("[%q, end)", s.Start)
+			}
+		case placement == config.PlacementRing && s.Weight > 1:
+			keys += fmt.Sprintf(" (weight %d)", s.Weight)
+		}
+		replicas := strings.Join(s.Replicas, ",")
+		if replicas == "" {
+			replicas = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", s.Idx, s.Name, s.Address, replicas, keys)
+	}
+	w.Flush()
+}
+
+func diff(prev, next *config.Shards) {
+	moves, err := config.Diff(prev, next)
+	if err != nil {
+		log.Fatalf("Error comparing configs: %v", err)
+	}
+	if len(moves) == 0 {
+		fmt.Println("No keys move")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	// Range placement has no shares, its ranges are always listed.
+	ranged := prev.Config().Placement == config.PlacementRange
+	if *verbose || ranged {
+		fmt.Fprintln(w, "SLOT\tFROM\tTO")
+		for _, m := range moves {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", m.Slot, m.From, m.To)
+		}
+		if ranged {
+			return
+		}
+		fmt.Fprintln(w)
+	}
+
+	type pair struct{ from, to string }
+	var pairs []pair
+	totals := make(map[pair]float64)
+	slots := make(map[pair]int)
+	var total float64
+	for _, m := range moves {
+		p := pair{m.From, m.To}
+		if _, ok := totals[p]; !ok {
+			pairs = append(pairs, p)
+		}
+		totals[p] += m.Fraction
+		slots[p]++
+		total += m.Fraction
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].from != pairs[j].from {
+			return pairs[i].from < pairs[j].from
+		}
+		return pairs[i].to < pairs[j].to
+	})
+
+	fmt.Fprintln(w, "FROM\tTO\tSLOTS\tKEYS")
+	for _, p := range pairs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\n", p.from, p.to, slots[p], totals[p]*100)
+	}
+	fmt.Fprintf(w, "total\t\t%d\t%.1f%%\n", len(moves), total*100)
+}
+
+// locateRemote asks the node for the location of the key.
+func locateRemote(addr, key string) config.Location {
+	resp, err := http.Get("http://" + addr + "/admin/locate?key=" + url.QueryEscape(key))
+	if err != nil {
+		log.Fatalf("Error locating %q: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("Error locating %q: unexpected status %d: %s", key, resp.StatusCode, body)
+	}
+	var loc config.Location
+	if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
+		log.Fatalf("Error decoding location of %q: %v", key, err)
+	}
+	return loc
+}
+
+func printLocation(loc config.Location) {
+	fmt.Printf("Key %q: shard %d %q, epoch %d\n", loc.Key, loc.Shard, loc.Name, loc.Epoch)
+	fmt.Printf("  placement  %s\n", loc.Placement)
+	if loc.Placement != config.PlacementRange {
+		fmt.Printf("  hashed key %q\n", loc.HashedKey)
+		fmt.Printf("  hash       %#016x\n", loc.Hash)
+	}
+	fmt.Printf("  slot       %s\n", loc.Slot)
+	fmt.Printf("  leader     %s\n", loc.Leader)
+	replicas := strings.Join(loc.Replicas, ", ")
+	if replicas == "" {
+		replicas = "-"
+	}
+	fmt.Printf("  replicas   %s\n", replicas)
+}
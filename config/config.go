@@ -28,25 +28,80 @@ package config
 import (
 	"fmt"
 	"hash/fnv"
+	"strings"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 )
 
+// Placement strategies of keys between shards.
+const (
+	// PlacementModulo places a key on shard hash(key) % count.
+	PlacementModulo = "modulo"
+	// PlacementRing places keys on a consistent-hash ring,
+	// adding a shard only moves the keys the new shard takes over.
+	PlacementRing = "ring"
+	// PlacementRange places keys by the Start and End of the shards,
+	// keeping neighbouring keys together for ordered scans.
+	PlacementRange = "range"
+)
+
 type Config struct {
-	Shards []Shard
+	// Epoch identifies the version of the config, it must grow
+	// with every change that moves keys between shards.
+	Epoch uint64
+	// Placement is PlacementModulo (default), PlacementRing or PlacementRange.
+	Placement string
+	// VirtualNodes is the number of ring points per unit of shard weight,
+	// DefaultVirtualNodes if not set.
+	VirtualNodes int
+	// HashTags places keys sharing a hash tag on the same shard with hash
+	// placements, see HashTag. Turning it on or off moves keys, so it needs
+	// a new epoch like any other change of the placement.
+	HashTags bool `toml:"hash_tags"`
+	Shards   []Shard
 }
 
 // Shard each shard has unique set of keys and values.
 type Shard struct {
-	Name    string
-	Idx     int
-	Address string
+	Name     string
+	Idx      int
+	Address  string
+	Replicas []string
+	// Weight is the relative share of keys of the shard with ring placement, 1 if not set.
+	Weight int
+	// Start and End are the range of keys [Start, End) of the shard with range placement,
+	// an empty End is the end of the keyspace.
+	Start string
+	End   string
 }
 
 type Shards struct {
-	Count  int
-	CurIdx int
-	Addrs  map[int]string
+	Count    int
+	CurIdx   int
+	CurName  string
+	Epoch    uint64
+	Addrs    map[int]string
+	Replicas map[int][]string
+
+	ring     *ring          // nil unless placed on a ring
+	ranges   []keyRange     // nil unless placed by ranges
+	hashTags bool           // hash only the hash tag of keys, see HashTag
+	config   Config         // the config the routing was parsed from
+	promoted map[int]string // leaders set with SetLeader since the config was parsed
+
+	mu sync.RWMutex // guards all fields after a leader change or a reshard
+}
+
+// clone returns a deep copy of the config.
+func (c Config) clone() Config {
+	res := c
+	res.Shards = make([]Shard, len(c.Shards))
+	for i, s := range c.Shards {
+		s.Replicas = append([]string(nil), s.Replicas...)
+		res.Shards[i] = s
+	}
+	return res
 }
 
 // ParseFile parses the config and return it if success.
@@ -58,18 +113,58 @@ func ParseFile(filename string) (Config, error) {
 	return c, nil
 }
 
+// Parse parses the contents of a config file.
+func Parse(data []byte) (Config, error) {
+	var c Config
+	if _, err := toml.Decode(string(data), &c); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
 // ParseShards converts and verifies a list of shards
 // convert them into a form that can be used for routing.
 func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
+	s, err := parseShards(shards, curShardName)
+	if err != nil {
+		return nil, err
+	}
+	if s.CurIdx < 0 {
+		return nil, fmt.Errorf("shard %q was not found", curShardName)
+	}
+	return s, nil
+}
+
+// parseShards is ParseShards, but CurIdx is -1 if the current shard is not found.
+func parseShards(shards []Shard, curShardName string) (*Shards, error) {
 	shardCount := len(shards)
 	shardIdx := -1
 	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
 
+	names := make(map[string]bool)
+	owners := make(map[string]string) // address -> name of the shard using it
 	for _, s := range shards {
 		if _, exist := addrs[s.Idx]; exist {
 			return nil, fmt.Errorf("duplicate shard found, index: %d", s.Idx)
 		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate shard found, name: %q", s.Name)
+		}
+		names[s.Name] = true
+		for _, addr := range append([]string{s.Address}, s.Replicas...) {
+			if owner, exist := owners[addr]; exist && addr != "" {
+				if owner == s.Name {
+					return nil, fmt.Errorf("address %q is used twice by shard %q", addr, s.Name)
+				}
+				return nil, fmt.Errorf("address %q is used by shards %q and %q", addr, owner, s.Name)
+			}
+			owners[addr] = s.Name
+		}
 		addrs[s.Idx] = s.Address
+		if len(s.Replicas) > 0 {
+			replicas[s.Idx] = s.Replicas
+		}
 		if s.Name == curShardName {
 			shardIdx = s.Idx
 		}
@@ -79,20 +174,295 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 			return nil, fmt.Errorf("shard with index %d was not found", i)
 		}
 	}
-	if shardIdx < 0 {
+	return &Shards{
+		Count:    shardCount,
+		CurIdx:   shardIdx,
+		Addrs:    addrs,
+		Replicas: replicas,
+	}, nil
+}
+
+// ParseConfig converts and verifies the shards of the config
+// using the placement strategy of the config. With an empty curShardName
+// only the routing is parsed and CurIdx is -1.
+func ParseConfig(c Config, curShardName string) (*Shards, error) {
+	s, err := parseConfig(c, curShardName)
+	if err != nil {
+		return nil, err
+	}
+	if curShardName != "" && s.CurIdx < 0 {
 		return nil, fmt.Errorf("shard %q was not found", curShardName)
 	}
+	return s, nil
+}
 
-	return &Shards{
-		Count:  shardCount,
-		CurIdx: shardIdx,
-		Addrs:  addrs,
-	}, nil
+// ParseNextConfig is ParseConfig for a config replacing the current one.
+// A shard that is not part of the next config, because it is removed or
+// has not joined yet, gets only the routing with CurIdx -1.
+func ParseNextConfig(c Config, curShardName string) (*Shards, error) {
+	return parseConfig(c, curShardName)
+}
+
+func parseConfig(c Config, curShardName string) (*Shards, error) {
+	s, err := parseShards(c.Shards, curShardName)
+	if err != nil {
+		return nil, err
+	}
+	s.CurName = curShardName
+	s.Epoch = c.Epoch
+	s.hashTags = c.HashTags
+	s.config = c.clone()
+
+	switch c.Placement {
+	case "", PlacementModulo:
+		return s, nil
+	case PlacementRing:
+	case PlacementRange:
+		if s.ranges, err = newRanges(c.Shards); err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown placement %q", c.Placement)
+	}
+
+	vnodes := c.VirtualNodes
+	if vnodes == 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	if vnodes < 0 {
+		return nil, fmt.Errorf("invalid virtual node count %d", vnodes)
+	}
+	weights := make(map[int]int)
+	for _, sh := range c.Shards {
+		switch {
+		case sh.Weight == 0:
+			weights[sh.Idx] = 1
+		case sh.Weight > 0:
+			weights[sh.Idx] = sh.Weight
+		default:
+			return nil, fmt.Errorf("invalid weight %d of shard %q", sh.Weight, sh.Name)
+		}
+	}
+	s.ring = newRing(weights, vnodes)
+	return s, nil
 }
 
 // Index returns the hashed index for the corresponding key.
+// With hash placements and hash tags turned on, keys sharing a hash tag are
+// placed on the same shard, see HashTag. Range placement always routes by the whole key.
 func (s *Shards) Index(key string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ranges != nil {
+		return rangeShard(s.ranges, key)
+	}
+	key = s.hashedKey(key)
+	if s.ring != nil {
+		return s.ring.shard(key)
+	}
+	return int(moduloHash(key) % uint64(s.Count))
+}
+
+// moduloHash is the hash of the key for modulo placement.
+func moduloHash(key string) uint64 {
 	h := fnv.New64()
 	h.Write([]byte(key))
-	return int(h.Sum64() % uint64(s.Count))
+	return h.Sum64()
+}
+
+// hashedKey returns the part of the key that is hashed for placement.
+func (s *Shards) hashedKey(key string) string {
+	if s.hashTags {
+		return HashTag(key)
+	}
+	return key
+}
+
+// HashTag returns the part of the key that is hashed for placement.
+// Like Redis hash tags, if the key contains "{" followed later by "}" with at least
+// one character in between, only the characters between the first "{" and the
+// next "}" are hashed, so "user:{42}:profile" and "user:{42}:settings" are placed together.
+// Otherwise the whole key is hashed.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// Leader returns the address of the leader of the shard.
+func (s *Shards) Leader(idx int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Addrs[idx]
+}
+
+// ReplicaAddrs returns the addresses of the replicas of the shard.
+func (s *Shards) ReplicaAddrs(idx int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.Replicas[idx]...)
+}
+
+// AllAddrs returns the addresses of all leaders and replicas of all shards.
+func (s *Shards) AllAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var res []string
+	for i := 0; i < s.Count; i++ {
+		res = append(res, s.Addrs[i])
+		res = append(res, s.Replicas[i]...)
+	}
+	return res
+}
+
+// SetLeader makes the replica with the given address the leader of the shard,
+// the previous leader is no longer considered part of the shard.
+func (s *Shards) SetLeader(idx int, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var replicas []string
+	for _, r := range s.Replicas[idx] {
+		if r != addr {
+			replicas = append(replicas, r)
+		}
+	}
+	if s.Replicas == nil {
+		s.Replicas = make(map[int][]string)
+	}
+	s.Replicas[idx] = replicas
+	s.Addrs[idx] = addr
+	if s.promoted == nil {
+		s.promoted = make(map[int]string)
+	}
+	s.promoted[idx] = addr
+
+	for i := range s.config.Shards {
+		if sh := &s.config.Shards[i]; sh.Idx == idx {
+			sh.Address = addr
+			sh.Replicas = replicas
+		}
+	}
+}
+
+// KeepLeaders repeats on s the leader changes made on prev with SetLeader, so that
+// reloading a config written before a failover does not route to the failed leader.
+// A change is dropped if s no longer lists the new leader as a member of the shard.
+func (s *Shards) KeepLeaders(prev *Shards) {
+	p := prev.Clone()
+	for idx, addr := range p.promoted {
+		if addr == s.Leader(idx) {
+			continue
+		}
+		for _, r := range s.ReplicaAddrs(idx) {
+			if r == addr {
+				s.SetLeader(idx, addr)
+				break
+			}
+		}
+	}
+}
+
+// CurrentName returns the name of the shard of this node.
+func (s *Shards) CurrentName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.CurName
+}
+
+// CurrentIdx returns the index of the shard of this node.
+func (s *Shards) CurrentIdx() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.CurIdx
+}
+
+// ShardCount returns the number of shards.
+func (s *Shards) ShardCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Count
+}
+
+// CurrentEpoch returns the epoch of the config the routing was parsed from.
+func (s *Shards) CurrentEpoch() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Epoch
+}
+
+// Config returns the config the routing was parsed from,
+// including leader changes made since.
+func (s *Shards) Config() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.clone()
+}
+
+// SamePlacement reports whether o places every key on the same shard index as s.
+func (s *Shards) SamePlacement(o *Shards) bool {
+	a, b := s.Clone(), o.Clone()
+	if a.ranges == nil && a.hashTags != b.hashTags {
+		return false
+	}
+	return a.Count == b.Count && a.ring.equal(b.ring) && equalRanges(a.ranges, b.ranges)
+}
+
+// Clone returns a copy of the routing that is not affected by later changes of s.
+func (s *Shards) Clone() *Shards {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := &Shards{
+		Count:    s.Count,
+		CurIdx:   s.CurIdx,
+		CurName:  s.CurName,
+		Epoch:    s.Epoch,
+		Addrs:    make(map[int]string, len(s.Addrs)),
+		Replicas: make(map[int][]string, len(s.Replicas)),
+		ring:     s.ring,
+		ranges:   s.ranges,
+		hashTags: s.hashTags,
+		config:   s.config.clone(),
+	}
+	for idx, addr := range s.Addrs {
+		c.Addrs[idx] = addr
+	}
+	if s.promoted != nil {
+		c.promoted = make(map[int]string, len(s.promoted))
+		for idx, addr := range s.promoted {
+			c.promoted[idx] = addr
+		}
+	}
+	for idx, replicas := range s.Replicas {
+		c.Replicas[idx] = append([]string(nil), replicas...)
+	}
+	return c
+}
+
+// Update replaces the routing with the one of next, so that everyone
+// holding s routes by next from now on.
+func (s *Shards) Update(next *Shards) {
+	c := next.Clone()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Count = c.Count
+	s.CurIdx = c.CurIdx
+	s.CurName = c.CurName
+	s.Epoch = c.Epoch
+	s.Addrs = c.Addrs
+	s.Replicas = c.Replicas
+	s.ring = c.ring
+	s.ranges = c.ranges
+	s.hashTags = c.hashTags
+	s.config = c.config
+	s.promoted = c.promoted
 }
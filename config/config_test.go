@@ -26,8 +26,10 @@
 package config_test
 
 import (
+	"fmt"
 	"github.com/Nicknamezz00/naive-distributed-kv/config"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"testing"
@@ -60,14 +62,16 @@ func TestConfigParse(t *testing.T) {
 	got := createConfig(t, `[[shards]]
 		name = "NodeTest"
 		idx = 0
-		address = "localhost:8080"`)
+		address = "localhost:8080"
+		replicas = ["localhost:8081", "localhost:8082"]`)
 
 	want := config.Config{
 		Shards: []config.Shard{
 			{
-				Name:    "NodeTest",
-				Idx:     0,
-				Address: "localhost:8080",
+				Name:     "NodeTest",
+				Idx:      0,
+				Address:  "localhost:8080",
+				Replicas: []string{"localhost:8081", "localhost:8082"},
 			},
 		},
 	}
@@ -85,7 +89,8 @@ func TestParseShards(t *testing.T) {
 	[[shards]]
 		name = "NodeTest1"
 		idx = 1
-		address = "localhost:8081"`)
+		address = "localhost:8081"
+		replicas = ["localhost:8091"]`)
 
 	got, err := config.ParseShards(c.Shards, "NodeTest1")
 	if err != nil {
@@ -98,8 +103,513 @@ func TestParseShards(t *testing.T) {
 			0: "localhost:8080",
 			1: "localhost:8081",
 		},
+		Replicas: map[int][]string{
+			1: {"localhost:8091"},
+		},
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("The shards does not match, got: %#v, but want: %#v", got, want)
 	}
 }
+
+func TestSetLeader(t *testing.T) {
+	s := &config.Shards{
+		Count:  2,
+		CurIdx: 0,
+		Addrs: map[int]string{
+			0: "localhost:8080",
+			1: "localhost:8081",
+		},
+		Replicas: map[int][]string{
+			0: {"localhost:8090", "localhost:8091"},
+		},
+	}
+
+	s.SetLeader(0, "localhost:8091")
+
+	if got := s.Leader(0); got != "localhost:8091" {
+		t.Errorf("Leader(0): got %q, want %q", got, "localhost:8091")
+	}
+	if got, want := s.ReplicaAddrs(0), []string{"localhost:8090"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReplicaAddrs(0): got %q, want %q", got, want)
+	}
+	if got, want := s.AllAddrs(), []string{"localhost:8091", "localhost:8090", "localhost:8081"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AllAddrs(): got %q, want %q", got, want)
+	}
+}
+
+func ringShards(t *testing.T, count int, weights map[int]int) *config.Shards {
+	t.Helper()
+	c := config.Config{Placement: config.PlacementRing}
+	for i := 0; i < count; i++ {
+		c.Shards = append(c.Shards, config.Shard{
+			Name:    fmt.Sprintf("Node%d", i),
+			Idx:     i,
+			Address: fmt.Sprintf("localhost:%d", 8080+i),
+			Weight:  weights[i],
+		})
+	}
+	s, err := config.ParseConfig(c, "Node0")
+	if err != nil {
+		t.Fatalf("ParseConfig(%#v): %v", c, err)
+	}
+	return s
+}
+
+func TestRingPlacement(t *testing.T) {
+	const keys = 10000
+
+	four := ringShards(t, 4, nil)
+	five := ringShards(t, 5, nil)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if before, after := four.Index(key), five.Index(key); before != after {
+			moved++
+			if after != 4 {
+				t.Fatalf("Key %q moved from shard %d to existing shard %d", key, before, after)
+			}
+		}
+	}
+	// The new shard takes over about a fifth of the keys.
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Errorf("Keys moved after adding a shard: got %d of %d, want about %d", moved, keys, keys/5)
+	}
+
+	weighted := ringShards(t, 2, map[int]int{1: 3})
+	counts := make(map[int]int)
+	for i := 0; i < keys; i++ {
+		counts[weighted.Index(fmt.Sprintf("key-%d", i))]++
+	}
+	if counts[1] < keys*65/100 || counts[1] > keys*85/100 {
+		t.Errorf("Keys on shard with weight 3: got %d of %d, want about %d", counts[1], keys, keys*3/4)
+	}
+}
+
+func TestParseConfigPlacement(t *testing.T) {
+	c := createConfig(t, `
+	placement = "ring"
+	virtualnodes = 16
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		weight = 2`)
+	if c.Placement != config.PlacementRing || c.VirtualNodes != 16 || c.Shards[0].Weight != 2 {
+		t.Errorf("Unexpected config: %#v", c)
+	}
+	if _, err := config.ParseConfig(c, "NodeTest0"); err != nil {
+		t.Errorf("ParseConfig: got %v, want nil error", err)
+	}
+
+	c.Placement = "random"
+	if _, err := config.ParseConfig(c, "NodeTest0"); err == nil {
+		t.Errorf("ParseConfig with unknown placement: got nil error, want non-nil error")
+	}
+}
+
+func TestSamePlacement(t *testing.T) {
+	four := ringShards(t, 4, nil)
+	moved := ringShards(t, 4, nil)
+	moved.Addrs[1] = "localhost:9090"
+	if !four.SamePlacement(moved) {
+		t.Errorf("SamePlacement after an address change: got false, want true")
+	}
+	if four.SamePlacement(ringShards(t, 4, map[int]int{2: 2})) {
+		t.Errorf("SamePlacement after a weight change: got true, want false")
+	}
+	if four.SamePlacement(&config.Shards{Count: 4}) {
+		t.Errorf("SamePlacement of ring and modulo placement: got true, want false")
+	}
+}
+
+func TestRangePlacement(t *testing.T) {
+	c := createConfig(t, `
+	placement = "range"
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		end = "m"
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "localhost:8081"
+		start = "m"`)
+	s, err := config.ParseConfig(c, "NodeTest0")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	for key, want := range map[string]int{"": 0, "apple": 0, "lz": 0, "m": 1, "zebra": 1} {
+		if got := s.Index(key); got != want {
+			t.Errorf("Index(%q): got %d, want %d", key, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		want       []int
+	}{
+		{"a", "c", []int{0}},
+		{"a", "", []int{0, 1}},
+		{"m", "z", []int{1}},
+		{"", "m", []int{0}},
+	} {
+		got, ordered := s.ScanShards(tc.start, tc.end)
+		if !ordered || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ScanShards(%q, %q): got %v, %v; want %v, true", tc.start, tc.end, got, ordered, tc.want)
+		}
+	}
+
+	c.Shards[1].Start = "n"
+	if _, err := config.ParseConfig(c, "NodeTest0"); err == nil {
+		t.Errorf("ParseConfig with a gap between ranges: got nil error, want non-nil error")
+	}
+	c.Shards[1].Start = "m"
+	c.Shards[1].End = "x"
+	if _, err := config.ParseConfig(c, "NodeTest0"); err == nil {
+		t.Errorf("ParseConfig with keys after the last range: got nil error, want non-nil error")
+	}
+}
+
+func TestRangeValidation(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		ranges [][2]string // start and end of each shard
+	}{
+		{"no bounds", [][2]string{{"", ""}, {"", ""}}},
+		{"unbounded range before another", [][2]string{{"", ""}, {"", "m"}}},
+		{"start equal to end", [][2]string{{"", "m"}, {"m", "m"}, {"m", ""}}},
+		{"start after end", [][2]string{{"", "m"}, {"m", "c"}, {"c", ""}}},
+	} {
+		c := config.Config{Placement: config.PlacementRange}
+		for i, r := range tc.ranges {
+			c.Shards = append(c.Shards, config.Shard{
+				Name:    fmt.Sprintf("NodeTest%d", i),
+				Idx:     i,
+				Address: fmt.Sprintf("localhost:%d", 8080+i),
+				Start:   r[0],
+				End:     r[1],
+			})
+		}
+		if _, err := config.ParseConfig(c, "NodeTest0"); err == nil {
+			t.Errorf("ParseConfig with %s: got nil error, want non-nil error", tc.desc)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	for key, want := range map[string]string{
+		"user:42:profile":      "user:42:profile",
+		"user:{42}:profile":    "42",
+		"{user:42}:settings":   "user:42",
+		"user:{}:profile":      "user:{}:profile",
+		"user:{42:profile":     "user:{42:profile",
+		"user:}42{:profile}":   ":profile",
+		"user:{42}:{settings}": "42",
+	} {
+		if got := config.HashTag(key); got != want {
+			t.Errorf("HashTag(%q): got %q, want %q", key, got, want)
+		}
+	}
+
+	if c := createConfig(t, `
+	hash_tags = true
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"`); !c.HashTags {
+		t.Errorf("HashTags of a config with hash_tags = true: got false, want true")
+	}
+
+	ring := ringShards(t, 8, nil).Config()
+	for _, c := range []config.Config{ring, {Shards: ring.Shards}} {
+		plain, err := config.ParseConfig(c, "")
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		c.HashTags = true
+		tagged, err := config.ParseConfig(c, "")
+		if err != nil {
+			t.Fatalf("ParseConfig: %v", err)
+		}
+		if a, b := tagged.Index("user:{42}:profile"), tagged.Index("user:{42}:settings"); a != b {
+			t.Errorf("Keys with the same hash tag on different shards: %d and %d", a, b)
+		}
+		if a, b := tagged.Index("{42}"), tagged.Index("user:{42}:settings"); a != b {
+			t.Errorf("Key %q and its hash tag on different shards: %d and %d", "user:{42}:settings", a, b)
+		}
+		if tagged.SamePlacement(plain) {
+			t.Errorf("SamePlacement of configs with and without hash tags: got true, want false")
+		}
+		if _, err := config.Diff(plain, tagged); err == nil {
+			t.Errorf("Diff of configs with and without hash tags: got nil error, want non-nil error")
+		}
+
+		moved := false
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user:{%d}:profile", i)
+			if got := plain.Locate(key).HashedKey; got != key {
+				t.Errorf("Locate(%q) without hash tags: got hashed key %q, want %q", key, got, key)
+			}
+			moved = moved || plain.Index(key) != tagged.Index(key)
+		}
+		if !moved {
+			t.Errorf("Keys with hash tags placed the same with and without hash tags, want some to move")
+		}
+	}
+}
+
+func TestSplitMerge(t *testing.T) {
+	c := createConfig(t, `
+	epoch = 1
+	placement = "range"
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		end = "m"
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "localhost:8081"
+		start = "m"`)
+
+	split, err := config.Split(c, 0, "g", config.Shard{Name: "NodeTest2", Address: "localhost:8082"})
+	if err != nil {
+		t.Fatalf("Split: got %v, want nil error", err)
+	}
+	data, err := config.Encode(split)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	parsed, err := config.Parse(data)
+	if err != nil {
+		t.Fatalf("Parse of encoded config %q: %v", data, err)
+	}
+	s, err := config.ParseConfig(parsed, "NodeTest2")
+	if err != nil {
+		t.Fatalf("ParseConfig after split: %v", err)
+	}
+	if s.Epoch != 2 || s.CurIdx != 2 {
+		t.Errorf("After split: got epoch %d and index %d, want 2 and 2", s.Epoch, s.CurIdx)
+	}
+	for key, want := range map[string]int{"apple": 0, "grape": 2, "lime": 2, "mango": 1} {
+		if got := s.Index(key); got != want {
+			t.Errorf("Index(%q) after split: got %d, want %d", key, got, want)
+		}
+	}
+	if _, err := config.Split(c, 0, "n", config.Shard{Name: "NodeTest2"}); err == nil {
+		t.Errorf("Split outside of the range: got nil error, want non-nil error")
+	}
+
+	merged, err := config.Merge(split, 0, 2)
+	if err != nil {
+		t.Fatalf("Merge: got %v, want nil error", err)
+	}
+	if merged.Epoch != 3 || len(merged.Shards) != 2 || merged.Shards[1].Name != "NodeTest2" || merged.Shards[1].Start != "" || merged.Shards[1].Idx != 1 {
+		t.Errorf("Unexpected config after merge: %#v", merged)
+	}
+	if _, err := config.Merge(split, 0, 1); err == nil {
+		t.Errorf("Merge of shards that are not neighbours: got nil error, want non-nil error")
+	}
+}
+
+func TestLint(t *testing.T) {
+	good := createConfig(t, `
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		replicas = ["localhost:8090"]
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "localhost:8081"`)
+	if errs := config.Lint(good); len(errs) != 0 {
+		t.Errorf("Lint of a valid config: got %v, want no errors", errs)
+	}
+
+	bad := createConfig(t, `
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		replicas = ["localhost:8081", "localhost"]
+	[[shards]]
+		name = "NodeTest0"
+		idx = 2
+		address = "localhost:8081"
+		replicas = ["localhost:99999"]`)
+	errs := config.Lint(bad)
+	if len(errs) != 6 {
+		t.Errorf("Lint of an invalid config: got %d errors %v, want 6 errors", len(errs), errs)
+	}
+
+	if _, err := config.ParseConfig(bad, ""); err == nil {
+		t.Errorf("ParseConfig with duplicate names: got nil error, want non-nil error")
+	}
+	bad.Shards[1].Name = "NodeTest1"
+	bad.Shards[1].Idx = 1
+	if _, err := config.ParseConfig(bad, ""); err == nil {
+		t.Errorf("ParseConfig with a replica address of a leader: got nil error, want non-nil error")
+	}
+
+	// Spellings of the same address are duplicates too.
+	aliased := createConfig(t, `
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		replicas = ["LOCALHOST:8090"]
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "127.0.0.1:8080"
+		replicas = ["127.0.0.1:8090", "localhost:8080"]`)
+	errs = config.Lint(aliased)
+	if len(errs) != 3 {
+		t.Errorf("Lint of a config with aliased addresses: got %d errors %v, want 3 errors", len(errs), errs)
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		"localhost:8090":    "127.0.0.1:8090",
+		"LocalHost:8090":    "127.0.0.1:8090",
+		"127.0.0.1:8090":    "127.0.0.1:8090",
+		"[::1]:8090":        "[::1]:8090",
+		"[0:0::1]:8090":     "[::1]:8090",
+		"Node.Example:8090": "node.example:8090",
+		"replica":           "replica",
+		"":                  "",
+	} {
+		if got := config.NormalizeAddr(addr); got != want {
+			t.Errorf("NormalizeAddr(%q): got %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	four := ringShards(t, 4, nil)
+	five := ringShards(t, 5, nil)
+	moves, err := config.Diff(four, five)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	var moved float64
+	for _, m := range moves {
+		if m.To != "Node4" {
+			t.Errorf("Move %+v: got target %q, want %q", m, m.To, "Node4")
+		}
+		moved += m.Fraction
+	}
+	if share := five.Shares()[4]; math.Abs(moved-share) > 1e-9 {
+		t.Errorf("Moved fraction %f differs from the share of the new shard %f", moved, share)
+	}
+
+	// With modulo placement keys move between all shards.
+	modulo := func(count int) *config.Shards {
+		c := config.Config{}
+		for i := 0; i < count; i++ {
+			c.Shards = append(c.Shards, config.Shard{Name: fmt.Sprintf("Node%d", i), Idx: i, Address: fmt.Sprintf("localhost:%d", 8080+i)})
+		}
+		s, err := config.ParseConfig(c, "")
+		if err != nil {
+			t.Fatalf("ParseConfig(%#v): %v", c, err)
+		}
+		return s
+	}
+	moves, err = config.Diff(modulo(2), modulo(3))
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if len(moves) != 4 || moves[0].Slot != "hash % 6 = 2" || moves[0].From != "Node0" || moves[0].To != "Node2" {
+		t.Errorf("Diff of modulo placement: got %+v, want 4 moves starting with slot 2 from Node0 to Node2", moves)
+	}
+
+	if _, err := config.Diff(four, modulo(4)); err == nil {
+		t.Errorf("Diff of different placements: got nil error, want non-nil error")
+	}
+
+	c := createConfig(t, `
+	placement = "range"
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		end = "m"
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "localhost:8081"
+		start = "m"`)
+	split, err := config.Split(c, 0, "g", config.Shard{Name: "NodeTest2", Address: "localhost:8082"})
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	prev, _ := config.ParseConfig(c, "")
+	next, _ := config.ParseConfig(split, "")
+	moves, err = config.Diff(prev, next)
+	want := []config.Move{{Slot: `keys ["g", "m")`, From: "NodeTest0", To: "NodeTest2"}}
+	if err != nil || !reflect.DeepEqual(moves, want) {
+		t.Errorf("Diff of a split: got %+v, %v; want %+v, nil", moves, err, want)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	ranged := createConfig(t, `
+	epoch = 3
+	placement = "range"
+	[[shards]]
+		name = "NodeTest0"
+		idx = 0
+		address = "localhost:8080"
+		replicas = ["localhost:8090"]
+		end = "m"
+	[[shards]]
+		name = "NodeTest1"
+		idx = 1
+		address = "localhost:8081"
+		start = "m"`)
+	r, err := config.ParseConfig(ranged, "")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	want := config.Location{
+		Key:       "apple",
+		Placement: config.PlacementRange,
+		Slot:      `keys ["", "m")`,
+		Shard:     0,
+		Name:      "NodeTest0",
+		Leader:    "localhost:8080",
+		Replicas:  []string{"localhost:8090"},
+		Epoch:     3,
+	}
+	if got := r.Locate("apple"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Locate(%q): got %+v, want %+v", "apple", got, want)
+	}
+
+	tagged := ringShards(t, 4, nil).Config()
+	tagged.HashTags = true
+	ring, err := config.ParseConfig(tagged, "")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	modulo, err := config.ParseConfig(config.Config{HashTags: true, Shards: tagged.Shards}, "")
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	for _, s := range []*config.Shards{r, ring, modulo} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user:{%d}:profile", i)
+			loc := s.Locate(key)
+			if loc.Shard != s.Index(key) || loc.Leader != s.Leader(loc.Shard) {
+				t.Errorf("Locate(%q): got shard %d with leader %q, want shard %d with leader %q", key, loc.Shard, loc.Leader, s.Index(key), s.Leader(s.Index(key)))
+			}
+			if loc.Placement != config.PlacementRange && loc.HashedKey != fmt.Sprint(i) {
+				t.Errorf("Locate(%q): got hashed key %q, want %q", key, loc.HashedKey, fmt.Sprint(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Move is a part of the keyspace that the next config places on another shard.
+type Move struct {
+	// Slot describes the keys that move: a remainder of the key hash
+	// for modulo placement, an arc of the ring for ring placement
+	// and a range of keys for range placement.
+	Slot     string
+	From, To string // shard names
+	// Fraction is the share of all keys that move, assuming keys
+	// hash uniformly. It is 0 for range placement.
+	Fraction float64
+}
+
+// snapshot is the routing of Shards at one point in time.
+type snapshot struct {
+	count    int
+	ring     *ring
+	ranges   []keyRange
+	hashTags bool
+	names    map[int]string
+}
+
+func (s *Shards) snapshot() snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make(map[int]string)
+	for _, sh := range s.config.Shards {
+		names[sh.Idx] = sh.Name
+	}
+	return snapshot{count: s.Count, ring: s.ring, ranges: s.ranges, hashTags: s.hashTags, names: names}
+}
+
+func (s snapshot) placement() string {
+	switch {
+	case s.ranges != nil:
+		return PlacementRange
+	case s.ring != nil:
+		return PlacementRing
+	}
+	return PlacementModulo
+}
+
+// Diff returns the parts of the keyspace that move to another shard when
+// the config of prev is replaced by the config of next. Shards are matched
+// by name, so a shard that only changes its index keeps its keys.
+// Both configs must use the same placement and, with hash placements,
+// the same hash tag setting, otherwise keys are hashed differently and
+// every key may move.
+func Diff(prev, next *Shards) ([]Move, error) {
+	a, b := prev.snapshot(), next.snapshot()
+	if a.placement() != b.placement() {
+		return nil, fmt.Errorf("placement changes from %q to %q, every key may move", a.placement(), b.placement())
+	}
+	if a.placement() != PlacementRange && a.hashTags != b.hashTags {
+		return nil, fmt.Errorf("hash tags change from %t to %t, every key with a hash tag may move", a.hashTags, b.hashTags)
+	}
+	switch a.placement() {
+	case PlacementRange:
+		return diffRanges(a, b), nil
+	case PlacementRing:
+		return diffRings(a, b), nil
+	}
+	return diffModulo(a, b), nil
+}
+
+// Shares returns the share of the keys each shard owns, assuming keys hash
+// uniformly. It returns nil for range placement.
+func (s *Shards) Shares() map[int]float64 {
+	sn := s.snapshot()
+	shares := make(map[int]float64)
+	switch sn.placement() {
+	case PlacementRange:
+		return nil
+	case PlacementModulo:
+		for i := 0; i < sn.count; i++ {
+			shares[i] = 1 / float64(sn.count)
+		}
+		return shares
+	}
+	points := sn.ring.points
+	for i, p := range points {
+		// The first point owns the arc wrapping around from the last one.
+		prev := points[len(points)-1]
+		if i > 0 {
+			prev = points[i-1]
+		}
+		shares[sn.ring.shards[i]] += arcSize(prev, p, len(points))
+	}
+	return shares
+}
+
+// arcSize returns the share of the ring in (lo, hi], wrapping around
+// if hi <= lo. A ring of a single point is owned entirely by it.
+func arcSize(lo, hi uint64, points int) float64 {
+	if points == 1 {
+		return 1
+	}
+	return float64(hi-lo) / math.Exp2(64)
+}
+
+// diffModulo compares the owners of the remainders of the key hash divided
+// by the least common multiple of both shard counts, which determine
+// the shard of a key in both configs.
+func diffModulo(a, b snapshot) []Move {
+	slots := a.count / gcd(a.count, b.count) * b.count
+	var moves []Move
+	for i := 0; i < slots; i++ {
+		if from, to := a.names[i%a.count], b.names[i%b.count]; from != to {
+			moves = append(moves, Move{
+				Slot:     fmt.Sprintf("hash %% %d = %d", slots, i),
+				From:     from,
+				To:       to,
+				Fraction: 1 / float64(slots),
+			})
+		}
+	}
+	return moves
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// diffRings compares the owners of the arcs between the points of both rings,
+// neighbouring arcs moving between the same shards are reported together.
+func diffRings(a, b snapshot) []Move {
+	points := append(append([]uint64(nil), a.ring.points...), b.ring.points...)
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	points = uniq(points)
+
+	var moves []Move
+	var lo []uint64 // start of each move
+	moved := false  // whether the previous arc moved
+	for i, p := range points {
+		prev := points[len(points)-1]
+		if i > 0 {
+			prev = points[i-1]
+		}
+		from, to := a.names[a.ring.owner(p)], b.names[b.ring.owner(p)]
+		if from == to {
+			moved = false
+			continue
+		}
+		size := arcSize(prev, p, len(points))
+		if n := len(moves); moved && moves[n-1].From == from && moves[n-1].To == to {
+			moves[n-1].Fraction += size
+			moves[n-1].Slot = fmt.Sprintf("ring (%#016x, %#016x]", lo[n-1], p)
+			continue
+		}
+		moves = append(moves, Move{
+			Slot:     fmt.Sprintf("ring (%#016x, %#016x]", prev, p),
+			From:     from,
+			To:       to,
+			Fraction: size,
+		})
+		lo = append(lo, prev)
+		moved = true
+	}
+	return moves
+}
+
+func uniq(sorted []uint64) []uint64 {
+	var res []uint64
+	for i, v := range sorted {
+		if i == 0 || v != sorted[i-1] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// diffRanges compares the owners of the ranges between the boundaries of both
+// configs, neighbouring ranges moving between the same shards are reported together.
+func diffRanges(a, b snapshot) []Move {
+	var starts []string
+	for _, r := range append(append([]keyRange(nil), a.ranges...), b.ranges...) {
+		starts = append(starts, r.start)
+	}
+	sort.Strings(starts)
+
+	var moves []Move
+	var lo []string // start of each move
+	moved := false  // whether the previous range moved
+	for i, start := range starts {
+		if i > 0 && start == starts[i-1] {
+			continue
+		}
+		end := ""
+		for _, s := range starts[i:] {
+			if s != start {
+				end = s
+				break
+			}
+		}
+		from, to := a.names[rangeShard(a.ranges, start)], b.names[rangeShard(b.ranges, start)]
+		if from == to {
+			moved = false
+			continue
+		}
+		if n := len(moves); moved && moves[n-1].From == from && moves[n-1].To == to {
+			moves[n-1].Slot = keysSlot(lo[n-1], end)
+			continue
+		}
+		moves = append(moves, Move{Slot: keysSlot(start, end), From: from, To: to})
+		lo = append(lo, start)
+		moved = true
+	}
+	return moves
+}
+
+// keysSlot describes the keys [start, end), an empty end is the end of the keyspace.
+func keysSlot(start, end string) string {
+	if end == "" {
+		return fmt.Sprintf("keys [%q, end)", start)
+	}
+	return fmt.Sprintf("keys [%q, %q)", start, end)
+}
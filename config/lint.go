@@ -0,0 +1,141 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Lint returns all problems of the config, not only the first one like
+// ParseConfig: missing or duplicate indexes, names and addresses, replicas
+// sharing an address with a leader, addresses that are not host:port,
+// and invalid placement settings.
+func Lint(c Config) []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Shards) == 0 {
+		add("no shards")
+	}
+	idxs := make(map[int]string)
+	names := make(map[string]bool)
+	// Keyed by NormalizeAddr, so that spellings of the same address are duplicates.
+	leaders := make(map[string]string)  // address -> shard name
+	replicas := make(map[string]string) // address -> shard name
+	for _, s := range c.Shards {
+		if s.Name == "" {
+			add("shard %d has no name", s.Idx)
+		} else if names[s.Name] {
+			add("duplicate shard name %q", s.Name)
+		}
+		names[s.Name] = true
+
+		if other, exist := idxs[s.Idx]; exist {
+			add("shards %q and %q have the same index %d", other, s.Name, s.Idx)
+		}
+		idxs[s.Idx] = s.Name
+		if s.Idx < 0 || s.Idx >= len(c.Shards) {
+			add("index %d of shard %q is out of range [0, %d)", s.Idx, s.Name, len(c.Shards))
+		}
+
+		if err := checkAddr(s.Address); err != nil {
+			add("address of shard %q: %v", s.Name, err)
+		} else if other, exist := leaders[NormalizeAddr(s.Address)]; exist {
+			add("shards %q and %q have the same address %q", other, s.Name, s.Address)
+		}
+		leaders[NormalizeAddr(s.Address)] = s.Name
+	}
+	for i := range c.Shards {
+		if _, exist := idxs[i]; !exist {
+			add("no shard has index %d", i)
+		}
+	}
+
+	for _, s := range c.Shards {
+		for _, addr := range s.Replicas {
+			if err := checkAddr(addr); err != nil {
+				add("replica of shard %q: %v", s.Name, err)
+				continue
+			}
+			if leader, exist := leaders[NormalizeAddr(addr)]; exist {
+				add("replica %q of shard %q is the address of the leader of shard %q", addr, s.Name, leader)
+			}
+			if other, exist := replicas[NormalizeAddr(addr)]; exist {
+				add("replica %q is listed by shards %q and %q", addr, other, s.Name)
+			}
+			replicas[NormalizeAddr(addr)] = s.Name
+		}
+	}
+
+	// Anything else ParseConfig rejects, e.g. placement settings and ranges.
+	if len(errs) == 0 {
+		if _, err := ParseConfig(c, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// checkAddr verifies that addr is a host:port address.
+func checkAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("empty address")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("address %q has no host", addr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("address %q has an invalid port %q", addr, port)
+	}
+	return nil
+}
+
+// NormalizeAddr returns the canonical spelling of a host:port address, so that
+// a node is known by the same name whichever spelling it is configured with:
+// the host is lower-cased, localhost becomes 127.0.0.1 and IP addresses are
+// written in their canonical form. Other addresses are returned unchanged.
+func NormalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	} else if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
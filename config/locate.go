@@ -0,0 +1,87 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import "fmt"
+
+// Location explains the placement of a key.
+type Location struct {
+	Key       string
+	Placement string
+	// HashedKey is the part of the key that is hashed, see HashTag
+	// and Config.HashTags.
+	// Range placement does not hash keys and leaves it and Hash empty.
+	HashedKey string `json:",omitempty"`
+	Hash      uint64 `json:",omitempty"`
+	// Slot is the position of the hash that selects the shard: the
+	// remainder of the hash for modulo placement, the ring point
+	// owning the hash for ring placement and the start of the range
+	// for range placement.
+	Slot     string
+	Shard    int
+	Name     string
+	Leader   string
+	Replicas []string
+	Epoch    uint64
+}
+
+// Locate returns where the key is placed and why, the shard is the one
+// returned by Index.
+func (s *Shards) Locate(key string) Location {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loc := Location{Key: key, Epoch: s.Epoch}
+	switch {
+	case s.ranges != nil:
+		loc.Placement = PlacementRange
+		r := s.ranges[rangeIndex(s.ranges, key)]
+		loc.Shard = r.shard
+		loc.Slot = keysSlot(r.start, r.end)
+	case s.ring != nil:
+		loc.Placement = PlacementRing
+		loc.HashedKey = s.hashedKey(key)
+		loc.Hash = ringHash(loc.HashedKey)
+		i := s.ring.point(loc.Hash)
+		loc.Shard = s.ring.shards[i]
+		loc.Slot = fmt.Sprintf("ring point %#016x", s.ring.points[i])
+	default:
+		loc.Placement = PlacementModulo
+		loc.HashedKey = s.hashedKey(key)
+		loc.Hash = moduloHash(loc.HashedKey)
+		loc.Shard = int(loc.Hash % uint64(s.Count))
+		loc.Slot = fmt.Sprintf("hash %% %d = %d", s.Count, loc.Shard)
+	}
+
+	for _, sh := range s.config.Shards {
+		if sh.Idx == loc.Shard {
+			loc.Name = sh.Name
+		}
+	}
+	loc.Leader = s.Addrs[loc.Shard]
+	loc.Replicas = append([]string(nil), s.Replicas[loc.Shard]...)
+	return loc
+}
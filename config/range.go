@@ -0,0 +1,120 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// keyRange is the range of keys [start, end) owned by a shard,
+// an empty end is the end of the keyspace.
+type keyRange struct {
+	start, end string
+	shard      int
+}
+
+// contains reports whether the key falls into the range.
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
+}
+
+// newRanges verifies that the ranges of the shards cover the whole keyspace
+// without overlapping and returns them sorted by start.
+func newRanges(shards []Shard) ([]keyRange, error) {
+	var ranges []keyRange
+	for _, s := range shards {
+		ranges = append(ranges, keyRange{start: s.Start, end: s.End, shard: s.Idx})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	if len(ranges) > 0 && ranges[0].start != "" {
+		return nil, fmt.Errorf("no shard owns keys before %q", ranges[0].start)
+	}
+	for i, r := range ranges {
+		// Only the last range may run to the end of the keyspace.
+		if r.end == "" && i < len(ranges)-1 {
+			return nil, fmt.Errorf("range of shard %d has no end but is followed by shard %d from %q", r.shard, ranges[i+1].shard, ranges[i+1].start)
+		}
+		if r.end != "" && r.start >= r.end {
+			return nil, fmt.Errorf("shard %d has an empty range [%q, %q)", r.shard, r.start, r.end)
+		}
+		if i == 0 {
+			continue
+		}
+		if prev := ranges[i-1]; prev.end != r.start {
+			return nil, fmt.Errorf("ranges of shards %d and %d do not meet: %q and %q", prev.shard, r.shard, prev.end, r.start)
+		}
+	}
+	if len(ranges) > 0 && ranges[len(ranges)-1].end != "" {
+		return nil, fmt.Errorf("no shard owns keys from %q", ranges[len(ranges)-1].end)
+	}
+	return ranges, nil
+}
+
+// rangeShard returns the index of the shard whose range contains the key.
+func rangeShard(ranges []keyRange, key string) int {
+	return ranges[rangeIndex(ranges, key)].shard
+}
+
+// rangeIndex returns the position of the range containing the key.
+func rangeIndex(ranges []keyRange, key string) int {
+	return sort.Search(len(ranges), func(i int) bool { return ranges[i].start > key }) - 1
+}
+
+// equalRanges reports whether both lists place every key on the same shard.
+func equalRanges(a, b []keyRange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ScanShards returns the shards that may hold keys in [start, end), an empty end
+// being the end of the keyspace. With range placement the shards are returned
+// in key order and ordered is true, otherwise every shard is returned.
+func (s *Shards) ScanShards(start, end string) (shards []int, ordered bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.ranges == nil {
+		for i := 0; i < s.Count; i++ {
+			shards = append(shards, i)
+		}
+		return shards, false
+	}
+	for _, r := range s.ranges {
+		if (end == "" || r.start < end) && (r.end == "" || start < r.end) {
+			shards = append(shards, r.shard)
+		}
+	}
+	return shards, true
+}
@@ -0,0 +1,118 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// DefaultVirtualNodes is the number of points a shard of weight 1 gets on the ring.
+const DefaultVirtualNodes = 128
+
+// ring is a consistent-hash ring, each shard owns the keys hashed
+// between the points of the previous shard and its own points.
+type ring struct {
+	points []uint64 // sorted hashes of the virtual nodes
+	shards []int    // shard index of each point
+}
+
+// newRing places vnodes*weight virtual nodes of every shard on the ring.
+func newRing(weights map[int]int, vnodes int) *ring {
+	type point struct {
+		hash  uint64
+		shard int
+	}
+	var points []point
+	for idx, weight := range weights {
+		for i := 0; i < vnodes*weight; i++ {
+			points = append(points, point{hash: ringHash(fmt.Sprintf("shard-%d-vnode-%d", idx, i)), shard: idx})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+
+	r := &ring{}
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.shards = append(r.shards, p.shard)
+	}
+	return r
+}
+
+// equal reports whether both rings place every key on the same shard.
+func (r *ring) equal(o *ring) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	if len(r.points) != len(o.points) {
+		return false
+	}
+	for i := range r.points {
+		if r.points[i] != o.points[i] || r.shards[i] != o.shards[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// shard returns the index of the shard owning the key.
+func (r *ring) shard(key string) int {
+	return r.owner(ringHash(key))
+}
+
+// owner returns the index of the shard owning the hash.
+func (r *ring) owner(h uint64) int {
+	return r.shards[r.point(h)]
+}
+
+// point returns the position of the point owning the hash.
+func (r *ring) point(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// ringHash is fnv64a with a final mix, so short similar strings
+// still spread over the whole ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,121 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Split returns the next config in which the shard with index idx keeps the keys
+// before at and the new shard s takes over the keys from at to the end of its range.
+// Only range placement can be split.
+func Split(c Config, idx int, at string, s Shard) (Config, error) {
+	if c.Placement != PlacementRange {
+		return Config{}, fmt.Errorf("only range placement can be split, not %q", c.Placement)
+	}
+	next := c.clone()
+	sh := next.shard(idx)
+	if sh == nil {
+		return Config{}, fmt.Errorf("shard with index %d was not found", idx)
+	}
+	if at <= sh.Start || (sh.End != "" && at >= sh.End) {
+		return Config{}, fmt.Errorf("split key %q is not inside the range [%q, %q) of shard %q", at, sh.Start, sh.End, sh.Name)
+	}
+
+	s.Idx = len(next.Shards)
+	s.Start, s.End = at, sh.End
+	sh.End = at
+	next.Shards = append(next.Shards, s)
+	next.Epoch++
+	return next, next.validate()
+}
+
+// Merge returns the next config in which the shard with index into takes over
+// the keys of the neighbouring shard with index idx. The shard idx is removed and
+// the shards after it move down by one index. Only range placement can be merged.
+func Merge(c Config, idx, into int) (Config, error) {
+	if c.Placement != PlacementRange {
+		return Config{}, fmt.Errorf("only range placement can be merged, not %q", c.Placement)
+	}
+	if idx == into {
+		return Config{}, fmt.Errorf("cannot merge shard %d into itself", idx)
+	}
+	next := c.clone()
+	from, to := next.shard(idx), next.shard(into)
+	if from == nil || to == nil {
+		return Config{}, fmt.Errorf("shards with index %d and %d were not both found", idx, into)
+	}
+	switch {
+	case to.End != "" && to.End == from.Start:
+		to.End = from.End
+	case from.End != "" && from.End == to.Start:
+		to.Start = from.Start
+	default:
+		return Config{}, fmt.Errorf("shards %q and %q are not neighbours", from.Name, to.Name)
+	}
+
+	var shards []Shard
+	for _, s := range next.Shards {
+		switch {
+		case s.Idx == idx:
+			continue
+		case s.Idx > idx:
+			s.Idx--
+		}
+		shards = append(shards, s)
+	}
+	next.Shards = shards
+	next.Epoch++
+	return next, next.validate()
+}
+
+// Encode returns the config in the format of the config file.
+func Encode(c Config) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shard returns the shard with the given index or nil.
+func (c Config) shard(idx int) *Shard {
+	for i := range c.Shards {
+		if c.Shards[i].Idx == idx {
+			return &c.Shards[i]
+		}
+	}
+	return nil
+}
+
+// validate checks that the config can be used for routing.
+func (c Config) validate() error {
+	_, err := ParseConfig(c, "")
+	return err
+}
@@ -0,0 +1,62 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package config
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Watch checks the config file every interval and calls reload
+// with the parsed config whenever the file is modified.
+func Watch(filename string, interval time.Duration, reload func(Config)) {
+	var lastMod time.Time
+	if fi, err := os.Stat(filename); err == nil {
+		lastMod = fi.ModTime()
+	}
+
+	for {
+		time.Sleep(interval)
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			log.Printf("Watching config %q: %v", filename, err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+
+		c, err := ParseFile(filename)
+		if err != nil {
+			log.Printf("Error parsing modified config %q: %v", filename, err)
+			continue
+		}
+		reload(c)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// versionBucket maps keys to their version, the sequence number of their last write,
+// followed by their modification time, both as 8 big-endian bytes.
+var versionBucket = []byte("version")
+
+// ErrConditionFailed is returned by conditional writes whose condition does not hold.
+var ErrConditionFailed = errors.New("condition failed")
+
+// Condition is the precondition of a conditional write, the zero Condition always holds.
+// Expired keys do not exist.
+type Condition struct {
+	// Absent requires that the key does not exist.
+	Absent bool
+	// Exists requires that the key exists.
+	Exists bool
+	// Value, if not nil, requires that the key exists with this value.
+	Value []byte
+	// Version, if not 0, requires that the key exists with this version.
+	Version uint64
+	// NotVersion, if not 0, requires that the key does not have this version.
+	NotVersion uint64
+}
+
+// check returns an error wrapping ErrConditionFailed if the condition does not hold
+// for the key at now, in unix nanoseconds.
+func (c Condition) check(tx *bolt.Tx, key string, now int64) error {
+	k := []byte(key)
+	value := tx.Bucket(defaultBucket).Get(k)
+	if value != nil && expired(tx, k, now) {
+		value = nil
+	}
+	version := versionOf(tx, k)
+
+	switch {
+	case c.Absent && value != nil:
+		return fmt.Errorf("%w: key %q exists with version %d", ErrConditionFailed, key, version)
+	case (c.Exists || c.Value != nil || c.Version != 0) && value == nil:
+		return fmt.Errorf("%w: key %q does not exist", ErrConditionFailed, key)
+	case c.Value != nil && !bytes.Equal(value, c.Value):
+		return fmt.Errorf("%w: key %q has a different value", ErrConditionFailed, key)
+	case c.Version != 0 && version != c.Version:
+		return fmt.Errorf("%w: key %q has version %d, not %d", ErrConditionFailed, key, version, c.Version)
+	case c.NotVersion != 0 && value != nil && version == c.NotVersion:
+		return fmt.Errorf("%w: key %q has version %d", ErrConditionFailed, key, version)
+	}
+	return nil
+}
+
+// GetVersion returns the value of the key with its version,
+// expired keys are treated as absent.
+func (d *Database) GetVersion(key string) (value []byte, version uint64, err error) {
+	e, err := d.GetEntry(key)
+	if err != nil || e == nil {
+		return nil, 0, err
+	}
+	return e.Value, e.Version, nil
+}
+
+// GetEntry returns the value of the key with its metadata or nil if the key does not exist,
+// expired keys are treated as absent.
+func (d *Database) GetEntry(key string) (*KeyValue, error) {
+	var e *KeyValue
+	err := d.db.View(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		v := tx.Bucket(defaultBucket).Get(k)
+		if v == nil || expired(tx, k, time.Now().UnixNano()) {
+			return nil
+		}
+		e = &KeyValue{Key: key, Value: copyByteSlice(v), ExpiresAt: expiryOf(tx, k), Version: versionOf(tx, k), Modified: modifiedOf(tx, k)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetIf sets the key if cond holds, the check and the write are atomic.
+// A non-zero expiresAt makes the key expire, see SetWithExpiry.
+// Returns the sequence number of the write in the replication log,
+// which is also the new version of the key.
+func (d *Database) SetIf(key string, value []byte, expiresAt time.Time, cond Condition) (seq uint64, err error) {
+	if d.ReadOnly() {
+		return 0, errors.New("read-only mode")
+	}
+	err = d.update(func(tx *bolt.Tx) error {
+		e := KeyValue{Key: key, Value: value, Modified: time.Now().UnixNano()}
+		if err := cond.check(tx, key, e.Modified); err != nil {
+			return err
+		}
+		if expiresAt.IsZero() {
+			seq, err = appendLog(tx, OpSet, key, value, e.Modified)
+		} else {
+			e.ExpiresAt = expiresAt.UnixNano()
+			seq, err = appendLog(tx, OpSetExpiring, key, ExpiringValue(value, expiresAt), e.Modified)
+		}
+		if err != nil {
+			return err
+		}
+		e.Version = seq
+		return putValue(tx, e)
+	})
+	return seq, err
+}
+
+// DeleteIf deletes the key if cond holds, the check and the delete are atomic.
+// Returns the sequence number of the tombstone in the replication log.
+func (d *Database) DeleteIf(key string, cond Condition) (seq uint64, err error) {
+	if d.ReadOnly() {
+		return 0, errors.New("read-only mode")
+	}
+	err = d.update(func(tx *bolt.Tx) error {
+		now := time.Now().UnixNano()
+		if err := cond.check(tx, key, now); err != nil {
+			return err
+		}
+		if err := deleteValue(tx, key); err != nil {
+			return err
+		}
+		seq, err = appendLog(tx, OpDelete, key, nil, now)
+		return err
+	})
+	return seq, err
+}
+
+// setVersion replaces the version and modification time of the key, a version of 0 removes both.
+func setVersion(tx *bolt.Tx, key string, version uint64, modified int64) error {
+	b := tx.Bucket(versionBucket)
+	if version == 0 {
+		return b.Delete([]byte(key))
+	}
+	return b.Put([]byte(key), append(seqKey(version), seqKey(uint64(modified))...))
+}
+
+// versionOf returns the version of the key, 0 if it is unknown.
+func versionOf(tx *bolt.Tx, key []byte) uint64 {
+	v := tx.Bucket(versionBucket).Get(key)
+	if len(v) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// modifiedOf returns the modification time of the key in unix nanoseconds, 0 if it is unknown.
+func modifiedOf(tx *bolt.Tx, key []byte) int64 {
+	v := tx.Bucket(versionBucket).Get(key)
+	if len(v) != 16 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v[8:]))
+}
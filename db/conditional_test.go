@@ -0,0 +1,191 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func TestSetIf(t *testing.T) {
+	db := createTempDB(t, false)
+	never := time.Time{}
+
+	seq, err := db.SetIf("lock", []byte("owner-1"), never, internalDB.Condition{Absent: true})
+	if err != nil {
+		t.Fatalf("SetIf(absent) of a new key: got %v, want nil error", err)
+	}
+	if _, err := db.SetIf("lock", []byte("owner-2"), never, internalDB.Condition{Absent: true}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("SetIf(absent) of an existing key: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+	if _, err := db.SetIf("missing", []byte("value"), never, internalDB.Condition{Exists: true}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("SetIf(exists) of a missing key: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+
+	value, version, err := db.GetVersion("lock")
+	if err != nil || string(value) != "owner-1" || version != seq {
+		t.Fatalf("GetVersion(lock): got %q, %d, %v; want %q, %d, nil", value, version, err, "owner-1", seq)
+	}
+
+	// Compare-and-set against the version and the value.
+	if _, err := db.SetIf("lock", []byte("owner-2"), never, internalDB.Condition{Version: version + 1}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("SetIf with a wrong version: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+	seq, err = db.SetIf("lock", []byte("owner-2"), never, internalDB.Condition{Version: version})
+	if err != nil {
+		t.Fatalf("SetIf with the current version: got %v, want nil error", err)
+	}
+	if _, err := db.SetIf("lock", []byte("owner-3"), never, internalDB.Condition{Value: []byte("owner-1")}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("SetIf with a wrong value: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+	if _, err := db.SetIf("lock", []byte("owner-3"), never, internalDB.Condition{Value: []byte("owner-2"), Version: seq}); err != nil {
+		t.Errorf("SetIf with the current value and version: got %v, want nil error", err)
+	}
+
+	if _, err := db.DeleteIf("lock", internalDB.Condition{Value: []byte("owner-2")}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("DeleteIf with a wrong value: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+	if _, err := db.DeleteIf("lock", internalDB.Condition{Value: []byte("owner-3")}); err != nil {
+		t.Errorf("DeleteIf with the current value: got %v, want nil error", err)
+	}
+	if value, version, err := db.GetVersion("lock"); err != nil || value != nil || version != 0 {
+		t.Errorf("GetVersion(lock) after delete: got %q, %d, %v; want nil, 0, nil", value, version, err)
+	}
+
+	// Expired keys are absent.
+	if _, err := db.SetWithExpiry("lease", []byte("old"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetWithExpiry(lease): %v", err)
+	}
+	if _, err := db.SetIf("lease", []byte("new"), time.Now().Add(time.Hour), internalDB.Condition{Absent: true}); err != nil {
+		t.Errorf("SetIf(absent) of an expired key: got %v, want nil error", err)
+	}
+}
+
+func TestVersionReplication(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "a", "1")
+	setKey(t, leader, "b", "2")
+	setKey(t, leader, "a", "3")
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		_, want, _ := leader.GetVersion(key)
+		if _, got, err := replica.GetVersion(key); err != nil || got != want {
+			t.Errorf("Version of %q on the replica: got %d, %v; want %d, nil", key, got, err, want)
+		}
+	}
+}
+
+func TestApplyConditionalEntries(t *testing.T) {
+	replica := createTempDB(t, true)
+
+	now := time.Now().UnixNano()
+	entries := []*internalDB.LogEntry{
+		{Seq: 1, Op: internalDB.OpSet, Key: "a", Value: []byte("1"), Time: now, Cond: &internalDB.Condition{Absent: true}},
+		{Seq: 2, Op: internalDB.OpSet, Key: "a", Value: []byte("2"), Time: now, Cond: &internalDB.Condition{Absent: true}},
+		{Seq: 3, Op: internalDB.OpSet, Key: "a", Value: []byte("3"), Time: now, Cond: &internalDB.Condition{Version: 1}},
+		{Seq: 4, Op: internalDB.OpDelete, Key: "a", Time: now, Cond: &internalDB.Condition{Value: []byte("1")}},
+	}
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	for i, want := range []bool{true, false, true, false} {
+		if held := entries[i].CondErr == nil; held != want || !held && !errors.Is(entries[i].CondErr, internalDB.ErrConditionFailed) {
+			t.Errorf("Condition of entry %d: got error %v, want held %v", entries[i].Seq, entries[i].CondErr, want)
+		}
+	}
+	if value, version, err := replica.GetVersion("a"); err != nil || string(value) != "3" || version != 3 {
+		t.Errorf("GetVersion(a): got %q, %d, %v; want \"3\", 3, nil", value, version, err)
+	}
+	if got, err := replica.AppliedSeq(); err != nil || got != 4 {
+		t.Errorf("AppliedSeq(): got %d, %v; want 4, nil", got, err)
+	}
+}
+
+func TestGetEntry(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	before := time.Now().UnixNano()
+	setKey(t, leader, "a", "1")
+	after := time.Now().UnixNano()
+	e, err := leader.GetEntry("a")
+	if err != nil || e == nil {
+		t.Fatalf("GetEntry(a): got %+v, %v; want the entry", e, err)
+	}
+	if string(e.Value) != "1" || e.Version == 0 || e.Modified < before || e.Modified > after {
+		t.Errorf("GetEntry(a): got %+v, want value 1, a version and a modification time in [%d, %d]", e, before, after)
+	}
+	if e, err := leader.GetEntry("missing"); err != nil || e != nil {
+		t.Errorf("GetEntry(missing): got %+v, %v; want nil, nil", e, err)
+	}
+
+	// Replicas keep the modification time of the leader.
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if got, err := replica.GetEntry("a"); err != nil || got == nil || got.Version != e.Version || got.Modified != e.Modified {
+		t.Errorf("GetEntry(a) on the replica: got %+v, %v; want %+v", got, err, e)
+	}
+
+	if _, err := leader.SetIf("a", []byte("2"), time.Time{}, internalDB.Condition{NotVersion: e.Version}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("SetIf with the current version as NotVersion: got %v, want %v", err, internalDB.ErrConditionFailed)
+	}
+	if _, err := leader.SetIf("a", []byte("2"), time.Time{}, internalDB.Condition{NotVersion: e.Version + 1}); err != nil {
+		t.Errorf("SetIf with another version as NotVersion: got %v, want nil error", err)
+	}
+}
+
+func TestImportedVersion(t *testing.T) {
+	db := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	// The key had version 100 on its previous owner.
+	if _, err := db.ImportKeys([]internalDB.KeyValue{{Key: "a", Value: []byte("1"), Version: 100}}, func(string) bool { return false }); err != nil {
+		t.Fatalf("ImportKeys(): %v", err)
+	}
+	_, imported, err := db.GetVersion("a")
+	if err != nil || imported <= 100 {
+		t.Errorf("GetVersion(a) after import: got %d, %v; want a version above 100", imported, err)
+	}
+	seq, err := db.Set("a", []byte("2"))
+	if err != nil || seq <= imported {
+		t.Errorf("Set(a) after import: got version %d, %v; want a version above %d", seq, err, imported)
+	}
+
+	if err := replica.ApplyLogEntries(logEntries(t, db, 0, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if _, got, err := replica.GetVersion("a"); err != nil || got != seq {
+		t.Errorf("Version of a on the replica: got %d, %v; want %d, nil", got, err, seq)
+	}
+}
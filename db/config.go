@@ -0,0 +1,51 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// configKey holds the config the node routes by in the meta bucket.
+var configKey = []byte("config")
+
+// SaveConfig stores the encoded config the node routes by, so that a restarted
+// node does not fall back to an older config file. It is local to the node
+// and not part of the replication log.
+func (d *Database) SaveConfig(data []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(configKey, data)
+	})
+}
+
+// SavedConfig returns the config stored by SaveConfig or nil if there is none.
+func (d *Database) SavedConfig() (data []byte, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		data = copyByteSlice(tx.Bucket(metaBucket).Get(configKey))
+		return nil
+	})
+	return data, err
+}
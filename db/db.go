@@ -26,21 +26,29 @@
 package db
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	defaultBucket = []byte("default")
-	replicaBucket = []byte("replica")
+	logBucket     = []byte("log")
+	metaBucket    = []byte("meta")
+	acksBucket    = []byte("acks")
 )
 
 type Database struct {
-	db       *bolt.DB
-	readOnly bool
+	db *bolt.DB
+
+	mu       sync.Mutex
+	readOnly bool          // false once a replica is promoted to leader
+	changed  chan struct{} // closed and replaced after every committed write
+	maxLog   uint64        // largest number of log entries kept for replicas, 0 without a limit
+
+	promoteMu sync.Mutex // serializes Promote
 }
 
 func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() error, err error) {
@@ -49,7 +57,7 @@ func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() e
 		return nil, nil, err
 	}
 
-	db = &Database{db: boltDB, readOnly: readOnly}
+	db = &Database{db: boltDB, readOnly: readOnly, changed: make(chan struct{})}
 	closeFunc = boltDB.Close
 
 	if err := db.createBucket(); err != nil {
@@ -62,33 +70,86 @@ func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() e
 
 func (d *Database) createBucket() error {
 	return d.db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists(defaultBucket); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists(replicaBucket); err != nil {
-			return err
+		for _, name := range [][]byte{defaultBucket, logBucket, metaBucket, acksBucket, expiryBucket, expiryIndexBucket, versionBucket, migrationDeletedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
-// Set key
-func (d *Database) Set(key string, value []byte) error {
-	if d.readOnly {
-		return errors.New("read-only mode")
-	}
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket(defaultBucket).Put([]byte(key), value); err != nil {
+// Changed returns a channel that is closed after the next committed write.
+// Callers must obtain the channel before reading the state they wait on,
+// so that no write is missed in between.
+func (d *Database) Changed() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changed
+}
+
+// ReadOnly reports whether the database is a read-only replica.
+func (d *Database) ReadOnly() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readOnly
+}
+
+// SetMaxLogEntries limits the number of log entries kept for replicas that have not
+// acknowledged them, 0 keeps them until every registered replica did. A replica that
+// falls further behind bootstraps from a snapshot, see ErrLogTruncated.
+func (d *Database) SetMaxLogEntries(max uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxLog = max
+}
+
+// update runs fn in a read-write transaction and wakes up
+// everyone waiting on Changed once the transaction commits.
+// The oldest log entries beyond SetMaxLogEntries are deleted in the same transaction.
+func (d *Database) update(fn func(tx *bolt.Tx) error) error {
+	d.mu.Lock()
+	maxLog := d.maxLog
+	d.mu.Unlock()
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
 			return err
 		}
-		return tx.Bucket(replicaBucket).Put([]byte(key), value)
+		if maxLog > 0 {
+			return trimLog(tx, maxLog)
+		}
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+	return nil
+}
+
+// Set key, returns the sequence number of the write in the replication log.
+func (d *Database) Set(key string, value []byte) (seq uint64, err error) {
+	return d.SetIf(key, value, time.Time{}, Condition{})
 }
 
-// Get key
+// Delete key, a tombstone is appended to the replication log
+// so that replicas delete the key as well.
+// Returns the sequence number of the tombstone.
+func (d *Database) Delete(key string) (seq uint64, err error) {
+	return d.DeleteIf(key, Condition{})
+}
+
+// Get key, expired keys are treated as absent.
 func (d *Database) Get(key string) ([]byte, error) {
 	var result []byte
 	err := d.db.View(func(tx *bolt.Tx) error {
+		if expired(tx, []byte(key), time.Now().UnixNano()) {
+			return nil
+		}
 		b := tx.Bucket(defaultBucket)
 		result = copyByteSlice(b.Get([]byte(key)))
 		return nil
@@ -99,6 +160,29 @@ func (d *Database) Get(key string) ([]byte, error) {
 	return result, nil
 }
 
+// Scan returns up to limit keys in [start, end) in key order together with their values,
+// an empty end is the end of the keyspace. Expired keys are skipped.
+func (d *Database) Scan(start, end string, limit int) (entries []KeyValue, err error) {
+	now := time.Now().UnixNano()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && len(entries) < limit; k, v = c.Next() {
+			if end != "" && string(k) >= end {
+				break
+			}
+			if expired(tx, k, now) {
+				continue
+			}
+			entries = append(entries, KeyValue{Key: string(k), Value: copyByteSlice(v), ExpiresAt: expiryOf(tx, k), Version: versionOf(tx, k), Modified: modifiedOf(tx, k)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
 // DeleteExtraKeys deletes extra keys that do not belong to this shard.
 func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
 	var keys []string
@@ -117,10 +201,16 @@ func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
 		return err
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
+	readOnly := d.ReadOnly()
+	return d.update(func(tx *bolt.Tx) error {
 		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
+			if err := deleteValue(tx, k); err != nil {
+				return err
+			}
+			if readOnly {
+				continue
+			}
+			if _, err := appendLog(tx, OpDelete, k, nil, time.Now().UnixNano()); err != nil {
 				return err
 			}
 		}
@@ -128,12 +218,26 @@ func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
 	})
 }
 
-// SetReplica this function is intended to be used only on replicas.
-// It sets the key value into default bucket without writes to replication queue.
-func (d *Database) SetReplica(key string, value []byte) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(defaultBucket).Put([]byte(key), value)
-	})
+// putValue sets the key within tx together with its expiry time, version and modification time.
+func putValue(tx *bolt.Tx, e KeyValue) error {
+	if err := tx.Bucket(defaultBucket).Put([]byte(e.Key), e.Value); err != nil {
+		return err
+	}
+	if err := setExpiry(tx, e.Key, e.ExpiresAt); err != nil {
+		return err
+	}
+	return setVersion(tx, e.Key, e.Version, e.Modified)
+}
+
+// deleteValue deletes the key and its metadata within tx.
+func deleteValue(tx *bolt.Tx, key string) error {
+	if err := tx.Bucket(defaultBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	if err := setExpiry(tx, key, 0); err != nil {
+		return err
+	}
+	return setVersion(tx, key, 0, 0)
 }
 
 func copyByteSlice(b []byte) []byte {
@@ -144,34 +248,3 @@ func copyByteSlice(b []byte) []byte {
 	copy(c, b)
 	return c
 }
-
-// GetOldKey returns key and value that have not been applied to replicas,
-// if no such keys exist, returns nil key and nil value.
-func (d *Database) GetOldKey() (key, value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		k, v := b.Cursor().First()
-		key = copyByteSlice(k)
-		value = copyByteSlice(v)
-		return nil
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	return key, value, err
-}
-
-// DeleteReplicaKey deletes key from replication queue.
-func (d *Database) DeleteReplicaKey(key, value []byte) (err error) {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		v := b.Get(key)
-		if v == nil {
-			return errors.New("key does not exist")
-		}
-		if !bytes.Equal(v, value) {
-			return errors.New("value does not exist")
-		}
-		return b.Delete(key)
-	})
-}
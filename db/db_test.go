@@ -29,6 +29,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
@@ -58,7 +59,7 @@ func createTempDB(t *testing.T, readonly bool) *internalDB.Database {
 
 func TestGetSet(t *testing.T) {
 	db := createTempDB(t, false)
-	if err := db.Set("hello", []byte("world")); err != nil {
+	if _, err := db.Set("hello", []byte("world")); err != nil {
 		t.Fatalf("Cannot write key: %v", err)
 	}
 	value, err := db.Get("hello")
@@ -72,7 +73,7 @@ func TestGetSet(t *testing.T) {
 
 func setKey(t *testing.T, d *internalDB.Database, key, value string) {
 	t.Helper()
-	if err := d.Set(key, []byte(value)); err != nil {
+	if _, err := d.Set(key, []byte(value)); err != nil {
 		t.Fatalf("SetKey(%q, %q) failed: %v", key, value, err)
 	}
 }
@@ -106,33 +107,97 @@ func TestDeleteExtraKeys(t *testing.T) {
 
 func TestSetOnReadOnly(t *testing.T) {
 	db := createTempDB(t, true)
-	if err := db.Set("foo", []byte("bar")); err == nil {
+	if _, err := db.Set("foo", []byte("bar")); err == nil {
 		t.Fatalf("SetOnReadOnly(%q, %q): got nil error, want non-nil error", "foo", []byte("bar"))
 	}
 }
 
-func TestDeleteReplicaKey(t *testing.T) {
+func TestDelete(t *testing.T) {
 	db := createTempDB(t, false)
 	setKey(t, db, "hello", "world")
-	k, v, err := db.GetOldKey()
-	if err != nil {
-		t.Fatalf(`Unexpected error for GetOldKey(): %v`, err)
+
+	if _, err := db.Delete("hello"); err != nil {
+		t.Fatalf(`Delete("hello"): got %v, want nil error`, err)
 	}
-	if !bytes.Equal(k, []byte("hello")) || !bytes.Equal(v, []byte("world")) {
-		t.Errorf(`GetOldKey() returns unexpected key-value: got %q, %q; want %q, %q`, k, v, "hello", "world")
+	if value := getKey(t, db, "hello"); value != "" {
+		t.Errorf(`Unexpected value for key "hello": got %q, want %q`, value, "")
 	}
-	if err := db.DeleteReplicaKey([]byte("hello"), []byte("foo")); err == nil {
-		t.Fatalf(`DeleteReplicaKey("hello", "foo"): got nil error, want non-nil error`)
+}
+
+func TestDeleteOnReadOnly(t *testing.T) {
+	db := createTempDB(t, true)
+	if _, err := db.Delete("foo"); err == nil {
+		t.Fatalf("DeleteOnReadOnly(%q): got nil error, want non-nil error", "foo")
 	}
-	if err := db.DeleteReplicaKey([]byte("hello"), []byte("world")); err != nil {
-		t.Fatalf(`DeleteReplicaKey("hello", "world"): got %v, want nil error`, err)
+}
+
+func TestChanged(t *testing.T) {
+	db := createTempDB(t, false)
+	changed := db.Changed()
+
+	select {
+	case <-changed:
+		t.Fatalf("Changed() is closed before any write")
+	default:
 	}
-	// Now the previous `k` `v` should be deleted, there are not more keys to delete.
-	k, v, err = db.GetOldKey()
-	if err != nil {
-		t.Fatalf(`Unexpected error for GetOldKey(): %v`, err)
+
+	setKey(t, db, "hello", "world")
+
+	select {
+	case <-changed:
+	default:
+		t.Errorf("Changed() is not closed after a write")
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := createTempDB(t, false)
+	for _, key := range []string{"d", "a", "c", "b", "e"} {
+		setKey(t, db, key, "value-"+key)
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		limit      int
+		want       string
+	}{
+		{"", "", 10, "a,b,c,d,e"},
+		{"b", "d", 10, "b,c"},
+		{"bb", "", 2, "c,d"},
+		{"f", "", 10, ""},
+	} {
+		entries, err := db.Scan(tc.start, tc.end, tc.limit)
+		if err != nil {
+			t.Fatalf("Scan(%q, %q, %d): got %v, want nil error", tc.start, tc.end, tc.limit, err)
+		}
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+			if string(e.Value) != "value-"+e.Key {
+				t.Errorf("Scan(%q, %q, %d): got value %q for key %q", tc.start, tc.end, tc.limit, e.Value, e.Key)
+			}
+		}
+		if got := strings.Join(keys, ","); got != tc.want {
+			t.Errorf("Scan(%q, %q, %d): got keys %q, want %q", tc.start, tc.end, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	db := createTempDB(t, false)
+	for _, key := range []string{"a", "b", "c", "d", "e", "x"} {
+		setKey(t, db, key, "value-"+key)
+	}
+
+	key, err := db.SplitKey("", "", func(key string) bool { return key != "x" })
+	if err != nil || key != "c" {
+		t.Errorf("SplitKey of all keys: got %q, %v; want %q, nil", key, err, "c")
+	}
+	key, err = db.SplitKey("b", "e", func(string) bool { return true })
+	if err != nil || key != "c" {
+		t.Errorf("SplitKey of [b, e): got %q, %v; want %q, nil", key, err, "c")
 	}
-	if k != nil || v != nil {
-		t.Errorf(`GetOldKey(): got %q, %q; want nil, nil`, k, v)
+	if _, err := db.SplitKey("x", "", func(string) bool { return true }); err == nil {
+		t.Errorf("SplitKey of a single key: got nil error, want non-nil error")
 	}
 }
@@ -0,0 +1,633 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Op is the kind of mutation recorded in the replication log.
+type Op byte
+
+const (
+	OpSet Op = iota + 1
+	OpDelete
+	// OpNoop only advances the applied position, Raft leaders append it
+	// at the start of their term. An OpNoop entry with the previous position
+	// as 8 big-endian bytes of value marks a gap in the log, see advanceLog.
+	OpNoop
+	// OpSetExpiring sets a key that expires, the value of the entry
+	// is built by ExpiringValue.
+	OpSetExpiring
+	// OpExpire deletes a key only if it has expired at the time of the entry,
+	// a write that renewed the key before the entry was applied is kept.
+	OpExpire
+)
+
+var appliedSeqKey = []byte("applied-seq")
+
+// termShift is the bit position of the leadership term in sequence numbers.
+// A promoted leader continues the log at term<<termShift, so the sequence numbers,
+// and with them the key versions, of writes its predecessor accepted but never
+// replicated are not reused.
+const termShift = 40
+
+// Term returns the leadership term of the log position seq.
+func Term(seq uint64) uint64 {
+	return seq >> termShift
+}
+
+// ErrLogTruncated is returned when the requested log entries have already been
+// truncated, the reader must bootstrap from a snapshot instead.
+var ErrLogTruncated = errors.New("replication log is truncated")
+
+// ErrLogAhead is returned when the requested position is ahead of the log,
+// which happens when a replica applied entries the current leader never had.
+// The reader must bootstrap from a snapshot instead.
+var ErrLogAhead = errors.New("position is ahead of the replication log")
+
+// LogEntry is a single mutation in the replication log,
+// entries are ordered by their sequence number.
+type LogEntry struct {
+	Seq   uint64
+	Op    Op
+	Key   string
+	Value []byte
+	// Time is when the leader accepted the write in unix nanoseconds,
+	// it becomes the modification time of the key. It is 0 for entries
+	// written before log entries carried a time.
+	Time int64 `json:",omitempty"`
+	// Cond, if not nil, is the condition of a conditional write that is checked
+	// when the entry is applied, at its time. Only Raft entries carry it,
+	// the replication log only has the writes whose condition held.
+	Cond *Condition `json:",omitempty"`
+	// CondErr is set by ApplyLogEntries if Cond did not hold,
+	// the entry then only advances the applied position.
+	CondErr error `json:"-"`
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// appendLog appends a mutation accepted at the given time to the replication log
+// within tx, the sequence number is assigned by the log bucket.
+func appendLog(tx *bolt.Tx, op Op, key string, value []byte, at int64) (seq uint64, err error) {
+	b := tx.Bucket(logBucket)
+	seq, err = b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	if err := addLogLen(tx, 1); err != nil {
+		return 0, err
+	}
+	return seq, b.Put(seqKey(seq), encodeLogEntry(op, key, value, at))
+}
+
+// logLenKey holds the number of entries of the log bucket in the meta bucket.
+var logLenKey = []byte("log-len")
+
+// logLen returns the number of entries of the log within tx. Databases written
+// before the number was kept count the entries once.
+func logLen(tx *bolt.Tx) uint64 {
+	if v := tx.Bucket(metaBucket).Get(logLenKey); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return uint64(tx.Bucket(logBucket).Stats().KeyN)
+}
+
+// addLogLen adds delta to the number of entries of the log within tx.
+func addLogLen(tx *bolt.Tx, delta int64) error {
+	return tx.Bucket(metaBucket).Put(logLenKey, seqKey(uint64(int64(logLen(tx))+delta)))
+}
+
+// advanceLog moves the log within tx to at least seq by appending an OpNoop entry at seq
+// that records the previous position, replicas skip the gap before it.
+func advanceLog(tx *bolt.Tx, seq uint64, at int64) error {
+	b := tx.Bucket(logBucket)
+	prev := b.Sequence()
+	if seq <= prev {
+		return nil
+	}
+	if err := b.SetSequence(seq - 1); err != nil {
+		return err
+	}
+	_, err := appendLog(tx, OpNoop, "", seqKey(prev), at)
+	return err
+}
+
+// skipsFrom returns the position before the gap the entry ends, see advanceLog.
+func (e *LogEntry) skipsFrom() (prev uint64, ok bool) {
+	if e.Op != OpNoop || len(e.Value) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(e.Value), true
+}
+
+// logEntryTimeFlag is set in the op byte of entries that carry a time.
+const logEntryTimeFlag = 0x80
+
+// encodeLogEntry encodes the entry as op with logEntryTimeFlag, time as 8 big-endian bytes,
+// uvarint key length, key and value.
+func encodeLogEntry(op Op, key string, value []byte, at int64) []byte {
+	res := make([]byte, 9+binary.MaxVarintLen64, 9+binary.MaxVarintLen64+len(key)+len(value))
+	res[0] = byte(op) | logEntryTimeFlag
+	binary.BigEndian.PutUint64(res[1:], uint64(at))
+	n := binary.PutUvarint(res[9:], uint64(len(key)))
+	res = append(res[:9+n], key...)
+	return append(res, value...)
+}
+
+func decodeLogEntry(k, v []byte) (*LogEntry, error) {
+	if len(k) != 8 || len(v) == 0 {
+		return nil, errors.New("malformed log entry")
+	}
+	e := &LogEntry{
+		Seq: binary.BigEndian.Uint64(k),
+		Op:  Op(v[0] &^ logEntryTimeFlag),
+	}
+	off := 1 // start of the key length
+	if v[0]&logEntryTimeFlag != 0 {
+		if len(v) < 9 {
+			return nil, errors.New("malformed log entry time")
+		}
+		e.Time = int64(binary.BigEndian.Uint64(v[1:]))
+		off = 9
+	}
+	keyLen, n := binary.Uvarint(v[off:])
+	if n <= 0 || uint64(len(v)-off-n) < keyLen {
+		return nil, errors.New("malformed log entry key")
+	}
+	off += n
+	e.Key = string(v[off : off+int(keyLen)])
+	switch e.Op {
+	case OpSet, OpSetExpiring, OpNoop:
+		e.Value = copyByteSlice(v[off+int(keyLen):])
+	case OpDelete, OpExpire:
+	default:
+		return nil, fmt.Errorf("unknown log entry op %d", e.Op)
+	}
+	return e, nil
+}
+
+// LogEntries returns up to limit log entries with sequence number greater than after,
+// in sequence order.
+// Returns ErrLogTruncated if some entries after the position are no longer in the log
+// and ErrLogAhead if the position is past the last entry of the log or within a gap of it.
+func (d *Database) LogEntries(after uint64, limit int) (entries []*LogEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		if after < truncatedSeq(tx) {
+			return ErrLogTruncated
+		}
+		if after > tx.Bucket(logBucket).Sequence() {
+			return ErrLogAhead
+		}
+		c := tx.Bucket(logBucket).Cursor()
+		for k, v := c.Seek(seqKey(after + 1)); k != nil && len(entries) < limit; k, v = c.Next() {
+			e, err := decodeLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			if prev, ok := e.skipsFrom(); ok && len(entries) == 0 && after > prev {
+				return ErrLogAhead
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LastSeq returns the sequence number of the last write appended to the log.
+func (d *Database) LastSeq() (seq uint64, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(logBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+// PendingEntries returns the number of log entries after the position seq,
+// which differs from the distance to the last sequence number across gaps.
+func (d *Database) PendingEntries(seq uint64) (n uint64, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(logBucket).Cursor()
+		for k, _ := c.Seek(seqKey(seq + 1)); k != nil; k, _ = c.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// truncatedSeq returns the sequence number of the last entry removed from the log.
+func truncatedSeq(tx *bolt.Tx) uint64 {
+	b := tx.Bucket(logBucket)
+	k, v := b.Cursor().First()
+	if k == nil {
+		return b.Sequence()
+	}
+	if e, err := decodeLogEntry(k, v); err == nil {
+		if prev, ok := e.skipsFrom(); ok {
+			return prev
+		}
+	}
+	return binary.BigEndian.Uint64(k) - 1
+}
+
+// RegisterReplica registers a replica that must acknowledge every log entry
+// before the entry is truncated. Registering a known replica is a no-op.
+func (d *Database) RegisterReplica(name string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acksBucket)
+		if b.Get([]byte(name)) != nil {
+			return nil
+		}
+		return b.Put([]byte(name), seqKey(0))
+	})
+}
+
+// UnregisterReplica stops keeping log entries for a replica that left the shard,
+// the log is truncated up to the lowest sequence number acknowledged by the remaining replicas.
+// Unregistering an unknown replica is a no-op.
+func (d *Database) UnregisterReplica(name string) error {
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acksBucket)
+		if b.Get([]byte(name)) == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(name)); err != nil {
+			return err
+		}
+		minAck, ok, err := minReplicaAck(b)
+		if err != nil || !ok {
+			return err
+		}
+		return truncateLog(tx, minAck)
+	})
+}
+
+// Replicas returns the names of the registered replicas.
+func (d *Database) Replicas() (names []string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(acksBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// minReplicaAck returns the lowest sequence number acknowledged by the replicas
+// of the acks bucket b, ok is false if there are none.
+func minReplicaAck(b *bolt.Bucket) (minAck uint64, ok bool, err error) {
+	err = b.ForEach(func(k, v []byte) error {
+		if len(v) != 8 {
+			return fmt.Errorf("malformed ack for replica %q", k)
+		}
+		if ack := binary.BigEndian.Uint64(v); !ok || ack < minAck {
+			minAck, ok = ack, true
+		}
+		return nil
+	})
+	return minAck, ok, err
+}
+
+// AckReplica records that the replica has applied log entries up to and including seq,
+// unknown replicas are registered. The log is then truncated up to the lowest
+// sequence number acknowledged by all registered replicas.
+func (d *Database) AckReplica(name string, seq uint64) error {
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acksBucket)
+		if v := b.Get([]byte(name)); len(v) == 8 && binary.BigEndian.Uint64(v) >= seq {
+			return nil
+		}
+		if err := b.Put([]byte(name), seqKey(seq)); err != nil {
+			return err
+		}
+
+		minAck, _, err := minReplicaAck(b)
+		if err != nil {
+			return err
+		}
+		return truncateLog(tx, minAck)
+	})
+}
+
+// WaitForAcks blocks until at least n registered replicas have acknowledged
+// the log up to and including seq, a negative n waits for all registered replicas.
+func (d *Database) WaitForAcks(ctx context.Context, seq uint64, n int) error {
+	for {
+		changed := d.Changed()
+
+		var acked, total int
+		err := d.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(acksBucket).ForEach(func(k, v []byte) error {
+				total++
+				if len(v) == 8 && binary.BigEndian.Uint64(v) >= seq {
+					acked++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		need := n
+		if need < 0 {
+			need = total
+		}
+		if need > total {
+			return fmt.Errorf("need %d replica acknowledgements, but only %d replicas are registered", need, total)
+		}
+		if acked >= need {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d replica acknowledgements for seq %d: %w", acked, need, seq, ctx.Err())
+		}
+	}
+}
+
+// ReplicaAcks returns the last sequence number acknowledged by each registered replica
+// together with the number of log entries still kept for the slowest of them.
+func (d *Database) ReplicaAcks() (acks map[string]uint64, queued uint64, err error) {
+	acks = make(map[string]uint64)
+	err = d.db.View(func(tx *bolt.Tx) error {
+		queued = logLen(tx)
+		return tx.Bucket(acksBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return fmt.Errorf("malformed ack for replica %q", k)
+			}
+			acks[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return acks, queued, nil
+}
+
+// trimLog deletes the oldest log entries until at most max are left,
+// whether replicas acknowledged them or not.
+func trimLog(tx *bolt.Tx, max uint64) error {
+	n := logLen(tx)
+	if n <= max {
+		return nil
+	}
+	c := tx.Bucket(logBucket).Cursor()
+	var deleted int64
+	for k, _ := c.First(); k != nil && n > max; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		n--
+		deleted++
+	}
+	return addLogLen(tx, -deleted)
+}
+
+// truncateLog deletes log entries with sequence number up to and including seq.
+func truncateLog(tx *bolt.Tx, seq uint64) error {
+	c := tx.Bucket(logBucket).Cursor()
+	var deleted int64
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	return addLogLen(tx, -deleted)
+}
+
+// AppliedSeq returns the sequence number of the last log entry applied on a replica.
+func (d *Database) AppliedSeq() (seq uint64, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		seq = appliedSeq(tx)
+		return nil
+	})
+	return seq, err
+}
+
+func appliedSeq(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(metaBucket).Get(appliedSeqKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// ApplyLogEntries this function is intended to be used only on replicas.
+// It applies the entries to default bucket without writes to replication log
+// and durably records the last sequence number, all in a single transaction.
+// Entries that have already been applied are ignored, entries whose condition
+// does not hold are skipped with their CondErr set.
+func (d *Database) ApplyLogEntries(entries []*LogEntry) error {
+	return d.update(func(tx *bolt.Tx) error {
+		applied := appliedSeq(tx)
+
+		for _, e := range entries {
+			if e.Seq <= applied {
+				continue
+			}
+			if prev, ok := e.skipsFrom(); (!ok || prev != applied) && e.Seq != applied+1 {
+				return fmt.Errorf("log gap: last applied %d, got %d", applied, e.Seq)
+			}
+
+			if e.Cond != nil {
+				if e.CondErr = e.Cond.check(tx, e.Key, e.Time); e.CondErr != nil {
+					applied = e.Seq
+					continue
+				}
+			}
+
+			var err error
+			switch e.Op {
+			case OpSet:
+				err = putValue(tx, KeyValue{Key: e.Key, Value: e.Value, Version: e.Seq, Modified: e.Time})
+			case OpSetExpiring:
+				kv := KeyValue{Key: e.Key, Version: e.Seq, Modified: e.Time}
+				if kv.Value, kv.ExpiresAt, err = splitExpiringValue(e.Value); err == nil {
+					err = putValue(tx, kv)
+				}
+			case OpDelete:
+				err = deleteValue(tx, e.Key)
+			case OpExpire:
+				if expired(tx, []byte(e.Key), e.Time) {
+					err = deleteValue(tx, e.Key)
+				}
+			case OpNoop:
+			default:
+				err = fmt.Errorf("unknown log entry op %d", e.Op)
+			}
+			if err != nil {
+				return err
+			}
+			applied = e.Seq
+		}
+
+		return tx.Bucket(metaBucket).Put(appliedSeqKey, seqKey(applied))
+	})
+}
+
+// Promote turns a replica into the leader of the term that accepts writes.
+// The replication log continues at the start of the term after a gap, replicas
+// that applied the same entries skip it and keep streaming from the new leader.
+// The term must be newer than the term of the entries the replica applied.
+func (d *Database) Promote(term uint64) error {
+	// d.mu is not held across the transaction, readers of d.readOnly may be waiting
+	// for the write lock of the database while holding it.
+	d.promoteMu.Lock()
+	defer d.promoteMu.Unlock()
+	if !d.ReadOnly() {
+		return nil
+	}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		applied := appliedSeq(tx)
+		b := tx.Bucket(logBucket)
+		if applied < b.Sequence() {
+			return fmt.Errorf("log sequence %d is ahead of applied %d", b.Sequence(), applied)
+		}
+		if term <= Term(applied) {
+			return fmt.Errorf("term %d is not newer than term %d of the applied log", term, Term(applied))
+		}
+		if err := b.SetSequence(applied); err != nil {
+			return err
+		}
+		return advanceLog(tx, term<<termShift, time.Now().UnixNano())
+	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.readOnly = false
+	d.mu.Unlock()
+	return nil
+}
+
+// Demote turns a leader that found a newer leader of its shard back into a replica
+// that rejects writes. The log and the acknowledgements of its term are dropped:
+// the log may hold writes the new leader never received, the replica restores
+// a snapshot of the new leader instead.
+func (d *Database) Demote() error {
+	d.promoteMu.Lock()
+	defer d.promoteMu.Unlock()
+	if d.ReadOnly() {
+		return nil
+	}
+	d.mu.Lock()
+	d.readOnly = true
+	d.mu.Unlock()
+
+	return d.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{logBucket, acksBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(logLenKey, seqKey(0)); err != nil {
+			return err
+		}
+		return meta.Put(appliedSeqKey, seqKey(0))
+	})
+}
+
+var (
+	voteTermKey = []byte("vote-term")
+	voteForKey  = []byte("vote-for")
+)
+
+// Vote records the vote of a replica for candidate as the leader of term.
+// A replica votes for a single candidate per term, only in terms newer than
+// the term of the entries it applied, and only for candidates whose applied
+// position seq is not behind its own. Leaders do not vote.
+// It returns whether the vote was granted and the newest term the replica voted in.
+func (d *Database) Vote(term uint64, candidate string, seq uint64) (granted bool, voted uint64, err error) {
+	d.promoteMu.Lock()
+	defer d.promoteMu.Unlock()
+	if !d.ReadOnly() {
+		return false, 0, nil
+	}
+
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		voted = votedTerm(tx)
+		applied := appliedSeq(tx)
+		switch {
+		case term < voted, term == voted && string(meta.Get(voteForKey)) != candidate:
+			return nil
+		case term <= Term(applied), seq < applied:
+			return nil
+		}
+		if err := meta.Put(voteTermKey, seqKey(term)); err != nil {
+			return err
+		}
+		granted, voted = true, term
+		return meta.Put(voteForKey, []byte(candidate))
+	})
+	return granted, voted, err
+}
+
+// VotedTerm returns the newest term the replica voted in, 0 if it never voted.
+func (d *Database) VotedTerm() (term uint64, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		term = votedTerm(tx)
+		return nil
+	})
+	return term, err
+}
+
+func votedTerm(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(metaBucket).Get(voteTermKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
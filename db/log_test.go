@@ -0,0 +1,386 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func nextLogEntry(t *testing.T, d *internalDB.Database, after uint64) *internalDB.LogEntry {
+	t.Helper()
+	entries := logEntries(t, d, after, 1)
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+func logEntries(t *testing.T, d *internalDB.Database, after uint64, limit int) []*internalDB.LogEntry {
+	t.Helper()
+	entries, err := d.LogEntries(after, limit)
+	if err != nil {
+		t.Fatalf("LogEntries(%d, %d) failed: %v", after, limit, err)
+	}
+	return entries
+}
+
+func TestReplicationLogOrder(t *testing.T) {
+	db := createTempDB(t, false)
+	setKey(t, db, "b", "1")
+	setKey(t, db, "a", "2")
+	setKey(t, db, "b", "3")
+	if _, err := db.Delete("a"); err != nil {
+		t.Fatalf(`Delete("a"): got %v, want nil error`, err)
+	}
+
+	want := []*internalDB.LogEntry{
+		{Seq: 1, Op: internalDB.OpSet, Key: "b", Value: []byte("1")},
+		{Seq: 2, Op: internalDB.OpSet, Key: "a", Value: []byte("2")},
+		{Seq: 3, Op: internalDB.OpSet, Key: "b", Value: []byte("3")},
+		{Seq: 4, Op: internalDB.OpDelete, Key: "a"},
+	}
+	// Entries carry the time of the write, it is checked and cleared before comparing.
+	untimed := func(entries []*internalDB.LogEntry) []*internalDB.LogEntry {
+		for _, e := range entries {
+			if e.Time == 0 {
+				t.Errorf("Log entry %d has no time", e.Seq)
+			}
+			e.Time = 0
+		}
+		return entries
+	}
+
+	if got := untimed(logEntries(t, db, 0, 100)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected log entries: got %+v, want %+v", got, want)
+	}
+	if got := untimed(logEntries(t, db, 1, 2)); !reflect.DeepEqual(got, want[1:3]) {
+		t.Errorf("Unexpected log entries batch: got %+v, want %+v", got, want[1:3])
+	}
+}
+
+func ackReplica(t *testing.T, d *internalDB.Database, name string, seq uint64) {
+	t.Helper()
+	if err := d.AckReplica(name, seq); err != nil {
+		t.Fatalf("AckReplica(%q, %d) failed: %v", name, seq, err)
+	}
+}
+
+func TestAckReplica(t *testing.T) {
+	db := createTempDB(t, false)
+	for _, name := range []string{"replica-1", "replica-2"} {
+		if err := db.RegisterReplica(name); err != nil {
+			t.Fatalf("RegisterReplica(%q): got %v, want nil error", name, err)
+		}
+	}
+	setKey(t, db, "hello", "world")
+	setKey(t, db, "merry", "christmas")
+
+	// The log must be kept until every replica acknowledges it.
+	ackReplica(t, db, "replica-1", 2)
+	if e := nextLogEntry(t, db, 0); e == nil || e.Seq != 1 {
+		t.Errorf("NextLogEntry(0) after partial ack: got %+v, want seq 1", e)
+	}
+
+	ackReplica(t, db, "replica-2", 1)
+	if _, err := db.LogEntries(0, 1); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(0, 1) after truncation: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+	if e := nextLogEntry(t, db, 1); e == nil || e.Seq != 2 {
+		t.Errorf("NextLogEntry(1) after truncation: got %+v, want seq 2", e)
+	}
+
+	// Acknowledgements never move backwards.
+	ackReplica(t, db, "replica-1", 1)
+	ackReplica(t, db, "replica-2", 2)
+	if e := nextLogEntry(t, db, 2); e != nil {
+		t.Errorf("NextLogEntry(2) after full truncation: got %+v, want nil", e)
+	}
+
+	// Sequence numbers keep growing after truncation.
+	setKey(t, db, "hello", "again")
+	if e := nextLogEntry(t, db, 2); e == nil || e.Seq != 3 {
+		t.Errorf("NextLogEntry(2) after new write: got %+v, want seq 3", e)
+	}
+}
+
+func TestUnregisterReplica(t *testing.T) {
+	db := createTempDB(t, false)
+	for _, name := range []string{"replica-1", "replica-2"} {
+		if err := db.RegisterReplica(name); err != nil {
+			t.Fatalf("RegisterReplica(%q): got %v, want nil error", name, err)
+		}
+	}
+	setKey(t, db, "hello", "world")
+	setKey(t, db, "merry", "christmas")
+	ackReplica(t, db, "replica-1", 2)
+
+	// The log is truncated to the replicas that are left.
+	if err := db.UnregisterReplica("replica-2"); err != nil {
+		t.Fatalf(`UnregisterReplica("replica-2"): got %v, want nil error`, err)
+	}
+	if names, err := db.Replicas(); err != nil || !reflect.DeepEqual(names, []string{"replica-1"}) {
+		t.Errorf("Replicas(): got %v, %v, want [replica-1]", names, err)
+	}
+	if e := nextLogEntry(t, db, 2); e != nil {
+		t.Errorf("NextLogEntry(2) after unregistering: got %+v, want nil", e)
+	}
+	if _, err := db.LogEntries(0, 1); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(0, 1) after unregistering: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+}
+
+func TestMaxLogEntries(t *testing.T) {
+	db := createTempDB(t, false)
+	if err := db.RegisterReplica("gone"); err != nil {
+		t.Fatalf(`RegisterReplica("gone"): got %v, want nil error`, err)
+	}
+	db.SetMaxLogEntries(2)
+	for _, value := range []string{"1", "2", "3", "4"} {
+		setKey(t, db, "key", value)
+	}
+
+	// A replica that never acknowledges does not keep more than the cap.
+	if _, err := db.LogEntries(0, 1); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(0, 1) over the cap: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+	entries := logEntries(t, db, 2, 100)
+	if len(entries) != 2 || entries[0].Seq != 3 || entries[1].Seq != 4 {
+		t.Errorf("LogEntries(2, 100) over the cap: got %+v, want seqs 3 and 4", entries)
+	}
+}
+
+func TestApplyLogEntries(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "merry", "christmas")
+	if _, err := leader.Delete("hello"); err != nil {
+		t.Fatalf(`Delete("hello"): got %v, want nil error`, err)
+	}
+
+	entries := logEntries(t, leader, 0, 100)
+	if err := replica.ApplyLogEntries(entries[2:]); err == nil {
+		t.Errorf("ApplyLogEntries(%+v) with a gap: got nil error, want non-nil error", entries[2:])
+	}
+
+	if err := replica.ApplyLogEntries(entries[:1]); err != nil {
+		t.Fatalf("ApplyLogEntries(%+v): got %v, want nil error", entries[:1], err)
+	}
+	// Entries that were already applied must be skipped.
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(%+v): got %v, want nil error", entries, err)
+	}
+
+	applied, err := replica.AppliedSeq()
+	if err != nil {
+		t.Fatalf("AppliedSeq(): got %v, want nil error", err)
+	}
+	if applied != 3 {
+		t.Errorf("AppliedSeq(): got %d, want %d", applied, 3)
+	}
+	if value := getKey(t, replica, "hello"); value != "" {
+		t.Errorf(`Unexpected value for key "hello": got %q, want %q`, value, "")
+	}
+	if value := getKey(t, replica, "merry"); value != "christmas" {
+		t.Errorf(`Unexpected value for key "merry": got %q, want %q`, value, "christmas")
+	}
+}
+
+func TestWaitForAcks(t *testing.T) {
+	db := createTempDB(t, false)
+	for _, name := range []string{"replica-1", "replica-2"} {
+		if err := db.RegisterReplica(name); err != nil {
+			t.Fatalf("RegisterReplica(%q): got %v, want nil error", name, err)
+		}
+	}
+	seq, err := db.Set("hello", []byte("world"))
+	if err != nil {
+		t.Fatalf(`Set("hello", "world"): got %v, want nil error`, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := db.WaitForAcks(ctx, seq, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForAcks(%d, 1) without acks: got %v, want deadline exceeded", seq, err)
+	}
+	if err := db.WaitForAcks(context.Background(), seq, 3); err == nil {
+		t.Errorf("WaitForAcks(%d, 3) with 2 replicas: got nil error, want non-nil error", seq)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- db.WaitForAcks(context.Background(), seq, -1) }()
+
+	ackReplica(t, db, "replica-1", seq)
+	if err := db.WaitForAcks(context.Background(), seq, 1); err != nil {
+		t.Errorf("WaitForAcks(%d, 1) after one ack: got %v, want nil error", seq, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForAcks(%d, -1) returned %v before all replicas acknowledged", seq, err)
+	default:
+	}
+
+	ackReplica(t, db, "replica-2", seq)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitForAcks(%d, -1) after all acks: got %v, want nil error", seq, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("WaitForAcks(%d, -1) did not return after all acks", seq)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "merry", "christmas")
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 100)); err != nil {
+		t.Fatalf("ApplyLogEntries: got %v, want nil error", err)
+	}
+
+	if err := replica.Promote(0); err == nil {
+		t.Errorf("Promote(0): got nil error, want an error for the term of the old leader")
+	}
+	if err := replica.Promote(1); err != nil {
+		t.Fatalf("Promote(1): got %v, want nil error", err)
+	}
+	if replica.ReadOnly() {
+		t.Errorf("ReadOnly() after Promote(): got true, want false")
+	}
+
+	// The promoted replica continues the log of the old leader in its own term.
+	seq, err := replica.Set("new", []byte("leader"))
+	if err != nil {
+		t.Fatalf(`Set("new", "leader") after Promote(): got %v, want nil error`, err)
+	}
+	if internalDB.Term(seq) != 1 {
+		t.Errorf(`Set("new", "leader") after Promote(): got seq %d of term %d, want term 1`, seq, internalDB.Term(seq))
+	}
+	if _, err := replica.LogEntries(1, 10); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(1, 10) on promoted replica: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+	// A replica at 4 applied writes of the old leader the new one never had.
+	if _, err := replica.LogEntries(4, 10); !errors.Is(err, internalDB.ErrLogAhead) {
+		t.Errorf("LogEntries(4, 10) on promoted replica: got %v, want %v", err, internalDB.ErrLogAhead)
+	}
+
+	// Replicas at the position of the promotion skip the gap.
+	follower := createTempDB(t, true)
+	if err := follower.ApplyLogEntries(logEntries(t, leader, 0, 100)); err != nil {
+		t.Fatalf("ApplyLogEntries from the old leader: got %v, want nil error", err)
+	}
+	if err := follower.ApplyLogEntries(logEntries(t, replica, 2, 100)); err != nil {
+		t.Fatalf("ApplyLogEntries from the new leader: got %v, want nil error", err)
+	}
+	if value := getKey(t, follower, "new"); value != "leader" {
+		t.Errorf(`Value of "new" on the follower: got %q, want %q`, value, "leader")
+	}
+}
+
+func vote(t *testing.T, d *internalDB.Database, term uint64, candidate string, seq uint64) bool {
+	t.Helper()
+	granted, _, err := d.Vote(term, candidate, seq)
+	if err != nil {
+		t.Fatalf("Vote(%d, %q, %d) failed: %v", term, candidate, seq, err)
+	}
+	return granted
+}
+
+func TestVote(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "merry", "christmas")
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 100)); err != nil {
+		t.Fatalf("ApplyLogEntries: got %v, want nil error", err)
+	}
+
+	if vote(t, leader, 1, "a", 2) {
+		t.Errorf("Vote on a leader: got granted, want refused")
+	}
+	if vote(t, replica, 1, "a", 1) {
+		t.Errorf("Vote for a candidate behind the replica: got granted, want refused")
+	}
+	if vote(t, replica, 0, "a", 2) {
+		t.Errorf("Vote in the term of the applied log: got granted, want refused")
+	}
+
+	// A replica votes for one candidate per term, and again for the same one.
+	if !vote(t, replica, 1, "a", 2) || !vote(t, replica, 1, "a", 2) {
+		t.Errorf("Vote(1, a): got refused, want granted")
+	}
+	if vote(t, replica, 1, "b", 3) {
+		t.Errorf("Vote(1, b) after voting for a: got granted, want refused")
+	}
+	if !vote(t, replica, 2, "b", 2) {
+		t.Errorf("Vote(2, b): got refused, want granted")
+	}
+	if granted, voted, err := replica.Vote(1, "a", 2); err != nil || granted || voted != 2 {
+		t.Errorf("Vote(1, a) after term 2: got %v, %d, %v, want refused in term 2", granted, voted, err)
+	}
+	if term, err := replica.VotedTerm(); err != nil || term != 2 {
+		t.Errorf("VotedTerm(): got %d, %v, want 2", term, err)
+	}
+}
+
+func TestDemote(t *testing.T) {
+	db := createTempDB(t, false)
+	if err := db.RegisterReplica("replica"); err != nil {
+		t.Fatalf(`RegisterReplica("replica"): got %v, want nil error`, err)
+	}
+	setKey(t, db, "hello", "world")
+
+	if err := db.Demote(); err != nil {
+		t.Fatalf("Demote(): got %v, want nil error", err)
+	}
+	if !db.ReadOnly() {
+		t.Errorf("ReadOnly() after Demote(): got false, want true")
+	}
+	if _, err := db.Set("hello", []byte("again")); err == nil {
+		t.Errorf("Set after Demote(): got nil error, want non-nil error")
+	}
+
+	// The log of the old term is dropped, the replica starts over from a snapshot.
+	if seq, err := db.AppliedSeq(); err != nil || seq != 0 {
+		t.Errorf("AppliedSeq() after Demote(): got %d, %v, want 0", seq, err)
+	}
+	if acks, queued, err := db.ReplicaAcks(); err != nil || len(acks) != 0 || queued != 0 {
+		t.Errorf("ReplicaAcks() after Demote(): got %v, %d, %v, want none", acks, queued, err)
+	}
+	if !vote(t, db, 1, "new-leader", 0) {
+		t.Errorf("Vote after Demote(): got refused, want granted")
+	}
+}
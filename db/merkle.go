@@ -0,0 +1,249 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/fnv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MerkleLeaves is the number of leaves of MerkleTree, keys are spread
+// between the leaves by their hash. It must be a power of two.
+const MerkleLeaves = 256
+
+// ErrPositionChanged is returned when the replica moved past the position a repair is based on.
+var ErrPositionChanged = errors.New("log position changed")
+
+// MerkleTree is a hash summary of all keys and values. Each leaf hashes the keys
+// and values that fall into it in key order, inner nodes hash their two children.
+type MerkleTree struct {
+	// Seq is the log position the tree reflects.
+	Seq uint64
+	// Levels[0] holds the root, each next level doubles,
+	// the last level holds MerkleLeaves leaves.
+	Levels [][][]byte
+}
+
+// KeyValue is a single key and its value.
+type KeyValue struct {
+	Key   string
+	Value []byte
+	// ExpiresAt is the expiry time of the key in unix nanoseconds, 0 if it does not expire.
+	ExpiresAt int64 `json:",omitempty"`
+	// Version is the sequence number of the last write of the key, see Condition.
+	Version uint64 `json:",omitempty"`
+	// Modified is the time of the last write of the key in unix nanoseconds, 0 if it is unknown.
+	Modified int64 `json:",omitempty"`
+}
+
+// MerkleLeaf returns the leaf of MerkleTree the key belongs to.
+func MerkleLeaf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % MerkleLeaves)
+}
+
+func hashKeyValue(h hash.Hash, key, value []byte) {
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	h.Write(key)
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(value)))])
+	h.Write(value)
+}
+
+// position returns the log position of the data within tx,
+// the last written sequence number on a leader and the last applied one on a replica.
+// readOnly must be read before tx is opened: Promote holds d.mu while it waits for
+// the write lock of the database.
+func position(tx *bolt.Tx, readOnly bool) uint64 {
+	if readOnly {
+		return appliedSeq(tx)
+	}
+	return tx.Bucket(logBucket).Sequence()
+}
+
+// MerkleTree computes the hash summary of all keys and values.
+func (d *Database) MerkleTree() (tree *MerkleTree, err error) {
+	hashes := make([]hash.Hash, MerkleLeaves)
+	for i := range hashes {
+		hashes[i] = sha256.New()
+	}
+
+	tree = &MerkleTree{}
+	readOnly := d.ReadOnly()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		tree.Seq = position(tx, readOnly)
+		return tx.Bucket(defaultBucket).ForEach(func(k, v []byte) error {
+			hashKeyValue(hashes[MerkleLeaf(string(k))], k, v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	level := make([][]byte, MerkleLeaves)
+	for i, h := range hashes {
+		level[i] = h.Sum(nil)
+	}
+	tree.Levels = [][][]byte{level}
+	for len(level) > 1 {
+		parents := make([][]byte, len(level)/2)
+		for i := range parents {
+			h := sha256.New()
+			h.Write(level[2*i])
+			h.Write(level[2*i+1])
+			parents[i] = h.Sum(nil)
+		}
+		tree.Levels = append([][][]byte{parents}, tree.Levels...)
+		level = parents
+	}
+	return tree, nil
+}
+
+// Diff returns the leaves that differ between the trees, descending only
+// into subtrees with different hashes.
+func (t *MerkleTree) Diff(other *MerkleTree) []int {
+	if len(t.Levels) != len(other.Levels) {
+		res := make([]int, MerkleLeaves)
+		for i := range res {
+			res[i] = i
+		}
+		return res
+	}
+
+	var res []int
+	var walk func(level, i int)
+	walk = func(level, i int) {
+		if i >= len(t.Levels[level]) || i >= len(other.Levels[level]) {
+			return
+		}
+		if bytes.Equal(t.Levels[level][i], other.Levels[level][i]) {
+			return
+		}
+		if level == len(t.Levels)-1 {
+			res = append(res, i)
+			return
+		}
+		walk(level+1, 2*i)
+		walk(level+1, 2*i+1)
+	}
+	walk(0, 0)
+	return res
+}
+
+// MerkleLeafEntries returns all keys and values of the leaves in key order together
+// with the log position they reflect. The keys are scanned once for all leaves.
+func (d *Database) MerkleLeafEntries(leaves ...int) (seq uint64, entries []KeyValue, err error) {
+	in := leafSet(leaves)
+	readOnly := d.ReadOnly()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		seq = position(tx, readOnly)
+		return tx.Bucket(defaultBucket).ForEach(func(k, v []byte) error {
+			if in[MerkleLeaf(string(k))] {
+				entries = append(entries, KeyValue{Key: string(k), Value: copyByteSlice(v), ExpiresAt: expiryOf(tx, k), Version: versionOf(tx, k), Modified: modifiedOf(tx, k)})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return seq, entries, nil
+}
+
+// leafSet returns which of the leaves of MerkleTree are listed.
+func leafSet(leaves []int) (in [MerkleLeaves]bool) {
+	for _, leaf := range leaves {
+		if leaf >= 0 && leaf < MerkleLeaves {
+			in[leaf] = true
+		}
+	}
+	return in
+}
+
+// RepairMerkleLeaves this function is intended to be used only on replicas.
+// It replaces the keys of the leaves with entries taken from the leader at log position seq,
+// which may be ahead of the replica. The repair is pinned to the position of the replica:
+// keys the leader wrote after it are left to the replication stream, which would overwrite
+// a repair of them anyway. Local keys the leader no longer has are deleted, the stream
+// deletes them as well if the leader deleted them after the position of the replica.
+// If the replica is past seq, ErrPositionChanged is returned and nothing is changed.
+func (d *Database) RepairMerkleLeaves(seq uint64, leaves []int, entries []KeyValue) (repaired int, err error) {
+	in := leafSet(leaves)
+	readOnly := d.ReadOnly()
+	err = d.update(func(tx *bolt.Tx) error {
+		pos := position(tx, readOnly)
+		if pos > seq {
+			return ErrPositionChanged
+		}
+
+		want := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			want[e.Key] = true
+		}
+
+		b := tx.Bucket(defaultBucket)
+		var extra [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if in[MerkleLeaf(string(k))] && !want[string(k)] {
+				extra = append(extra, copyByteSlice(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range extra {
+			if err := deleteValue(tx, string(k)); err != nil {
+				return err
+			}
+			repaired++
+		}
+
+		for _, e := range entries {
+			k := []byte(e.Key)
+			if !in[MerkleLeaf(e.Key)] || e.Version > pos {
+				continue
+			}
+			if v := b.Get(k); v != nil && bytes.Equal(v, e.Value) && expiryOf(tx, k) == e.ExpiresAt && versionOf(tx, k) == e.Version && modifiedOf(tx, k) == e.Modified {
+				continue
+			}
+			if err := putValue(tx, e); err != nil {
+				return err
+			}
+			repaired++
+		}
+		return nil
+	})
+	return repaired, err
+}
@@ -0,0 +1,197 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func merkleTree(t *testing.T, d *internalDB.Database) *internalDB.MerkleTree {
+	t.Helper()
+
+	tree, err := d.MerkleTree()
+	if err != nil {
+		t.Fatalf("MerkleTree(): got %v, want nil error", err)
+	}
+	return tree
+}
+
+func TestMerkleRepair(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "merry", "christmas")
+	setKey(t, leader, "foo", "bar")
+
+	// The replica is at the same position but has diverged.
+	err := replica.RestoreSnapshot(3, func(put func(e internalDB.KeyValue) error) error {
+		if err := put(internalDB.KeyValue{Key: "hello", Value: []byte("world"), Version: 1}); err != nil {
+			return err
+		}
+		if err := put(internalDB.KeyValue{Key: "merry", Value: []byte("new year"), Version: 2}); err != nil {
+			return err
+		}
+		return put(internalDB.KeyValue{Key: "stale", Value: []byte("key")})
+	})
+	if err != nil {
+		t.Fatalf("RestoreSnapshot(): got %v, want nil error", err)
+	}
+
+	want := map[int]bool{
+		internalDB.MerkleLeaf("merry"): true,
+		internalDB.MerkleLeaf("foo"):   true,
+		internalDB.MerkleLeaf("stale"): true,
+	}
+	diff := merkleTree(t, replica).Diff(merkleTree(t, leader))
+	if len(diff) != len(want) {
+		t.Fatalf("Diff(): got leaves %v, want %v", diff, want)
+	}
+
+	for _, leaf := range diff {
+		if !want[leaf] {
+			t.Errorf("Diff(): unexpected leaf %d", leaf)
+		}
+	}
+	seq, entries, err := leader.MerkleLeafEntries(diff...)
+	if err != nil {
+		t.Fatalf("MerkleLeafEntries(%v): got %v, want nil error", diff, err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("MerkleLeafEntries(%v): got %d entries, want 2", diff, len(entries))
+	}
+	if _, err := replica.RepairMerkleLeaves(seq, diff, entries); err != nil {
+		t.Fatalf("RepairMerkleLeaves(%v): got %v, want nil error", diff, err)
+	}
+
+	if diff := merkleTree(t, replica).Diff(merkleTree(t, leader)); len(diff) != 0 {
+		t.Errorf("Diff() after repair: got leaves %v, want none", diff)
+	}
+	if value := getKey(t, replica, "merry"); value != "christmas" {
+		t.Errorf(`Unexpected value for key "merry": got %q, want %q`, value, "christmas")
+	}
+	if value := getKey(t, replica, "stale"); value != "" {
+		t.Errorf(`Unexpected value for key "stale": got %q, want %q`, value, "")
+	}
+}
+
+func TestMerkleRepairBehindLeader(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "a", "1")
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "foo", "bar")
+	setKey(t, leader, "hello", "again")
+
+	// The replica has diverged at position 2, the leader is at position 4.
+	err := replica.RestoreSnapshot(2, func(put func(e internalDB.KeyValue) error) error {
+		if err := put(internalDB.KeyValue{Key: "a", Value: []byte("wrong"), Version: 1}); err != nil {
+			return err
+		}
+		if err := put(internalDB.KeyValue{Key: "hello", Value: []byte("world"), Version: 2}); err != nil {
+			return err
+		}
+		return put(internalDB.KeyValue{Key: "stale", Value: []byte("key")})
+	})
+	if err != nil {
+		t.Fatalf("RestoreSnapshot(): got %v, want nil error", err)
+	}
+
+	diff := merkleTree(t, replica).Diff(merkleTree(t, leader))
+	seq, entries, err := leader.MerkleLeafEntries(diff...)
+	if err != nil {
+		t.Fatalf("MerkleLeafEntries(%v): got %v, want nil error", diff, err)
+	}
+	if _, err := replica.RepairMerkleLeaves(seq, diff, entries); err != nil {
+		t.Fatalf("RepairMerkleLeaves(%v): got %v, want nil error", diff, err)
+	}
+
+	// Keys the leader wrote after position 2 are left to the replication log.
+	for key, want := range map[string]string{"a": "1", "hello": "world", "foo": "", "stale": ""} {
+		if value := getKey(t, replica, key); value != want {
+			t.Errorf("Unexpected value for key %q after repair: got %q, want %q", key, value, want)
+		}
+	}
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 2, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if diff := merkleTree(t, replica).Diff(merkleTree(t, leader)); len(diff) != 0 {
+		t.Errorf("Diff() after repair and replication: got leaves %v, want none", diff)
+	}
+
+	// A replica past the position of the leader entries is not changed.
+	setKey(t, leader, "a", "2")
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 4, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	leaf := internalDB.MerkleLeaf("a")
+	_, err = replica.RepairMerkleLeaves(seq, []int{leaf}, []internalDB.KeyValue{{Key: "a", Value: []byte("1"), Version: 1}})
+	if !errors.Is(err, internalDB.ErrPositionChanged) {
+		t.Errorf("RepairMerkleLeaves(): got %v, want %v", err, internalDB.ErrPositionChanged)
+	}
+	if value := getKey(t, replica, "a"); value != "2" {
+		t.Errorf(`Unexpected value for key "a": got %q, want %q`, value, "2")
+	}
+}
+
+func TestMerkleRepairDuringPromote(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		replica := createTempDB(t, true)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := replica.Promote(1); err != nil {
+				t.Errorf("Promote(1): got %v, want nil error", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				replica.RepairMerkleLeaves(0, []int{0}, nil)
+				replica.MerkleTree()
+			}
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Promote() and RepairMerkleLeaves() deadlocked")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// migrationKey holds the state of a reshard in progress in the meta bucket.
+	migrationKey = []byte("migration")
+	// migrationDeletedBucket holds the keys deleted during a reshard in progress.
+	migrationDeletedBucket = []byte("migration-deleted")
+)
+
+// SaveMigration stores the encoded state of a reshard in progress, so that
+// a restarted node resumes it. Like SaveConfig it is local to the node.
+func (d *Database) SaveMigration(data []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(migrationKey, data)
+	})
+}
+
+// MigrationDeleted records that the key was deleted during the reshard in progress.
+func (d *Database) MigrationDeleted(key string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(migrationDeletedBucket).Put([]byte(key), nil)
+	})
+}
+
+// SavedMigration returns the state stored by SaveMigration and the keys recorded
+// by MigrationDeleted, data is nil if no reshard is in progress.
+func (d *Database) SavedMigration() (data []byte, deleted []string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		data = copyByteSlice(tx.Bucket(metaBucket).Get(migrationKey))
+		return tx.Bucket(migrationDeletedBucket).ForEach(func(k, v []byte) error {
+			deleted = append(deleted, string(k))
+			return nil
+		})
+	})
+	return data, deleted, err
+}
+
+// EndMigration removes the state of the finished reshard.
+func (d *Database) EndMigration() error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Delete(migrationKey); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(migrationDeletedBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(migrationDeletedBucket)
+		return err
+	})
+}
@@ -0,0 +1,139 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExtraKeys returns up to limit keys after the given key, in key order,
+// that do not belong to this shard together with their values.
+// Expired keys are skipped.
+func (d *Database) ExtraKeys(after string, limit int, isExtra func(string) bool) (entries []KeyValue, err error) {
+	now := time.Now().UnixNano()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(entries) < limit; k, v = c.Next() {
+			if isExtra(string(k)) && !expired(tx, k, now) {
+				entries = append(entries, KeyValue{Key: string(k), Value: copyByteSlice(v), ExpiresAt: expiryOf(tx, k), Version: versionOf(tx, k), Modified: modifiedOf(tx, k)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ImportKeys writes keys migrated from another shard. Keys that already exist
+// hold a newer value and are left alone, as are the keys skip returns true for.
+// Keys keep their expiry time. Returns the number of written keys.
+func (d *Database) ImportKeys(entries []KeyValue, skip func(string) bool) (imported int, err error) {
+	if d.ReadOnly() {
+		return 0, errors.New("read-only mode")
+	}
+	now := time.Now().UnixNano()
+	err = d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(defaultBucket)
+		for _, e := range entries {
+			exists := b.Get([]byte(e.Key)) != nil && !expired(tx, []byte(e.Key), now)
+			if exists || skip(e.Key) {
+				continue
+			}
+			op, value := OpSet, e.Value
+			if e.ExpiresAt != 0 {
+				op, value = OpSetExpiring, ExpiringValue(e.Value, time.Unix(0, e.ExpiresAt))
+			}
+			// The key keeps its modification time and gets a newer version of this shard:
+			// the log moves past its version on the previous owner first.
+			if e.Modified == 0 {
+				e.Modified = now
+			}
+			if err := advanceLog(tx, e.Version, now); err != nil {
+				return err
+			}
+			seq, err := appendLog(tx, op, e.Key, value, e.Modified)
+			if err != nil {
+				return err
+			}
+			e.Version = seq
+			if err := putValue(tx, e); err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+// SplitKey returns the middle key of the keys in [start, end) owned returns true for,
+// an empty end being the end of the keyspace. Splitting the range at the key
+// leaves half of the keys on each side.
+func (d *Database) SplitKey(start, end string, owned func(string) bool) (key string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		inRange := func(k []byte) bool {
+			return k != nil && (end == "" || string(k) < end)
+		}
+
+		var count int
+		for k, _ := c.Seek([]byte(start)); inRange(k); k, _ = c.Next() {
+			if owned(string(k)) {
+				count++
+			}
+		}
+		if count < 2 {
+			return fmt.Errorf("%d keys in [%q, %q) cannot be split", count, start, end)
+		}
+
+		var seen int
+		for k, _ := c.Seek([]byte(start)); inRange(k); k, _ = c.Next() {
+			if !owned(string(k)) {
+				continue
+			}
+			if seen == count/2 {
+				key = string(k)
+				return nil
+			}
+			seen++
+		}
+		return fmt.Errorf("keys in [%q, %q) changed while splitting", start, end)
+	})
+	return key, err
+}
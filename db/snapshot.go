@@ -0,0 +1,88 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// Snapshot is a consistent point-in-time view of the data
+// together with the log position it reflects.
+// The snapshot holds a read transaction open until it is closed,
+// writes that need to grow the database file block until then.
+type Snapshot struct {
+	tx  *bolt.Tx
+	Seq uint64
+}
+
+// Snapshot starts a snapshot of the data, the caller must close it.
+// Its position is the last applied sequence number on a read-only database.
+func (d *Database) Snapshot() (*Snapshot, error) {
+	readOnly := d.ReadOnly()
+	tx, err := d.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{tx: tx, Seq: position(tx, readOnly)}, nil
+}
+
+// ForEach calls fn for every key in the snapshot in key order
+// with its value and metadata.
+// The value is only valid for the duration of the call.
+func (s *Snapshot) ForEach(fn func(e KeyValue) error) error {
+	return s.tx.Bucket(defaultBucket).ForEach(func(k, v []byte) error {
+		return fn(KeyValue{Key: string(k), Value: v, ExpiresAt: expiryOf(s.tx, k), Version: versionOf(s.tx, k), Modified: modifiedOf(s.tx, k)})
+	})
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() error {
+	return s.tx.Rollback()
+}
+
+// RestoreSnapshot this function is intended to be used only on replicas.
+// It replaces all data with the entries passed to put by load
+// and records seq as the last applied log position, all in a single transaction.
+// Values passed to put must not be modified afterwards.
+func (d *Database) RestoreSnapshot(seq uint64, load func(put func(e KeyValue) error) error) error {
+	return d.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{defaultBucket, expiryBucket, expiryIndexBucket, versionBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		err := load(func(e KeyValue) error {
+			return putValue(tx, e)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(appliedSeqKey, seqKey(seq))
+	})
+}
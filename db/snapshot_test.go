@@ -0,0 +1,100 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db_test
+
+import (
+	"errors"
+	"testing"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func TestSnapshot(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	setKey(t, leader, "hello", "world")
+	setKey(t, leader, "merry", "christmas")
+
+	snap, err := leader.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot(): got %v, want nil error", err)
+	}
+	err = replica.RestoreSnapshot(snap.Seq, func(put func(e internalDB.KeyValue) error) error {
+		return snap.ForEach(func(e internalDB.KeyValue) error {
+			e.Value = append([]byte(nil), e.Value...)
+			return put(e)
+		})
+	})
+	if err != nil {
+		t.Fatalf("RestoreSnapshot(%d): got %v, want nil error", snap.Seq, err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatalf("Snapshot.Close(): got %v, want nil error", err)
+	}
+	setKey(t, leader, "late", "write")
+
+	if value := getKey(t, replica, "merry"); value != "christmas" {
+		t.Errorf(`Unexpected value for key "merry": got %q, want %q`, value, "christmas")
+	}
+	if value := getKey(t, replica, "late"); value != "" {
+		t.Errorf(`Unexpected value for key "late": got %q, want %q`, value, "")
+	}
+	applied, err := replica.AppliedSeq()
+	if err != nil || applied != 2 {
+		t.Errorf("AppliedSeq(): got %d, %v; want 2, nil", applied, err)
+	}
+
+	// The replica resumes from the snapshot position.
+	if err := replica.ApplyLogEntries(logEntries(t, leader, applied, 100)); err != nil {
+		t.Fatalf("ApplyLogEntries after snapshot: got %v, want nil error", err)
+	}
+	if value := getKey(t, replica, "late"); value != "write" {
+		t.Errorf(`Unexpected value for key "late": got %q, want %q`, value, "write")
+	}
+}
+
+func TestLogEntriesTruncated(t *testing.T) {
+	db := createTempDB(t, false)
+	setKey(t, db, "hello", "world")
+	setKey(t, db, "merry", "christmas")
+	ackReplica(t, db, "replica", 1)
+
+	if _, err := db.LogEntries(0, 10); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(0, 10) after truncation: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+	if entries := logEntries(t, db, 1, 10); len(entries) != 1 {
+		t.Errorf("LogEntries(1, 10): got %+v, want one entry", entries)
+	}
+
+	ackReplica(t, db, "replica", 2)
+	if _, err := db.LogEntries(1, 10); !errors.Is(err, internalDB.ErrLogTruncated) {
+		t.Errorf("LogEntries(1, 10) after full truncation: got %v, want %v", err, internalDB.ErrLogTruncated)
+	}
+	if entries := logEntries(t, db, 2, 10); len(entries) != 0 {
+		t.Errorf("LogEntries(2, 10): got %+v, want no entries", entries)
+	}
+}
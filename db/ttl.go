@@ -0,0 +1,146 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// expiryBucket maps keys that expire to their expiry time.
+	expiryBucket = []byte("expiry")
+	// expiryIndexBucket holds the expiry time followed by the key for every
+	// key that expires, so that expired keys are found in expiry order.
+	expiryIndexBucket = []byte("expiry-index")
+)
+
+// ExpiringValue returns the value of an OpSetExpiring log entry: the expiry time
+// in unix nanoseconds as 8 big-endian bytes followed by the value.
+func ExpiringValue(value []byte, expiresAt time.Time) []byte {
+	return append(seqKey(uint64(expiresAt.UnixNano())), value...)
+}
+
+// splitExpiringValue returns the value and the expiry time of an OpSetExpiring log entry.
+func splitExpiringValue(v []byte) (value []byte, expiresAt int64, err error) {
+	if len(v) < 8 {
+		return nil, 0, errors.New("malformed expiring value")
+	}
+	return v[8:], int64(binary.BigEndian.Uint64(v)), nil
+}
+
+// SetWithExpiry sets the key until expiresAt, afterwards it is treated as absent
+// and eventually deleted by ReapExpired.
+// Returns the sequence number of the write in the replication log.
+func (d *Database) SetWithExpiry(key string, value []byte, expiresAt time.Time) (seq uint64, err error) {
+	return d.SetIf(key, value, expiresAt, Condition{})
+}
+
+// ReapExpired deletes up to limit keys that have expired, in expiry order.
+// The deletions are appended to the replication log so that replicas delete
+// the keys as well. Returns the number of deleted keys.
+func (d *Database) ReapExpired(limit int) (deleted int, err error) {
+	if d.ReadOnly() {
+		return 0, errors.New("read-only mode")
+	}
+	now := time.Now().UnixNano()
+	err = d.update(func(tx *bolt.Tx) error {
+		keys := expiredKeys(tx, now, limit)
+		for _, key := range keys {
+			if err := deleteValue(tx, key); err != nil {
+				return err
+			}
+			if _, err := appendLog(tx, OpDelete, key, nil, now); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return deleted, err
+}
+
+// ExpiredKeys returns up to limit keys that have expired, in expiry order.
+// In Raft mode the leader deletes them by committing OpExpire entries.
+func (d *Database) ExpiredKeys(limit int) (keys []string, err error) {
+	now := time.Now().UnixNano()
+	err = d.db.View(func(tx *bolt.Tx) error {
+		keys = expiredKeys(tx, now, limit)
+		return nil
+	})
+	return keys, err
+}
+
+// expiredKeys returns up to limit keys that have expired at now, in expiry order.
+func expiredKeys(tx *bolt.Tx, now int64, limit int) (keys []string) {
+	c := tx.Bucket(expiryIndexBucket).Cursor()
+	for k, _ := c.First(); k != nil && len(keys) < limit; k, _ = c.Next() {
+		if len(k) < 8 || int64(binary.BigEndian.Uint64(k)) > now {
+			break
+		}
+		keys = append(keys, string(k[8:]))
+	}
+	return keys
+}
+
+// setExpiry replaces the expiry time of the key, 0 removes it.
+func setExpiry(tx *bolt.Tx, key string, expiresAt int64) error {
+	b, index := tx.Bucket(expiryBucket), tx.Bucket(expiryIndexBucket)
+	if old := expiryOf(tx, []byte(key)); old != 0 {
+		if err := index.Delete(expiryIndexKey(old, key)); err != nil {
+			return err
+		}
+	}
+	if expiresAt == 0 {
+		return b.Delete([]byte(key))
+	}
+	if err := b.Put([]byte(key), seqKey(uint64(expiresAt))); err != nil {
+		return err
+	}
+	return index.Put(expiryIndexKey(expiresAt, key), []byte{})
+}
+
+func expiryIndexKey(expiresAt int64, key string) []byte {
+	return append(seqKey(uint64(expiresAt)), key...)
+}
+
+// expiryOf returns the expiry time of the key in unix nanoseconds, 0 if it does not expire.
+func expiryOf(tx *bolt.Tx, key []byte) int64 {
+	v := tx.Bucket(expiryBucket).Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// expired reports whether the key has expired at now, given in unix nanoseconds.
+func expired(tx *bolt.Tx, key []byte, now int64) bool {
+	at := expiryOf(tx, key)
+	return at != 0 && at <= now
+}
@@ -0,0 +1,162 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+func TestSetWithExpiry(t *testing.T) {
+	db := createTempDB(t, false)
+	if _, err := db.SetWithExpiry("session", []byte("token"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SetWithExpiry(session): %v", err)
+	}
+	if _, err := db.SetWithExpiry("cache", []byte("page"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetWithExpiry(cache): %v", err)
+	}
+	setKey(t, db, "plain", "value")
+
+	if value := getKey(t, db, "session"); value != "token" {
+		t.Errorf(`Unexpected value for key "session": got %q, want %q`, value, "token")
+	}
+	if value := getKey(t, db, "cache"); value != "" {
+		t.Errorf(`Unexpected value for expired key "cache": got %q, want ""`, value)
+	}
+	entries, err := db.Scan("", "", 10)
+	if err != nil || len(entries) != 2 || entries[0].Key != "plain" || entries[1].Key != "session" || entries[1].ExpiresAt == 0 {
+		t.Errorf("Scan(): got %+v, %v; want plain and session with its expiry", entries, err)
+	}
+
+	// Setting the key again without a ttl makes it permanent.
+	if _, err := db.SetWithExpiry("plain", []byte("value"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetWithExpiry(plain): %v", err)
+	}
+	setKey(t, db, "plain", "forever")
+	if value := getKey(t, db, "plain"); value != "forever" {
+		t.Errorf(`Unexpected value for key "plain": got %q, want %q`, value, "forever")
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := leader.SetWithExpiry(key, []byte("value-"+key), time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("SetWithExpiry(%q): %v", key, err)
+		}
+	}
+	if _, err := leader.SetWithExpiry("d", []byte("value-d"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SetWithExpiry(d): %v", err)
+	}
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if value := getKey(t, replica, "a"); value != "" {
+		t.Errorf(`Unexpected value for expired key "a" on the replica: got %q, want ""`, value)
+	}
+	if value := getKey(t, replica, "d"); value != "value-d" {
+		t.Errorf(`Unexpected value for key "d" on the replica: got %q, want %q`, value, "value-d")
+	}
+
+	if _, err := replica.ReapExpired(10); err == nil {
+		t.Errorf("ReapExpired() on a replica: got nil error, want non-nil error")
+	}
+	if n, err := leader.ReapExpired(2); err != nil || n != 2 {
+		t.Errorf("ReapExpired(2): got %d, %v; want 2, nil", n, err)
+	}
+	if n, err := leader.ReapExpired(10); err != nil || n != 1 {
+		t.Errorf("ReapExpired(10): got %d, %v; want 1, nil", n, err)
+	}
+	if n, err := leader.ReapExpired(10); err != nil || n != 0 {
+		t.Errorf("ReapExpired(10) again: got %d, %v; want 0, nil", n, err)
+	}
+
+	entries := logEntries(t, leader, 4, 10)
+	if len(entries) != 3 {
+		t.Fatalf("Log entries after reaping: got %d, want 3", len(entries))
+	}
+	for _, e := range entries {
+		if e.Op != internalDB.OpDelete {
+			t.Errorf("Log entry %+v: got op %d, want OpDelete", e, e.Op)
+		}
+	}
+	if err := replica.ApplyLogEntries(entries); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+
+	// The snapshot includes expired keys that have not been deleted.
+	snap, err := replica.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot(): %v", err)
+	}
+	defer snap.Close()
+	var kept []string
+	err = snap.ForEach(func(e internalDB.KeyValue) error {
+		kept = append(kept, e.Key)
+		return nil
+	})
+	if err != nil || len(kept) != 1 || kept[0] != "d" {
+		t.Errorf("Keys of the replica: got %q, %v; want only d", kept, err)
+	}
+}
+
+func TestExpireEntry(t *testing.T) {
+	leader := createTempDB(t, false)
+	replica := createTempDB(t, true)
+
+	if _, err := leader.SetWithExpiry("a", []byte("value-a"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetWithExpiry(a): %v", err)
+	}
+	if _, err := leader.SetWithExpiry("b", []byte("value-b"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SetWithExpiry(b): %v", err)
+	}
+	if err := replica.ApplyLogEntries(logEntries(t, leader, 0, 10)); err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if keys, err := replica.ExpiredKeys(10); err != nil || len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("ExpiredKeys(10): got %q, %v; want [\"a\"], nil", keys, err)
+	}
+
+	// Only the key that has expired at the time of its entry is deleted.
+	now := time.Now().UnixNano()
+	err := replica.ApplyLogEntries([]*internalDB.LogEntry{
+		{Seq: 3, Op: internalDB.OpExpire, Key: "a", Time: now},
+		{Seq: 4, Op: internalDB.OpExpire, Key: "b", Time: now},
+	})
+	if err != nil {
+		t.Fatalf("ApplyLogEntries(): %v", err)
+	}
+	if keys, err := replica.ExpiredKeys(10); err != nil || len(keys) != 0 {
+		t.Errorf("ExpiredKeys(10) after OpExpire: got %q, %v; want none", keys, err)
+	}
+	if value := getKey(t, replica, "b"); value != "value-b" {
+		t.Errorf(`Unexpected value for key "b" after OpExpire: got %q, want %q`, value, "value-b")
+	}
+}
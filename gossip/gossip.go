@@ -0,0 +1,471 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package gossip keeps track of the members of the cluster with a SWIM-style
+// failure detector. Every interval a node pings a random member, asking other
+// members to ping it on its behalf if it does not answer, and suspects it if
+// nobody can reach it. Suspected members that do not refute the suspicion in
+// time are declared dead and forgotten a while later. Each exchange carries
+// the full member list and the config of the sender, which spreads new members,
+// failures, shard leadership and newer config epochs through the cluster.
+// The static config only seeds the member list.
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+)
+
+const (
+	pingTimeout = 500 * time.Millisecond
+	// indirectProbes is the number of members asked to ping an unresponsive member.
+	indirectProbes = 3
+	// suspectIntervals is the number of probe intervals a member has
+	// to refute a suspicion before it is declared dead.
+	suspectIntervals = 5
+	// pruneIntervals is the number of probe intervals a dead member
+	// stays in the member list, so that its death spreads before it is forgotten.
+	pruneIntervals = 60
+)
+
+// State of a member as seen by the cluster.
+type State string
+
+const (
+	Alive   State = "alive"
+	Suspect State = "suspect"
+	Dead    State = "dead"
+)
+
+// rank orders states of the same incarnation, the worse state wins.
+func (s State) rank() int {
+	switch s {
+	case Suspect:
+		return 1
+	case Dead:
+		return 2
+	}
+	return 0
+}
+
+// Member is a node of the cluster. Only the member itself changes its
+// Shard, Leader and Epoch, increasing its Incarnation every time,
+// which also refutes suspicions about it.
+type Member struct {
+	Addr string
+	// Shard is the name of the shard the member serves.
+	Shard string
+	// Leader is true if the member accepts writes for its shard.
+	Leader bool
+	// Epoch is the config epoch of the member.
+	Epoch       uint64
+	Incarnation uint64
+	State       State
+}
+
+// overrides reports whether m is newer information about the member than o.
+func (m Member) overrides(o Member) bool {
+	if m.Incarnation != o.Incarnation {
+		return m.Incarnation > o.Incarnation
+	}
+	return m.State.rank() > o.State.rank()
+}
+
+// Message is exchanged by pings, it carries the member list
+// and the encoded config of the sender.
+type Message struct {
+	From    string
+	Members []Member
+	Config  string `json:",omitempty"`
+}
+
+type member struct {
+	Member
+	changed time.Time // when State last changed
+}
+
+// Gossip is the membership of the cluster as seen by one node.
+type Gossip struct {
+	self     string
+	shards   *config.Shards
+	isLeader func() bool
+	onConfig func(config.Config) error
+	rejected uint64 // epoch of the last config onConfig failed to apply, used by Run only
+	client   *http.Client
+	stop     chan struct{}
+
+	mu          sync.Mutex
+	incarnation uint64
+	leader      bool
+	epoch       uint64
+	members     map[string]*member // all members except self
+	newest      *config.Config     // newest config received, nil if not newer than the own one
+}
+
+// New creates the membership of the node listening on self,
+// seeded with all nodes of the config. isLeader reports whether the node
+// currently accepts writes for its shard.
+func New(self string, shards *config.Shards, isLeader func() bool) *Gossip {
+	g := &Gossip{
+		self:     self,
+		shards:   shards,
+		isLeader: isLeader,
+		client:   &http.Client{Timeout: pingTimeout},
+		stop:     make(chan struct{}),
+		// Seeded members have incarnation 0, so the first
+		// announcement of a member overrides its seed.
+		incarnation: 1,
+		leader:      isLeader(),
+		epoch:       shards.CurrentEpoch(),
+		members:     make(map[string]*member),
+	}
+
+	now := time.Now()
+	for _, s := range shards.Config().Shards {
+		g.members[s.Address] = &member{Member: Member{Addr: s.Address, Shard: s.Name, Leader: true, State: Alive}, changed: now}
+		for _, addr := range s.Replicas {
+			g.members[addr] = &member{Member: Member{Addr: addr, Shard: s.Name, State: Alive}, changed: now}
+		}
+	}
+	delete(g.members, self)
+	return g
+}
+
+// OnConfig makes Run pass configs with a newer epoch than the one of
+// the node to fn, which is expected to switch the routing to them.
+// A config fn fails to apply is passed again after the next interval.
+// It must be called before Run.
+func (g *Gossip) OnConfig(fn func(config.Config) error) {
+	g.onConfig = fn
+}
+
+// Run probes a random member every interval until Stop is called.
+func (g *Gossip) Run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		g.probe()
+		g.expireSuspects(suspectIntervals * interval)
+		g.pruneDead(pruneIntervals * interval)
+		g.applyConfig()
+		g.applyLeaders()
+
+		select {
+		case <-g.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Stop stops Run.
+func (g *Gossip) Stop() {
+	close(g.stop)
+}
+
+// Members returns all members including this node, sorted by address.
+func (g *Gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.memberList()
+}
+
+func (g *Gossip) memberList() []Member {
+	res := []Member{g.selfMember()}
+	for _, m := range g.members {
+		res = append(res, m.Member)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+// selfMember returns the record of this node, a new incarnation is started
+// whenever the shard leadership or the config epoch of the node changes.
+func (g *Gossip) selfMember() Member {
+	leader, epoch := g.isLeader(), g.shards.CurrentEpoch()
+	if leader != g.leader || epoch != g.epoch {
+		g.leader, g.epoch = leader, epoch
+		g.incarnation++
+	}
+	return Member{
+		Addr:        g.self,
+		Shard:       g.shards.CurrentName(),
+		Leader:      g.leader,
+		Epoch:       g.epoch,
+		Incarnation: g.incarnation,
+		State:       Alive,
+	}
+}
+
+func (g *Gossip) message() *Message {
+	data, err := config.Encode(g.shards.Config())
+	if err != nil {
+		log.Printf("Gossip: encoding the config: %v", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return &Message{From: g.self, Members: g.memberList(), Config: string(data)}
+}
+
+// merge applies newer information from the member list and the config of a message.
+func (g *Gossip) merge(msg *Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range msg.Members {
+		if m.Addr == msg.From && msg.Config != "" {
+			g.mergeConfig(m.Epoch, msg.Config)
+		}
+		if m.Addr == g.self {
+			// Refute a suspicion by starting a new incarnation.
+			if m.State != Alive && m.Incarnation >= g.incarnation {
+				g.incarnation = m.Incarnation + 1
+			}
+			continue
+		}
+		cur, ok := g.members[m.Addr]
+		if !ok {
+			if m.State == Dead {
+				// A dead member that has been forgotten stays forgotten.
+				continue
+			}
+			log.Printf("Gossip: new member %q of shard %q", m.Addr, m.Shard)
+			g.members[m.Addr] = &member{Member: m, changed: now}
+			continue
+		}
+		if !m.overrides(cur.Member) {
+			continue
+		}
+		if m.State != cur.State {
+			log.Printf("Gossip: member %q is %s", m.Addr, m.State)
+			cur.changed = now
+		}
+		cur.Member = m
+	}
+}
+
+// mergeConfig keeps the encoded config of the sender if its epoch is newer than
+// the epoch of this node and of any config received before, g.mu must be held.
+func (g *Gossip) mergeConfig(epoch uint64, data string) {
+	if epoch <= g.shards.CurrentEpoch() || g.newest != nil && epoch <= g.newest.Epoch {
+		return
+	}
+	c, err := config.Parse([]byte(data))
+	if err != nil || c.Epoch != epoch {
+		log.Printf("Gossip: ignoring an invalid config with epoch %d: %v", epoch, err)
+		return
+	}
+	g.newest = &c
+}
+
+// applyConfig passes the newest config received to the OnConfig function
+// if it is still newer than the config of the node.
+func (g *Gossip) applyConfig() {
+	g.mu.Lock()
+	c := g.newest
+	g.mu.Unlock()
+	if c == nil || g.onConfig == nil {
+		return
+	}
+	if c.Epoch <= g.shards.CurrentEpoch() {
+		g.mu.Lock()
+		if g.newest == c {
+			g.newest = nil
+		}
+		g.mu.Unlock()
+		return
+	}
+
+	err := g.onConfig(*c)
+	switch {
+	case err == nil:
+		log.Printf("Gossip: switched to config epoch %d", c.Epoch)
+	case g.rejected != c.Epoch:
+		g.rejected = c.Epoch
+		log.Printf("Gossip: applying config epoch %d failed, retrying: %v", c.Epoch, err)
+	}
+}
+
+// Ping handles a ping: it merges the member list of the sender
+// and replies with the member list of this node.
+func (g *Gossip) Ping(msg *Message) *Message {
+	g.merge(msg)
+	return g.message()
+}
+
+// PingReq pings target on behalf of the sender of msg.
+func (g *Gossip) PingReq(target string, msg *Message) (*Message, error) {
+	g.merge(msg)
+	reply, err := g.ping(target)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ping sends the member list to addr and merges its reply.
+func (g *Gossip) ping(addr string) (*Message, error) {
+	var reply Message
+	if err := g.call(addr, "/gossip/ping", g.message(), &reply); err != nil {
+		return nil, err
+	}
+	g.merge(&reply)
+	return &reply, nil
+}
+
+// probe pings a random member that is not dead. If it does not answer,
+// other members are asked to ping it, and if none of them succeeds it is suspected.
+func (g *Gossip) probe() {
+	g.mu.Lock()
+	var live []string
+	for addr, m := range g.members {
+		if m.State != Dead {
+			live = append(live, addr)
+		}
+	}
+	g.mu.Unlock()
+	if len(live) == 0 {
+		return
+	}
+
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	target, helpers := live[0], live[1:]
+	if _, err := g.ping(target); err == nil {
+		return
+	}
+
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	u := url.Values{}
+	u.Set("target", target)
+	for _, addr := range helpers {
+		var reply Message
+		if err := g.call(addr, "/gossip/ping-req?"+u.Encode(), g.message(), &reply); err == nil {
+			g.merge(&reply)
+			return
+		}
+	}
+	g.suspect(target)
+}
+
+// suspect marks an alive member as suspected in its current incarnation.
+func (g *Gossip) suspect(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok := g.members[addr]; ok && m.State == Alive {
+		log.Printf("Gossip: member %q is %s", addr, Suspect)
+		m.State = Suspect
+		m.changed = time.Now()
+	}
+}
+
+// expireSuspects declares members dead that did not refute a suspicion in time.
+func (g *Gossip) expireSuspects(timeout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, m := range g.members {
+		if m.State == Suspect && time.Since(m.changed) > timeout {
+			log.Printf("Gossip: member %q is %s", addr, Dead)
+			m.State = Dead
+			m.changed = time.Now()
+		}
+	}
+}
+
+// pruneDead forgets members that have been dead for longer than timeout,
+// so that nodes removed from the cluster do not stay members forever.
+// A forgotten node that comes back announces itself again.
+func (g *Gossip) pruneDead(timeout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, m := range g.members {
+		if m.State == Dead && time.Since(m.changed) > timeout {
+			log.Printf("Gossip: forgetting dead member %q", addr)
+			delete(g.members, addr)
+		}
+	}
+}
+
+// applyLeaders updates the routing when the configured leader of a shard
+// is no longer an alive leader, but another alive member leads the shard
+// with the same config epoch, e.g. a replica promoted by failover.
+func (g *Gossip) applyLeaders() {
+	members := g.Members()
+	epoch := g.shards.CurrentEpoch()
+
+	for _, s := range g.shards.Config().Shards {
+		cur := g.shards.Leader(s.Idx)
+		var best *Member
+		for i := range members {
+			m := &members[i]
+			if m.Shard != s.Name || !m.Leader || m.State != Alive || m.Epoch != epoch {
+				continue
+			}
+			if m.Addr == cur {
+				best = nil
+				break
+			}
+			if best == nil || m.Incarnation > best.Incarnation {
+				best = m
+			}
+		}
+		if best != nil {
+			log.Printf("Gossip: %q leads shard %d instead of %q", best.Addr, s.Idx, cur)
+			g.shards.SetLeader(s.Idx, best.Addr)
+		}
+	}
+}
+
+func (g *Gossip) call(addr, path string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Post("http://"+addr+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
@@ -0,0 +1,225 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package gossip_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	"github.com/Nicknamezz00/naive-distributed-kv/gossip"
+)
+
+const interval = 20 * time.Millisecond
+
+type node struct {
+	ts     *httptest.Server
+	addr   string
+	g      *gossip.Gossip
+	shards *config.Shards
+	leader int32
+}
+
+func newNode(t *testing.T) *node {
+	t.Helper()
+	n := &node{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gossip/ping", func(w http.ResponseWriter, r *http.Request) {
+		var msg gossip.Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		json.NewEncoder(w).Encode(n.g.Ping(&msg))
+	})
+	mux.HandleFunc("/gossip/ping-req", func(w http.ResponseWriter, r *http.Request) {
+		var msg gossip.Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		reply, err := n.g.PingReq(r.FormValue("target"), &msg)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	})
+	n.ts = httptest.NewServer(mux)
+	n.addr = strings.TrimPrefix(n.ts.URL, "http://")
+	return n
+}
+
+func (n *node) start(t *testing.T, c config.Config, shard string, leader bool) {
+	t.Helper()
+	shards, err := config.ParseConfig(c, shard)
+	if err != nil {
+		t.Fatalf("ParseConfig(%q): %v", shard, err)
+	}
+	n.shards = shards
+	if leader {
+		n.leader = 1
+	}
+	n.g = gossip.New(n.addr, shards, func() bool { return atomic.LoadInt32(&n.leader) == 1 })
+	n.g.OnConfig(func(c config.Config) error {
+		next, err := config.ParseNextConfig(c, shard)
+		if err != nil {
+			return err
+		}
+		shards.Update(next)
+		return nil
+	})
+	go n.g.Run(interval)
+	t.Cleanup(n.stop)
+}
+
+// stop takes the node down.
+func (n *node) stop() {
+	if n.ts != nil {
+		n.ts.Close()
+		n.g.Stop()
+		n.ts = nil
+	}
+}
+
+func member(g *gossip.Gossip, addr string) gossip.Member {
+	for _, m := range g.Members() {
+		if m.Addr == addr {
+			return m
+		}
+	}
+	return gossip.Member{}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	a, replica, b := newNode(t), newNode(t), newNode(t)
+	c, err := config.Parse([]byte(fmt.Sprintf(`
+[[shards]]
+name = "a"
+idx = 0
+address = %q
+replicas = [%q]
+
+[[shards]]
+name = "b"
+idx = 1
+address = %q
+`, a.addr, replica.addr, b.addr)))
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+
+	a.start(t, c, "a", true)
+	replica.start(t, c, "a", false)
+	b.start(t, c, "b", true)
+
+	// The members announce themselves with their first incarnation.
+	for _, n := range []*node{a, replica, b} {
+		for _, m := range []*node{a, replica, b} {
+			waitFor(t, fmt.Sprintf("%s to learn about %s", n.addr, m.addr), func() bool {
+				got := member(n.g, m.addr)
+				return got.State == gossip.Alive && got.Incarnation > 0
+			})
+		}
+	}
+	if got := member(b.g, replica.addr); got.Shard != "a" || got.Leader {
+		t.Errorf("Member %q seen by shard b: got shard %q, leader %v; want shard \"a\", leader false", replica.addr, got.Shard, got.Leader)
+	}
+
+	// The leader of shard a goes down and the replica takes over.
+	a.stop()
+	atomic.StoreInt32(&replica.leader, 1)
+
+	waitFor(t, "shard a leader to be declared dead", func() bool {
+		return member(b.g, a.addr).State == gossip.Dead
+	})
+	waitFor(t, "shard b to route shard a to the new leader", func() bool {
+		return b.shards.Leader(0) == replica.addr
+	})
+	if got := b.shards.Leader(1); got != b.addr {
+		t.Errorf("Leader(1): got %q, want %q", got, b.addr)
+	}
+
+	// The dead member is forgotten by everyone.
+	waitFor(t, "the dead member to be forgotten", func() bool {
+		return len(b.g.Members()) == 2 && len(replica.g.Members()) == 2
+	})
+}
+
+func TestGossipConfig(t *testing.T) {
+	a, b := newNode(t), newNode(t)
+	file := `
+epoch = %d
+[[shards]]
+name = "a"
+idx = 0
+address = %q
+
+[[shards]]
+name = "b"
+idx = 1
+address = %q
+replicas = [%q]
+`
+	c, err := config.Parse([]byte(fmt.Sprintf(file, 1, a.addr, b.addr, "localhost:1")))
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+	a.start(t, c, "a", true)
+	b.start(t, c, "b", true)
+
+	// a switches to a config with a new replica of b, which spreads to b.
+	c, err = config.Parse([]byte(fmt.Sprintf(file, 2, a.addr, b.addr, "localhost:2")))
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+	next, err := config.ParseConfig(c, "a")
+	if err != nil {
+		t.Fatalf("ParseConfig(): %v", err)
+	}
+	a.shards.Update(next)
+
+	waitFor(t, "b to switch to epoch 2", func() bool {
+		return b.shards.CurrentEpoch() == 2
+	})
+	if got := b.shards.ReplicaAddrs(1); len(got) != 1 || got[0] != "localhost:2" {
+		t.Errorf("ReplicaAddrs(1) after the gossiped config: got %q, want [\"localhost:2\"]", got)
+	}
+	if got := b.shards.CurrentName(); got != "b" {
+		t.Errorf("CurrentName() after the gossiped config: got %q, want %q", got, "b")
+	}
+}
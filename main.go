@@ -26,23 +26,40 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	internalReplica "github.com/Nicknamezz00/naive-distributed-kv/replica"
 
 	"github.com/Nicknamezz00/naive-distributed-kv/api"
 	"github.com/Nicknamezz00/naive-distributed-kv/config"
 	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/gossip"
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
 )
 
 var (
-	dbPath     = flag.String("path", "", "The path to bolt db")
-	httpAddr   = flag.String("http-addr", "127.0.0.1:8080", "HTTP address listening")
-	configFile = flag.String("config", "sharding.toml", "Config for static sharding")
-	shard      = flag.String("shard", "", "The name of the shard for the data")
-	replica    = flag.Bool("replica", false, "Run as a read-only replica or not")
+	dbPath      = flag.String("path", "", "The path to bolt db")
+	httpAddr    = flag.String("http-addr", "127.0.0.1:8080", "HTTP address listening")
+	configFile  = flag.String("config", "sharding.toml", "Config for static sharding")
+	configWatch = flag.Duration("config-watch-interval", 5*time.Second, "How often the config file is checked for changes, 0 disables it")
+	prevConfig  = flag.String("previous-config", "", "Config before a reshard in progress, for nodes started during the reshard that have not saved it")
+	shard       = flag.String("shard", "", "The name of the shard for the data")
+	join        = flag.Bool("join", false, "Start a shard that is not in the config yet, it joins once an admin split adds it")
+	replica     = flag.Bool("replica", false, "Run as a read-only replica or not")
+	failover    = flag.Bool("failover", true, "Promote a replica when the shard leader goes down")
+	antiEntropy = flag.Duration("anti-entropy-interval", time.Minute, "How often replicas compare their data with the leader, 0 disables it")
+	raftMode    = flag.Bool("raft", false, "Replicate writes through a Raft group of the shard leader and its replicas")
+	raftMaxLog  = flag.Uint64("raft-max-log-entries", raft.DefaultMaxLogEntries, "How many applied entries the Raft log keeps before it is compacted, 0 keeps them all")
+	durability  = flag.String("durability", "async", "When writes are acknowledged: async, semi-sync or all")
+	ackTimeout  = flag.Duration("ack-timeout", api.DefaultAckTimeout, "How long writes wait for replica acknowledgements")
+	readRouting = flag.String("read-routing", "leader", "Where reads for other shards go: leader, round-robin or least-loaded")
+	reapEvery   = flag.Duration("ttl-reap-interval", time.Second, "How often the leader deletes expired keys, 0 disables it")
+	maxLog      = flag.Uint64("max-log-entries", 1000000, "How many log entries the leader keeps for replicas that have not acknowledged them, 0 keeps them until all did")
+	gossipEvery = flag.Duration("gossip-interval", time.Second, "How often members of the cluster are probed, 0 disables gossip membership")
 )
 
 func parseFlags() {
@@ -59,38 +76,220 @@ func parseFlags() {
 func main() {
 	parseFlags()
 
-	cfg, err := config.ParseFile(*configFile)
+	// In Raft mode the database is only modified by applying committed entries.
+	db, closeFunc, err := internalDB.NewDatabase(*dbPath, *replica || *raftMode)
+	if err != nil {
+		log.Fatalf("NewDatabase(%q): %v", *dbPath, err)
+	}
+	defer closeFunc()
+
+	fileCfg, err := config.ParseFile(*configFile)
 	if err != nil {
 		log.Fatalf("Error parsing config %q: %v", *configFile, err)
 	}
+	// A split or merge since the config file was written is only in the saved config.
+	cfg, saved, err := api.StartupConfig(db, fileCfg)
+	if err != nil {
+		log.Fatalf("Error loading the saved config: %v", err)
+	}
+	if saved {
+		log.Printf("Config file %q has epoch %d, using the saved config with epoch %d", *configFile, fileCfg.Epoch, cfg.Epoch)
+	}
 
-	shards, err := config.ParseShards(cfg.Shards, *shard)
+	parse := config.ParseConfig
+	if *join || saved {
+		parse = config.ParseNextConfig
+	}
+	shards, err := parse(cfg, *shard)
 	if err != nil {
 		log.Fatalf("Error parsing shards config: %v", err)
 	}
 	log.Printf("Shard count is %d, current shard: %d", shards.Count, shards.CurIdx)
 
-	db, closeFunc, err := internalDB.NewDatabase(*dbPath, *replica)
+	var raftNode *raft.Node
+	var replicaStats internalReplica.Stats
+	if *raftMode {
+		group := append([]string{shards.Leader(shards.CurIdx)}, shards.ReplicaAddrs(shards.CurIdx)...)
+		var peers []string
+		for _, addr := range group {
+			// The config may spell the address of this node differently from -http-addr.
+			if config.NormalizeAddr(addr) != config.NormalizeAddr(*httpAddr) {
+				peers = append(peers, addr)
+			}
+		}
+		if len(peers) == len(group) {
+			log.Fatalf("Address %q is not a member of shard %d: %q", *httpAddr, shards.CurIdx, group)
+		}
+
+		var closeRaft func() error
+		raftNode, closeRaft, err = raft.Open(*dbPath+".raft", *httpAddr, peers, db)
+		if err != nil {
+			log.Fatalf("raft.Open(%q): %v", *dbPath+".raft", err)
+		}
+		defer closeRaft()
+		raftNode.SetMaxLogEntries(*raftMaxLog)
+		go raftNode.Run()
+	} else {
+		if *replica {
+			if shards.Leader(shards.CurIdx) == "" && !*join {
+				log.Fatalf("Cannot find address for leader shard %d", shards.CurIdx)
+			}
+		} else if err := internalReplica.RegisterReplicas(db, shards, nil, *httpAddr); err != nil {
+			log.Fatalf("RegisterReplicas: %v", err)
+		}
+		// Leaders run the replica loops too: they idle while the node leads its shard
+		// and take over once it steps down for a leader elected while it was unreachable.
+		go internalReplica.ClientLoop(db, shards, *httpAddr, &replicaStats)
+		if *failover {
+			go internalReplica.FailoverLoop(db, shards, *httpAddr)
+		}
+		if *antiEntropy > 0 {
+			go internalReplica.AntiEntropyLoop(db, shards, *httpAddr, *antiEntropy)
+		}
+	}
+	db.SetMaxLogEntries(*maxLog)
+
+	durabilityMode, err := api.ParseDurability(*durability)
 	if err != nil {
-		log.Fatalf("NewDatabase(%q): %v", *dbPath, err)
+		log.Fatalf("Error parsing durability: %v", err)
 	}
-	defer closeFunc()
 
-	if *replica {
-		leader, ok := shards.Addrs[shards.CurIdx]
-		if !ok {
-			log.Fatalf("Cannot find address for leader shard %d", shards.CurIdx)
-		}
-		go internalReplica.ClientLoop(db, leader)
+	readRoutingPolicy, err := api.ParseReadRouting(*readRouting)
+	if err != nil {
+		log.Fatalf("Error parsing read routing: %v", err)
 	}
 
 	srv := api.NewServer(db, shards)
+	srv.SetDurability(durabilityMode, *ackTimeout)
+	srv.SetReadRouting(readRoutingPolicy)
+	if *prevConfig != "" {
+		prev, err := parsePreviousConfig(*prevConfig, *shard)
+		if err != nil {
+			log.Fatalf("Error parsing previous config %q: %v", *prevConfig, err)
+		}
+		if err := srv.Reshard(prev, shards); err != nil {
+			log.Fatalf("Reshard: %v", err)
+		}
+	} else if err := srv.ResumeMigration(); err != nil {
+		log.Fatalf("ResumeMigration: %v", err)
+	}
+	if !*raftMode {
+		srv.SetReplicaStats(&replicaStats)
+	}
+	if raftNode != nil {
+		srv.SetRaft(raftNode)
+		http.HandleFunc("/raft/request-vote", srv.RaftRequestVote)
+		http.HandleFunc("/raft/append-entries", srv.RaftAppendEntries)
+		http.HandleFunc("/raft/install-snapshot", srv.RaftInstallSnapshot)
+		http.HandleFunc("/raft/status", srv.RaftStatus)
+	}
+	if *gossipEvery > 0 {
+		// The static config only seeds the membership, leadership changes
+		// and newer configs are learned from the members themselves.
+		isLeader := func() bool { return !db.ReadOnly() }
+		if raftNode != nil {
+			isLeader = func() bool { return raftNode.Role() == raft.Leader }
+		}
+		g := gossip.New(*httpAddr, shards, isLeader)
+		g.OnConfig(func(c config.Config) error {
+			next, err := config.ParseNextConfig(c, *shard)
+			if err != nil {
+				return err
+			}
+			return srv.ReloadConfig(next)
+		})
+		srv.SetGossip(g)
+		http.HandleFunc("/gossip/ping", srv.GossipPing)
+		http.HandleFunc("/gossip/ping-req", srv.GossipPingReq)
+		http.HandleFunc("/gossip/members", srv.GossipMembers)
+		go g.Run(*gossipEvery)
+	}
+
+	if *reapEvery > 0 {
+		go reapLoop(db, raftNode, *reapEvery)
+	}
+
+	if *configWatch > 0 {
+		go config.Watch(*configFile, *configWatch, func(c config.Config) {
+			next, err := config.ParseNextConfig(c, *shard)
+			if err == nil {
+				err = srv.ReloadConfig(next)
+			}
+			if err != nil {
+				log.Printf("Error reloading config %q: %v", *configFile, err)
+			}
+		})
+	}
 
 	http.HandleFunc("/get", srv.GetHandler)
 	http.HandleFunc("/set", srv.SetHandler)
+	http.HandleFunc("/delete", srv.DeleteHandler)
+	http.HandleFunc("/scan", srv.ScanHandler)
 	http.HandleFunc("/delete-extra", srv.DeleteExtraKeysHandler)
-	http.HandleFunc("/delete-replica-key", srv.DeleteReplicaKey)
-	http.HandleFunc("/get-old-key", srv.GetOldKey)
+	http.HandleFunc("/log-entries", srv.LogEntries)
+	http.HandleFunc("/replication/stream", srv.StreamLog)
+	http.HandleFunc("/replication/snapshot", srv.Snapshot)
+	http.HandleFunc("/replication/position", srv.Position)
+	http.HandleFunc("/replication/status", srv.ReplicationStatus)
+	http.HandleFunc("/replication/vote", srv.Vote)
+	http.HandleFunc("/cluster/leader", srv.SetLeader)
+	http.HandleFunc("/admin/config", srv.ConfigHandler)
+	http.HandleFunc("/admin/reshard", srv.ReshardHandler)
+	http.HandleFunc("/admin/split", srv.SplitHandler)
+	http.HandleFunc("/admin/merge", srv.MergeHandler)
+	http.HandleFunc("/admin/locate", srv.LocateHandler)
+	http.HandleFunc("/reshard/import", srv.ImportKeys)
+	http.HandleFunc("/reshard/done", srv.MigrationDone)
+	http.HandleFunc("/anti-entropy/tree", srv.MerkleTree)
+	http.HandleFunc("/anti-entropy/leaf", srv.MerkleLeaf)
+	http.HandleFunc("/ack-log", srv.AckLog)
 
 	log.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
+
+// reapBatch is the number of expired keys deleted in one transaction.
+const reapBatch = 1000
+
+// reapLoop deletes expired keys in batches while the node leads its shard,
+// the deletions reach the replicas through the replication log.
+// In Raft mode the database only changes through committed entries,
+// the Raft leader then commits the deletions.
+func reapLoop(db *internalDB.Database, raftNode *raft.Node, interval time.Duration) {
+	reap := db.ReapExpired
+	isLeader := func() bool { return !db.ReadOnly() }
+	if raftNode != nil {
+		reap = func(limit int) (int, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+			return raftNode.ReapExpired(ctx, limit)
+		}
+		isLeader = func() bool { return raftNode.Role() == raft.Leader }
+	}
+
+	for {
+		time.Sleep(interval)
+		if !isLeader() {
+			continue
+		}
+		for {
+			n, err := reap(reapBatch)
+			if err != nil {
+				log.Printf("Error deleting expired keys: %v", err)
+				break
+			}
+			if n < reapBatch {
+				break
+			}
+		}
+	}
+}
+
+// parsePreviousConfig parses the config before a reshard. A shard added
+// by the reshard is not part of it and only gets the routing.
+func parsePreviousConfig(filename, shardName string) (*config.Shards, error) {
+	c, err := config.ParseFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseNextConfig(c, shardName)
+}
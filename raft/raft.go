@@ -0,0 +1,1091 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package raft replicates writes of a shard through a Raft group
+// formed by the shard leader and its replicas, with db.Database as the state machine.
+// The group membership is static. Applied entries are compacted once the log holds
+// more than SetMaxLogEntries of them: the database is the snapshot of compacted entries,
+// followers that need them restore a snapshot of the database of the leader.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+const (
+	tickInterval       = 20 * time.Millisecond
+	heartbeatInterval  = 100 * time.Millisecond
+	minElectionTimeout = 500 * time.Millisecond
+	maxElectionTimeout = 1000 * time.Millisecond
+	rpcTimeout         = 500 * time.Millisecond
+	// snapshotTimeout bounds sending a snapshot of the database to a follower.
+	snapshotTimeout = 10 * time.Minute
+	// maxAppendBatch is the largest number of entries sent in a single AppendEntries.
+	maxAppendBatch = 500
+)
+
+// DefaultMaxLogEntries is the number of applied entries the log holds before it is compacted.
+const DefaultMaxLogEntries = 10000
+
+var (
+	metaBucket  = []byte("raft-meta")
+	logBucket   = []byte("raft-log")
+	termKey     = []byte("term")
+	votedForKey = []byte("voted-for")
+	// The index and term of the last compacted entry.
+	snapshotIndexKey = []byte("snapshot-index")
+	snapshotTermKey  = []byte("snapshot-term")
+)
+
+// ErrEntryLost is returned when a proposed entry was replaced by the log of another leader,
+// or by a snapshot of another leader before it was applied.
+var ErrEntryLost = errors.New("entry was lost after a leader change")
+
+// NotLeaderError is returned when a write is proposed on a node that is not the leader.
+// Leader is empty if the leader is not known.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not the raft leader, leader is unknown"
+	}
+	return fmt.Sprintf("not the raft leader, leader is %q", e.Leader)
+}
+
+// Role of a node in the Raft group.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Entry is a single entry of the Raft log, its index is the sequence number
+// of the mutation in the state machine.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Op    db.Op
+	Key   string
+	Value []byte
+	// Time is the time the entry was proposed in unix nanoseconds.
+	Time int64 `json:",omitempty"`
+	// Cond is the condition of a conditional write, see ProposeIf.
+	Cond *db.Condition `json:",omitempty"`
+}
+
+type RequestVoteArgs struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader should retry from when Success is false.
+	ConflictIndex uint64
+}
+
+// InstallSnapshotArgs starts the body of an InstallSnapshot request,
+// the keys of the snapshot follow it as JSON encoded db.KeyValue values.
+type InstallSnapshotArgs struct {
+	Term   uint64
+	Leader string
+	// LastIndex and LastTerm are the index and term of the last entry the snapshot holds.
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// Status describes the state of the node.
+type Status struct {
+	ID          string
+	Role        string
+	Term        uint64
+	Leader      string
+	LastIndex   uint64
+	CommitIndex uint64
+	LastApplied uint64
+	// SnapshotIndex is the index of the last compacted entry.
+	SnapshotIndex uint64
+}
+
+// proposal is an entry ProposeIf or Propose waits on.
+type proposal struct {
+	term uint64 // the term of the proposed entry
+	done bool   // an entry was applied at its index
+	err  error  // ErrEntryLost if it was another entry, or the outcome of the condition
+}
+
+type Node struct {
+	id             string   // http address of this node
+	peers          []string // http addresses of the other members
+	db             *db.Database
+	store          *bolt.DB
+	client         *http.Client
+	snapshotClient *http.Client
+	stop           chan struct{}
+
+	// applyMu serializes applying entries with installing snapshots, it is taken before mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	term     uint64
+	votedFor string
+	// log[0] is a sentinel holding the index and term of the last compacted entry,
+	// so that log[i].Index == log[0].Index+i.
+	log              []Entry
+	maxLog           uint64
+	commitIndex      uint64
+	lastApplied      uint64
+	role             Role
+	leader           string
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	inflight         map[string]bool
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	proposals        map[uint64]*proposal // by index
+	changed          chan struct{}        // closed and replaced when the state of the node changes
+}
+
+// Open opens the Raft log stored at path. The database must be opened read-only,
+// it is only modified by applying committed entries.
+func Open(path, id string, peers []string, d *db.Database) (n *Node, closeFunc func() error, err error) {
+	store, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n = &Node{
+		id:             id,
+		peers:          peers,
+		db:             d,
+		store:          store,
+		client:         &http.Client{Timeout: rpcTimeout},
+		snapshotClient: &http.Client{Timeout: snapshotTimeout},
+		stop:           make(chan struct{}),
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		log:            []Entry{{}},
+		maxLog:         DefaultMaxLogEntries,
+		nextIndex:      make(map[string]uint64),
+		matchIndex:     make(map[string]uint64),
+		inflight:       make(map[string]bool),
+		proposals:      make(map[uint64]*proposal),
+		changed:        make(chan struct{}),
+	}
+	if err := n.load(); err != nil {
+		_ = store.Close()
+		return nil, nil, fmt.Errorf("error loading raft state: %w", err)
+	}
+	n.resetElectionTimer()
+
+	closeFunc = func() error {
+		close(n.stop)
+		return store.Close()
+	}
+	return n, closeFunc, nil
+}
+
+// SetMaxLogEntries sets the number of applied entries the log holds before it is compacted,
+// the newest half of them is kept for followers that are a little behind. 0 disables compaction.
+func (n *Node) SetMaxLogEntries(max uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.maxLog = max
+}
+
+func indexKey(index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+	return b
+}
+
+func (n *Node) load() error {
+	err := n.store.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(termKey); len(v) == 8 {
+			n.term = binary.BigEndian.Uint64(v)
+		}
+		n.votedFor = string(meta.Get(votedForKey))
+		if v := meta.Get(snapshotIndexKey); len(v) == 8 {
+			n.log[0].Index = binary.BigEndian.Uint64(v)
+		}
+		if v := meta.Get(snapshotTermKey); len(v) == 8 {
+			n.log[0].Term = binary.BigEndian.Uint64(v)
+		}
+
+		b, err := tx.CreateBucketIfNotExists(logBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Index != n.lastIndex()+1 {
+				return fmt.Errorf("raft log gap: got index %d, want %d", e.Index, n.lastIndex()+1)
+			}
+			n.log = append(n.log, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	applied, err := n.db.AppliedSeq()
+	if err != nil {
+		return err
+	}
+	if applied < n.base() {
+		// The node stopped while installing a snapshot: the database holds the entries
+		// up to applied, which are committed, the leader sends the rest again.
+		// Their term is unknown, the log only matches the leader after them.
+		log.Printf("Raft: database applied %d entries, the log was compacted up to %d, dropping the log", applied, n.base())
+		if err := n.compact(Entry{Index: applied}, false); err != nil {
+			return err
+		}
+	}
+	if applied > n.lastIndex() {
+		return fmt.Errorf("database applied %d entries, but the raft log has only %d", applied, n.lastIndex())
+	}
+	// Applied entries are committed.
+	n.lastApplied = applied
+	n.commitIndex = applied
+	return nil
+}
+
+// persistState durably stores the current term and vote, mu must be held.
+func (n *Node) persistState() error {
+	return n.store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		if err := b.Put(termKey, indexKey(n.term)); err != nil {
+			return err
+		}
+		return b.Put(votedForKey, []byte(n.votedFor))
+	})
+}
+
+// appendLog durably appends entries to the log, mu must be held.
+func (n *Node) appendLog(entries []Entry) error {
+	err := n.store.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(logBucket)
+		for _, e := range entries {
+			v, err := json.Marshal(&e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(indexKey(e.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// compact durably replaces the entries up to and including snap.Index, whose effect
+// is in the database, by a sentinel with the index and term of snap. The entries
+// after it are kept if keep is set, otherwise the log ends at snap, mu must be held.
+func (n *Node) compact(snap Entry, keep bool) error {
+	err := n.store.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(snapshotIndexKey, indexKey(snap.Index)); err != nil {
+			return err
+		}
+		if err := meta.Put(snapshotTermKey, indexKey(snap.Term)); err != nil {
+			return err
+		}
+		c := tx.Bucket(logBucket).Cursor()
+		for k, _ := c.First(); k != nil && (!keep || binary.BigEndian.Uint64(k) <= snap.Index); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	entries := []Entry{{Index: snap.Index, Term: snap.Term}}
+	if keep && snap.Index < n.lastIndex() {
+		entries = append(entries, n.entries(snap.Index+1, n.lastIndex()+1)...)
+	}
+	n.log = entries
+	return nil
+}
+
+// truncateLog durably deletes entries starting from index, mu must be held.
+func (n *Node) truncateLog(index uint64) error {
+	err := n.store.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(logBucket).Cursor()
+		for k, _ := c.Seek(indexKey(index)); k != nil; k, _ = c.Seek(indexKey(index)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.log = n.log[:index-n.base()]
+	return nil
+}
+
+// base returns the index of the last compacted entry, mu must be held.
+func (n *Node) base() uint64 {
+	return n.log[0].Index
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.base() + uint64(len(n.log)-1)
+}
+
+// entry returns the entry at index, which must not be compacted, mu must be held.
+// The entry at the base only holds the index and term of the last compacted entry.
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.base()]
+}
+
+// entries returns the entries with indexes in [from, to), mu must be held.
+func (n *Node) entries(from, to uint64) []Entry {
+	return n.log[from-n.base() : to-n.base()]
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// notify wakes up everyone waiting for a state change, mu must be held.
+func (n *Node) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := minElectionTimeout + time.Duration(n.rand.Int63n(int64(maxElectionTimeout-minElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollower steps down to a follower, adopting a newer term, mu must be held.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persistState(); err != nil {
+			log.Printf("Raft: persisting state: %v", err)
+		}
+	}
+	if n.role != Follower || n.leader != leader {
+		n.role = Follower
+		n.leader = leader
+		n.notify()
+	}
+}
+
+// Run drives elections, heartbeats and applying committed entries until the node is closed.
+func (n *Node) Run() {
+	go n.applyLoop()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if n.role == Leader {
+			if time.Since(n.lastHeartbeat) >= heartbeatInterval {
+				n.broadcastAppend()
+			}
+		} else if time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection becomes a candidate and requests votes from peers, mu must be held.
+func (n *Node) startElection() {
+	n.term++
+	n.role = Candidate
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetElectionTimer()
+	if err := n.persistState(); err != nil {
+		log.Printf("Raft: persisting state: %v", err)
+		return
+	}
+	n.notify()
+
+	log.Printf("Raft: %q starts election for term %d", n.id, n.term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	last := n.entry(n.lastIndex())
+	args := &RequestVoteArgs{
+		Term:         n.term,
+		Candidate:    n.id,
+		LastLogIndex: last.Index,
+		LastLogTerm:  last.Term,
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			var reply RequestVoteReply
+			if err := n.call(peer, "/raft/request-vote", args, &reply); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				return
+			}
+			if n.role != Candidate || n.term != args.Term || !reply.VoteGranted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the group and appends a no-op entry,
+// so that entries from previous terms get committed, mu must be held.
+func (n *Node) becomeLeader() {
+	log.Printf("Raft: %q is the leader for term %d", n.id, n.term)
+
+	n.role = Leader
+	n.leader = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	if err := n.appendLog([]Entry{{Index: n.lastIndex() + 1, Term: n.term, Op: db.OpNoop}}); err != nil {
+		log.Printf("Raft: appending no-op entry: %v", err)
+	}
+	n.notify()
+	n.advanceCommit()
+	n.broadcastAppend()
+}
+
+// broadcastAppend sends new entries or a heartbeat to every peer, mu must be held.
+func (n *Node) broadcastAppend() {
+	n.lastHeartbeat = time.Now()
+	for _, peer := range n.peers {
+		n.replicate(peer)
+	}
+}
+
+// replicate sends entries the peer does not have yet, at most one request
+// is in flight per peer, mu must be held.
+func (n *Node) replicate(peer string) {
+	if n.inflight[peer] {
+		return
+	}
+	n.inflight[peer] = true
+
+	next := n.nextIndex[peer]
+	if next <= n.base() {
+		n.sendSnapshot(peer)
+		return
+	}
+	end := n.lastIndex() + 1
+	if end-next > maxAppendBatch {
+		end = next + maxAppendBatch
+	}
+	args := &AppendEntriesArgs{
+		Term:         n.term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.entry(next - 1).Term,
+		Entries:      append([]Entry(nil), n.entries(next, end)...),
+		LeaderCommit: n.commitIndex,
+	}
+
+	go func() {
+		var reply AppendEntriesReply
+		err := n.call(peer, "/raft/append-entries", args, &reply)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inflight[peer] = false
+		if err != nil {
+			return
+		}
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term, "")
+			return
+		}
+		if n.role != Leader || n.term != args.Term {
+			return
+		}
+
+		if reply.Success {
+			match := args.PrevLogIndex + uint64(len(args.Entries))
+			if match > n.matchIndex[peer] {
+				n.matchIndex[peer] = match
+			}
+			n.nextIndex[peer] = match + 1
+			n.advanceCommit()
+		} else {
+			next := reply.ConflictIndex
+			if next == 0 || next > args.PrevLogIndex {
+				next = args.PrevLogIndex
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.nextIndex[peer] = next
+		}
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.replicate(peer)
+		}
+	}()
+}
+
+// sendSnapshot sends a snapshot of the database to a peer that needs compacted entries,
+// the peer continues from the entries after it. inflight must be set, mu must be held.
+func (n *Node) sendSnapshot(peer string) {
+	snap, err := n.db.Snapshot()
+	if err != nil {
+		log.Printf("Raft: snapshot for %q: %v", peer, err)
+		n.inflight[peer] = false
+		return
+	}
+	// The database applied entries up to at most the commit index,
+	// and at least up to the base, entries are only compacted once applied.
+	if snap.Seq < n.base() || snap.Seq > n.lastIndex() {
+		log.Printf("Raft: snapshot for %q at %d is outside of the log [%d, %d]", peer, snap.Seq, n.base(), n.lastIndex())
+		snap.Close()
+		n.inflight[peer] = false
+		return
+	}
+	args := &InstallSnapshotArgs{
+		Term:      n.term,
+		Leader:    n.id,
+		LastIndex: snap.Seq,
+		LastTerm:  n.entry(snap.Seq).Term,
+	}
+
+	go func() {
+		var reply InstallSnapshotReply
+		err := n.callInstallSnapshot(peer, args, snap, &reply)
+		snap.Close()
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.inflight[peer] = false
+		if err != nil {
+			log.Printf("Raft: sending snapshot to %q: %v", peer, err)
+			return
+		}
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term, "")
+			return
+		}
+		if n.role != Leader || n.term != args.Term {
+			return
+		}
+		if args.LastIndex > n.matchIndex[peer] {
+			n.matchIndex[peer] = args.LastIndex
+		}
+		n.nextIndex[peer] = args.LastIndex + 1
+		n.advanceCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.replicate(peer)
+		}
+	}()
+}
+
+// callInstallSnapshot streams args followed by the keys of the snapshot to the peer.
+func (n *Node) callInstallSnapshot(peer string, args *InstallSnapshotArgs, snap *db.Snapshot, reply *InstallSnapshotReply) error {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e := json.NewEncoder(w)
+		err := e.Encode(args)
+		if err == nil {
+			err = snap.ForEach(func(kv db.KeyValue) error {
+				return e.Encode(&kv)
+			})
+		}
+		w.CloseWithError(err)
+	}()
+	// The snapshot is read until the request ends, it must not be closed before.
+	defer func() {
+		r.Close()
+		<-done
+	}()
+
+	resp, err := n.snapshotClient.Post("http://"+peer+"/raft/install-snapshot", "application/x-ndjson", r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// advanceCommit commits the entries of the current term replicated on a majority, mu must be held.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.entry(index).Term == n.term; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.notify()
+			return
+		}
+	}
+}
+
+// applyLoop applies committed entries to the database in log order
+// and compacts the log once it holds more than maxLog applied entries.
+func (n *Node) applyLoop() {
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex {
+			changed := n.changed
+			n.mu.Unlock()
+			select {
+			case <-changed:
+			case <-n.stop:
+				return
+			}
+			n.mu.Lock()
+		}
+		from := n.lastApplied
+		var entries []*db.LogEntry
+		var terms []uint64
+		for _, e := range n.entries(n.lastApplied+1, n.commitIndex+1) {
+			entries = append(entries, &db.LogEntry{Seq: e.Index, Op: e.Op, Key: e.Key, Value: e.Value, Time: e.Time, Cond: e.Cond})
+			terms = append(terms, e.Term)
+		}
+		n.mu.Unlock()
+
+		n.applyMu.Lock()
+		n.mu.Lock()
+		// A snapshot installed in the meantime holds the entries.
+		installed := n.lastApplied != from
+		n.mu.Unlock()
+		if installed {
+			n.applyMu.Unlock()
+			continue
+		}
+
+		if err := n.db.ApplyLogEntries(entries); err != nil {
+			n.applyMu.Unlock()
+			log.Printf("Raft: applying entries: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		n.mu.Lock()
+		for i, e := range entries {
+			if p := n.proposals[e.Seq]; p != nil {
+				p.done = true
+				if p.term != terms[i] {
+					p.err = ErrEntryLost
+				} else if e.Cond != nil {
+					p.err = e.CondErr
+				}
+			}
+		}
+		n.lastApplied = entries[len(entries)-1].Seq
+		if n.maxLog > 0 && n.lastApplied-n.base() > n.maxLog {
+			index := n.lastApplied - n.maxLog/2
+			if err := n.compact(n.entry(index), true); err != nil {
+				log.Printf("Raft: compacting the log up to %d: %v", index, err)
+			}
+		}
+		n.notify()
+		n.mu.Unlock()
+		n.applyMu.Unlock()
+	}
+}
+
+// Propose commits the mutation through the Raft log and waits until it is applied,
+// returns its sequence number. If this node is not the leader, *NotLeaderError is returned.
+func (n *Node) Propose(ctx context.Context, op db.Op, key string, value []byte) (seq uint64, err error) {
+	return n.propose(ctx, op, key, value, nil)
+}
+
+// ProposeIf is Propose for a conditional write: the condition is checked on every node
+// when the entry is applied, an error wrapping db.ErrConditionFailed is returned
+// if it did not hold and the write was skipped.
+func (n *Node) ProposeIf(ctx context.Context, op db.Op, key string, value []byte, cond db.Condition) (seq uint64, err error) {
+	return n.propose(ctx, op, key, value, &cond)
+}
+
+func (n *Node) propose(ctx context.Context, op db.Op, key string, value []byte, cond *db.Condition) (seq uint64, err error) {
+	n.mu.Lock()
+	if n.role != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return 0, &NotLeaderError{Leader: leader}
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Op: op, Key: key, Value: value, Time: time.Now().UnixNano(), Cond: cond}
+	if err := n.appendLog([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	p := &proposal{term: e.Term}
+	n.proposals[e.Index] = p
+	defer func() {
+		n.mu.Lock()
+		delete(n.proposals, e.Index)
+		n.mu.Unlock()
+	}()
+	n.advanceCommit()
+	n.broadcastAppend()
+	n.mu.Unlock()
+
+	for {
+		n.mu.Lock()
+		changed := n.changed
+		done, err := p.done, p.err
+		// Entries that are not applied are not compacted.
+		lost := !done && (n.lastIndex() < e.Index || n.entry(e.Index).Term != e.Term)
+		n.mu.Unlock()
+
+		if lost {
+			return 0, ErrEntryLost
+		}
+		if done && err != nil {
+			return 0, err
+		}
+		if done {
+			return e.Index, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// ReapExpired deletes up to limit expired keys by committing an OpExpire entry for each,
+// returns the number of committed entries. Only the leader reaps, a key renewed
+// before its entry is applied is kept. If this node is not the leader, *NotLeaderError is returned.
+func (n *Node) ReapExpired(ctx context.Context, limit int) (reaped int, err error) {
+	n.mu.Lock()
+	role, leader := n.role, n.leader
+	n.mu.Unlock()
+	if role != Leader {
+		return 0, &NotLeaderError{Leader: leader}
+	}
+
+	keys, err := n.db.ExpiredKeys(limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if _, err := n.Propose(ctx, db.OpExpire, key, nil); err != nil {
+			return reaped, err
+		}
+		reaped++
+	}
+	return reaped, nil
+}
+
+// RequestVote handles a vote request of a candidate.
+func (n *Node) RequestVote(args *RequestVoteArgs) *RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.term {
+		n.becomeFollower(args.Term, "")
+	}
+	reply := &RequestVoteReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+
+	last := n.entry(n.lastIndex())
+	upToDate := args.LastLogTerm > last.Term || (args.LastLogTerm == last.Term && args.LastLogIndex >= last.Index)
+	if (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		if err := n.persistState(); err != nil {
+			log.Printf("Raft: persisting state: %v", err)
+			return reply
+		}
+		reply.VoteGranted = true
+		n.resetElectionTimer()
+	}
+	return reply
+}
+
+// AppendEntries handles replication and heartbeats from the leader.
+func (n *Node) AppendEntries(args *AppendEntriesArgs) *AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.term || (args.Term == n.term && n.leader != args.Leader) {
+		n.becomeFollower(args.Term, args.Leader)
+	}
+	reply := &AppendEntriesReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+	n.resetElectionTimer()
+
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	// Compacted entries are committed, they match the log of every leader.
+	if args.PrevLogIndex > n.base() {
+		if term := n.entry(args.PrevLogIndex).Term; term != args.PrevLogTerm {
+			// Skip the whole conflicting term at once.
+			index := args.PrevLogIndex
+			for index > n.base()+1 && n.entry(index-1).Term == term {
+				index--
+			}
+			reply.ConflictIndex = index
+			return reply
+		}
+	}
+
+	for i, e := range args.Entries {
+		if e.Index <= n.base() {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			if e.Index <= n.commitIndex {
+				log.Printf("Raft: leader %q conflicts with committed entry %d", args.Leader, e.Index)
+				return reply
+			}
+			if err := n.truncateLog(e.Index); err != nil {
+				log.Printf("Raft: truncating log: %v", err)
+				return reply
+			}
+		}
+		if err := n.appendLog(args.Entries[i:]); err != nil {
+			log.Printf("Raft: appending entries: %v", err)
+			return reply
+		}
+		break
+	}
+
+	if last := args.PrevLogIndex + uint64(len(args.Entries)); args.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.notify()
+	}
+	reply.Success = true
+	return reply
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		Role:          n.role.String(),
+		Term:          n.term,
+		Leader:        n.leader,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.base(),
+	}
+}
+
+// InstallSnapshot handles a snapshot of the database of the leader sent for compacted
+// entries this node does not have, the body is the one sent by the leader, see InstallSnapshotArgs.
+// The database is replaced by the snapshot, entries of the log after it are kept if the
+// log has the last entry of the snapshot, otherwise the log is replaced too.
+func (n *Node) InstallSnapshot(body io.Reader) (*InstallSnapshotReply, error) {
+	d := json.NewDecoder(body)
+	var args InstallSnapshotArgs
+	if err := d.Decode(&args); err != nil {
+		return nil, err
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if args.Term > n.term || (args.Term == n.term && n.leader != args.Leader) {
+		n.becomeFollower(args.Term, args.Leader)
+	}
+	reply := &InstallSnapshotReply{Term: n.term}
+	if args.Term < n.term || args.LastIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return reply, nil
+	}
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	// The snapshot holds committed entries only, it is restored without blocking
+	// the node while it is received, applyMu keeps the entries from being applied.
+	err := n.db.RestoreSnapshot(args.LastIndex, func(put func(e db.KeyValue) error) error {
+		for {
+			var e db.KeyValue
+			if err := d.Decode(&e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := put(e); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// The snapshot is after the last applied entry, which is not compacted.
+	keep := args.LastIndex <= n.lastIndex() && n.entry(args.LastIndex).Term == args.LastTerm
+	if err := n.compact(Entry{Index: args.LastIndex, Term: args.LastTerm}, keep); err != nil {
+		return nil, err
+	}
+	for index, p := range n.proposals {
+		if index <= args.LastIndex && !p.done {
+			p.done, p.err = true, ErrEntryLost
+		}
+	}
+	n.lastApplied = args.LastIndex
+	if n.commitIndex < args.LastIndex {
+		n.commitIndex = args.LastIndex
+	}
+	n.resetElectionTimer()
+	n.notify()
+	return reply, nil
+}
+
+// Role returns the current role of the node.
+func (n *Node) Role() Role {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+func (n *Node) call(peer, path string, args, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post("http://"+peer+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
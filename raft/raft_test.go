@@ -0,0 +1,346 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package raft_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/raft"
+)
+
+type testNode struct {
+	addr   string
+	node   *raft.Node
+	db     *internalDB.Database
+	srv    *httptest.Server
+	close  func() error
+	paused int32 // requests fail until resume is called
+}
+
+// resume starts a node created paused.
+func (tn *testNode) resume() {
+	atomic.StoreInt32(&tn.paused, 0)
+	go tn.node.Run()
+}
+
+func tempPath(t *testing.T, prefix string) string {
+	t.Helper()
+	f, err := ioutil.TempFile(os.TempDir(), prefix)
+	if err != nil {
+		t.Fatalf("Cannot create temp file: %v", err)
+	}
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+	return name
+}
+
+// createCluster starts a group of size nodes, the nodes with the paused indexes
+// neither run nor answer requests until they are resumed.
+func createCluster(t *testing.T, size int, paused ...int) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		tn := &testNode{}
+		tn.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&tn.paused) != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			switch r.URL.Path {
+			case "/raft/request-vote":
+				var args raft.RequestVoteArgs
+				json.NewDecoder(r.Body).Decode(&args)
+				json.NewEncoder(w).Encode(tn.node.RequestVote(&args))
+			case "/raft/append-entries":
+				var args raft.AppendEntriesArgs
+				json.NewDecoder(r.Body).Decode(&args)
+				json.NewEncoder(w).Encode(tn.node.AppendEntries(&args))
+			case "/raft/install-snapshot":
+				reply, err := tn.node.InstallSnapshot(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(reply)
+			}
+		}))
+		t.Cleanup(tn.srv.Close)
+		tn.addr = strings.TrimPrefix(tn.srv.URL, "http://")
+		nodes[i] = tn
+	}
+	for _, i := range paused {
+		atomic.StoreInt32(&nodes[i].paused, 1)
+	}
+
+	for _, tn := range nodes {
+		var peers []string
+		for _, other := range nodes {
+			if other != tn {
+				peers = append(peers, other.addr)
+			}
+		}
+
+		db, closeDB, err := internalDB.NewDatabase(tempPath(t, "raftdb"), true)
+		if err != nil {
+			t.Fatalf("Cannot create a new database: %v", err)
+		}
+		node, closeNode, err := raft.Open(tempPath(t, "raftlog"), tn.addr, peers, db)
+		if err != nil {
+			t.Fatalf("raft.Open: %v", err)
+		}
+		var closed bool
+		tn.close = func() error {
+			if closed {
+				return nil
+			}
+			closed = true
+			return closeNode()
+		}
+		t.Cleanup(func() {
+			tn.close()
+			closeDB()
+		})
+
+		tn.db = db
+		tn.node = node
+		if atomic.LoadInt32(&tn.paused) == 0 {
+			go node.Run()
+		}
+	}
+	return nodes
+}
+
+func waitForLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, tn := range nodes {
+			if tn.node.Status().Role == "leader" {
+				return tn
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("No leader was elected")
+	return nil
+}
+
+func waitForValue(t *testing.T, tn *testNode, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		value, err := tn.db.Get(key)
+		if err == nil && string(value) == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Key %q on %q did not become %q", key, tn.addr, want)
+}
+
+func TestReplication(t *testing.T) {
+	nodes := createCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := leader.node.Propose(ctx, internalDB.OpSet, "hello", []byte("world")); err != nil {
+		t.Fatalf("Propose on leader: got %v, want nil error", err)
+	}
+	for _, tn := range nodes {
+		waitForValue(t, tn, "hello", "world")
+	}
+
+	for _, tn := range nodes {
+		if tn == leader {
+			continue
+		}
+		_, err := tn.node.Propose(ctx, internalDB.OpSet, "hello", []byte("follower"))
+		var notLeader *raft.NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != leader.addr {
+			t.Errorf("Propose on follower: got %v, want NotLeaderError with leader %q", err, leader.addr)
+		}
+	}
+
+	// The remaining nodes elect a new leader that keeps committed writes.
+	leader.close()
+	leader.srv.Close()
+	var rest []*testNode
+	for _, tn := range nodes {
+		if tn != leader {
+			rest = append(rest, tn)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var seq uint64
+	var err error
+	for time.Now().Before(deadline) {
+		newLeader := waitForLeader(t, rest)
+		if seq, err = newLeader.node.Propose(ctx, internalDB.OpDelete, "hello", nil); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Propose after leader failure: got %v, want nil error", err)
+	}
+	if seq < 3 {
+		t.Errorf("Propose after leader failure: got seq %d, want at least 3", seq)
+	}
+	for _, tn := range rest {
+		waitForValue(t, tn, "hello", "")
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	nodes := createCluster(t, 1)
+	leader := waitForLeader(t, nodes)
+
+	seq, err := leader.node.Propose(context.Background(), internalDB.OpSet, "hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("Propose: got %v, want nil error", err)
+	}
+	// The first entry is the no-op of the leader.
+	if seq != 2 {
+		t.Errorf("Propose: got seq %d, want 2", seq)
+	}
+	waitForValue(t, leader, "hello", "world")
+}
+
+func TestReapExpired(t *testing.T) {
+	nodes := createCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for key, expiresAt := range map[string]time.Time{"a": time.Now().Add(-time.Second), "b": time.Now().Add(time.Hour)} {
+		if _, err := leader.node.Propose(ctx, internalDB.OpSetExpiring, key, internalDB.ExpiringValue([]byte("value-"+key), expiresAt)); err != nil {
+			t.Fatalf("Propose(%q): %v", key, err)
+		}
+	}
+
+	for _, tn := range nodes {
+		if tn == leader {
+			continue
+		}
+		var notLeader *raft.NotLeaderError
+		if _, err := tn.node.ReapExpired(ctx, 10); !errors.As(err, &notLeader) {
+			t.Errorf("ReapExpired on follower: got %v, want NotLeaderError", err)
+		}
+	}
+	if n, err := leader.node.ReapExpired(ctx, 10); err != nil || n != 1 {
+		t.Fatalf("ReapExpired on leader: got %d, %v; want 1, nil", n, err)
+	}
+
+	for _, tn := range nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			keys, err := tn.db.ExpiredKeys(10)
+			if err == nil && len(keys) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expired keys on %q: got %q, %v; want none", tn.addr, keys, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		waitForValue(t, tn, "b", "value-b")
+	}
+}
+
+func TestProposeIf(t *testing.T) {
+	nodes := createCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seq, err := leader.node.ProposeIf(ctx, internalDB.OpSet, "hello", []byte("world"), internalDB.Condition{Absent: true})
+	if err != nil {
+		t.Fatalf("ProposeIf of a new key: got %v, want nil error", err)
+	}
+	if _, err := leader.node.ProposeIf(ctx, internalDB.OpSet, "hello", []byte("again"), internalDB.Condition{Absent: true}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("ProposeIf absent of an existing key: got %v, want ErrConditionFailed", err)
+	}
+	if _, err := leader.node.ProposeIf(ctx, internalDB.OpSet, "hello", []byte("next"), internalDB.Condition{Version: seq}); err != nil {
+		t.Errorf("ProposeIf with the current version: got %v, want nil error", err)
+	}
+	if _, err := leader.node.ProposeIf(ctx, internalDB.OpDelete, "hello", nil, internalDB.Condition{Version: seq}); !errors.Is(err, internalDB.ErrConditionFailed) {
+		t.Errorf("ProposeIf delete with an old version: got %v, want ErrConditionFailed", err)
+	}
+	for _, tn := range nodes {
+		waitForValue(t, tn, "hello", "next")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	const maxLog = 10
+	nodes := createCluster(t, 3, 2)
+	lagging := nodes[2]
+	for _, tn := range nodes {
+		tn.node.SetMaxLogEntries(maxLog)
+	}
+	leader := waitForLeader(t, nodes[:2])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5*maxLog; i++ {
+		if _, err := leader.node.Propose(ctx, internalDB.OpSet, fmt.Sprintf("key-%d", i), []byte("value")); err != nil {
+			t.Fatalf("Propose: got %v, want nil error", err)
+		}
+	}
+	if _, err := leader.node.Propose(ctx, internalDB.OpSet, "last", []byte("value")); err != nil {
+		t.Fatalf("Propose: got %v, want nil error", err)
+	}
+
+	st := leader.node.Status()
+	if st.SnapshotIndex == 0 || st.LastIndex-st.SnapshotIndex > maxLog+1 {
+		t.Errorf("Leader log: got snapshot index %d and last index %d, want at most %d entries after a snapshot", st.SnapshotIndex, st.LastIndex, maxLog+1)
+	}
+
+	// The lagging node needs compacted entries, it restores a snapshot of the leader.
+	lagging.resume()
+	waitForValue(t, lagging, "key-0", "value")
+	waitForValue(t, lagging, "last", "value")
+	if st := lagging.node.Status(); st.SnapshotIndex == 0 {
+		t.Errorf("Lagging node: got snapshot index 0, want the index of the snapshot it restored")
+	}
+}
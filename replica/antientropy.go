@@ -0,0 +1,126 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+// MerkleLeaf contains the response for MerkleLeaf.
+type MerkleLeaf struct {
+	Seq     uint64
+	Entries []db.KeyValue
+}
+
+type antiEntropy struct {
+	db     *db.Database
+	shards *config.Shards
+	name   string // http address of this replica
+	client *http.Client
+}
+
+// AntiEntropyLoop periodically compares the Merkle tree of the replica with the one
+// of the leader and repairs the leaves that differ, fetching only their keys.
+// The leader may be ahead of the replica, the repair leaves keys written since
+// the position of the replica to the replication stream, see db.RepairMerkleLeaves.
+func AntiEntropyLoop(db *db.Database, shards *config.Shards, name string, interval time.Duration) {
+	a := &antiEntropy{db: db, shards: shards, name: name, client: &http.Client{Timeout: time.Minute}}
+	for {
+		time.Sleep(interval)
+
+		leader := shards.Leader(shards.CurrentIdx())
+		if sameAddr(leader, name) || !db.ReadOnly() {
+			continue
+		}
+		repaired, err := a.repair(leader)
+		if err != nil {
+			log.Printf("Anti-entropy error: %v", err)
+			continue
+		}
+		if repaired > 0 {
+			log.Printf("Anti-entropy repaired %d keys from %q", repaired, leader)
+		}
+	}
+}
+
+// repair compares the trees once and returns the number of repaired keys.
+func (a *antiEntropy) repair(leader string) (repaired int, err error) {
+	var remote db.MerkleTree
+	if err := a.get(leader, "/anti-entropy/tree", &remote); err != nil {
+		return 0, err
+	}
+	local, err := a.db.MerkleTree()
+	if err != nil {
+		return 0, err
+	}
+	if local.Seq > remote.Seq {
+		return 0, nil
+	}
+	leaves := local.Diff(&remote)
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+
+	// All differing leaves are fetched and repaired at once, each side scans its keys once.
+	u := url.Values{}
+	for _, leaf := range leaves {
+		u.Add("leaf", strconv.Itoa(leaf))
+	}
+	var res MerkleLeaf
+	if err := a.get(leader, "/anti-entropy/leaf?"+u.Encode(), &res); err != nil {
+		return 0, err
+	}
+	repaired, err = a.db.RepairMerkleLeaves(res.Seq, leaves, res.Entries)
+	if errors.Is(err, db.ErrPositionChanged) {
+		return 0, nil
+	}
+	return repaired, err
+}
+
+func (a *antiEntropy) get(addr, path string, res interface{}) error {
+	resp, err := a.client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,65 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica_test
+
+import (
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+func TestAntiEntropyLoop(t *testing.T) {
+	nodes := startShard(t, 1)
+	leader, r := nodes[0], nodes[1]
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		setKey(t, leader.db, kv[0], kv[1])
+	}
+
+	// The replica is at the position of the leader, but lost a key,
+	// holds a stale value and a key the leader deleted.
+	err := r.db.RestoreSnapshot(3, func(put func(e internalDB.KeyValue) error) error {
+		for _, e := range []internalDB.KeyValue{
+			{Key: "a", Value: []byte("1"), Version: 1},
+			{Key: "b", Value: []byte("stale"), Version: 1},
+			{Key: "x", Value: []byte("extra"), Version: 1},
+		} {
+			if err := put(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RestoreSnapshot: got %v, want nil error", err)
+	}
+
+	go replica.AntiEntropyLoop(r.db, r.shards, r.addr, 10*time.Millisecond)
+	waitFor(t, 5*time.Second, "the repair", func() bool {
+		return hasKey(r.db, "a", "1") && hasKey(r.db, "b", "2") && hasKey(r.db, "c", "3") && !hasKey(r.db, "x", "extra")
+	})
+}
@@ -0,0 +1,337 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	"github.com/Nicknamezz00/naive-distributed-kv/db"
+)
+
+const (
+	// healthInterval is how often replicas check that the leader responds.
+	healthInterval = time.Second
+	// failureThreshold is the number of failed checks in a row after which
+	// the leader is considered down.
+	failureThreshold = 3
+)
+
+// LeaderTimeout is how long a replica that stopped hearing from its leader waits before
+// it votes for a new one, replicas still in touch with the leader refuse to vote.
+// It is a little shorter than it takes replicas to find the leader down,
+// so they vote in the first election after it.
+const LeaderTimeout = (failureThreshold - 1) * healthInterval
+
+var healthClient = &http.Client{Timeout: time.Second}
+
+// Position contains the response for Position.
+type Position struct {
+	Seq      uint64
+	ReadOnly bool
+}
+
+// Vote contains the response for a vote request.
+type Vote struct {
+	Granted bool
+	Term    uint64 // the newest term the replica voted in
+	Reason  string // why the vote was refused
+}
+
+type failover struct {
+	db     *db.Database
+	shards *config.Shards
+	name   string // http address of this node
+	seen   uint64 // the newest term another replica refused a vote in
+}
+
+// FailoverLoop monitors the shard leader from a replica. When the leader stops
+// responding, the replica with the highest applied position among the reachable
+// replicas of the shard stands for a new term, ties are broken by the lowest address.
+// It promotes itself only once it has the votes of a majority of the shard, the
+// leader included, see db.Vote, so at most one replica leads each term. A shard
+// with a single replica does not fail over, its vote alone is no majority.
+// The new leader announces itself to every node.
+// On a leader the loop watches the replicas instead: once one of them leads a newer
+// term, as after a failover while the leader was unreachable, the leader steps down
+// and becomes a replica of the new leader.
+func FailoverLoop(db *db.Database, shards *config.Shards, name string) {
+	f := &failover{db: db, shards: shards, name: name}
+
+	failures := 0
+	for {
+		time.Sleep(healthInterval)
+
+		if !db.ReadOnly() {
+			failures = 0
+			if err := f.checkLeadership(); err != nil {
+				log.Printf("Leadership check error: %v", err)
+			}
+			continue
+		}
+
+		leader := shards.Leader(shards.CurrentIdx())
+		if sameAddr(leader, name) {
+			continue
+		}
+		_, err := fetchPosition(leader)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		log.Printf("Leader %q health check failed: %v", leader, err)
+
+		failures++
+		if failures < failureThreshold {
+			continue
+		}
+		failures = 0
+
+		winner, term, err := f.elect()
+		if err != nil {
+			log.Printf("Election error: %v", err)
+			continue
+		}
+		if !sameAddr(winner, name) {
+			log.Printf("Replica %q is expected to lead shard %d", winner, shards.CurrentIdx())
+			continue
+		}
+		if err := f.campaign(term); err != nil {
+			log.Printf("Election of term %d failed: %v", term, err)
+			continue
+		}
+		if err := f.promote(term); err != nil {
+			log.Printf("Promotion error: %v", err)
+		}
+	}
+}
+
+// elect returns the address of the replica that should stand for leader and the
+// term it stands for, newer than the term of every reachable replica and than
+// every term this replica voted in or was refused a vote in.
+// If some replica was already promoted, it is adopted as the leader.
+func (f *failover) elect() (winner string, term uint64, err error) {
+	winner = f.name
+	best, err := f.db.AppliedSeq()
+	if err != nil {
+		return "", 0, err
+	}
+	voted, err := f.db.VotedTerm()
+	if err != nil {
+		return "", 0, err
+	}
+	term = db.Term(best) + 1
+	if voted < f.seen {
+		voted = f.seen
+	}
+	if voted >= term {
+		term = voted + 1
+	}
+
+	for _, addr := range f.shards.ReplicaAddrs(f.shards.CurrentIdx()) {
+		if sameAddr(addr, f.name) {
+			continue
+		}
+		pos, err := fetchPosition(addr)
+		if err != nil {
+			log.Printf("Replica %q is not reachable: %v", addr, err)
+			continue
+		}
+		if !pos.ReadOnly {
+			f.shards.SetLeader(f.shards.CurrentIdx(), addr)
+			return addr, 0, nil
+		}
+		if t := db.Term(pos.Seq) + 1; t > term {
+			term = t
+		}
+		if pos.Seq > best || (pos.Seq == best && addr < winner) {
+			winner, best = addr, pos.Seq
+		}
+	}
+	return winner, term, nil
+}
+
+// campaign votes for this replica as the leader of term and asks the other replicas
+// of the shard for their votes. It returns nil once it has the votes of a majority
+// of the shard: the leader counts towards the size of the shard but does not vote.
+func (f *failover) campaign(term uint64) error {
+	seq, err := f.db.AppliedSeq()
+	if err != nil {
+		return err
+	}
+	granted, voted, err := f.db.Vote(term, f.name, seq)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		return fmt.Errorf("this replica already voted in term %d", voted)
+	}
+
+	replicas := f.shards.ReplicaAddrs(f.shards.CurrentIdx())
+	votes := 1
+	for _, addr := range replicas {
+		if sameAddr(addr, f.name) {
+			continue
+		}
+		v, err := requestVote(addr, term, f.name, seq)
+		if err != nil {
+			log.Printf("Vote request to %q failed: %v", addr, err)
+			continue
+		}
+		if !v.Granted {
+			if v.Term > f.seen {
+				f.seen = v.Term
+			}
+			log.Printf("Replica %q refused its vote for term %d: %s", addr, term, v.Reason)
+			continue
+		}
+		votes++
+	}
+	if need := (len(replicas)+1)/2 + 1; votes < need {
+		return fmt.Errorf("got %d votes, %d needed", votes, need)
+	}
+	return nil
+}
+
+// promote makes this replica the leader of the term and announces it.
+func (f *failover) promote(term uint64) error {
+	if err := f.db.Promote(term); err != nil {
+		return err
+	}
+	f.shards.SetLeader(f.shards.CurrentIdx(), f.name)
+
+	if err := RegisterReplicas(f.db, f.shards, nil, f.name); err != nil {
+		return err
+	}
+
+	log.Printf("Promoted to the leader of shard %d in term %d", f.shards.CurrentIdx(), term)
+
+	for _, addr := range f.shards.AllAddrs() {
+		if sameAddr(addr, f.name) {
+			continue
+		}
+		if err := announceLeader(addr, f.shards.CurrentIdx(), f.name, term); err != nil {
+			log.Printf("Announcing new leader to %q failed: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// checkLeadership makes this leader step down if a replica of its shard leads a newer term.
+func (f *failover) checkLeadership() error {
+	seq, err := f.db.LastSeq()
+	if err != nil {
+		return err
+	}
+	for _, addr := range f.shards.ReplicaAddrs(f.shards.CurrentIdx()) {
+		if sameAddr(addr, f.name) {
+			continue
+		}
+		pos, err := fetchPosition(addr)
+		if err != nil || pos.ReadOnly || db.Term(pos.Seq) <= db.Term(seq) {
+			continue
+		}
+		if err := f.db.Demote(); err != nil {
+			return err
+		}
+		f.shards.SetLeader(f.shards.CurrentIdx(), addr)
+		log.Printf("Stepped down, %q leads shard %d in term %d", addr, f.shards.CurrentIdx(), db.Term(pos.Seq))
+		return nil
+	}
+	return nil
+}
+
+// sameAddr reports whether a and b are spellings of the same address.
+func sameAddr(a, b string) bool {
+	return config.NormalizeAddr(a) == config.NormalizeAddr(b)
+}
+
+func fetchPosition(addr string) (*Position, error) {
+	resp, err := healthClient.Get("http://" + addr + "/replication/position")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	var pos Position
+	if err := json.NewDecoder(resp.Body).Decode(&pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+func announceLeader(addr string, shard int, leader string, term uint64) error {
+	u := url.Values{}
+	u.Set("shard", strconv.Itoa(shard))
+	u.Set("addr", leader)
+	u.Set("term", strconv.FormatUint(term, 10))
+
+	resp, err := healthClient.Get("http://" + addr + "/cluster/leader?" + u.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	return nil
+}
+
+func requestVote(addr string, term uint64, candidate string, seq uint64) (*Vote, error) {
+	u := url.Values{}
+	u.Set("term", strconv.FormatUint(term, 10))
+	u.Set("candidate", candidate)
+	u.Set("seq", strconv.FormatUint(seq, 10))
+
+	resp, err := healthClient.Get("http://" + addr + "/replication/vote?" + u.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	var v Vote
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
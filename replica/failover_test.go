@@ -0,0 +1,130 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica_test
+
+import (
+	"testing"
+	"time"
+
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+func TestFailover(t *testing.T) {
+	nodes := startShard(t, 2)
+	for _, n := range nodes[1:] {
+		go replica.ClientLoop(n.db, n.shards, n.addr, &n.stats)
+		go replica.FailoverLoop(n.db, n.shards, n.addr)
+	}
+	setKey(t, nodes[0].db, "a", "1")
+	waitFor(t, 5*time.Second, "the replicas to catch up", func() bool {
+		return hasKey(nodes[1].db, "a", "1") && hasKey(nodes[2].db, "a", "1")
+	})
+
+	// Both replicas are equally up to date, the one with the lowest address is elected.
+	nodes[0].stop()
+	leader, follower := nodes[1], nodes[2]
+	if follower.addr < leader.addr {
+		leader, follower = follower, leader
+	}
+	waitFor(t, 20*time.Second, "the election", func() bool { return !leader.db.ReadOnly() })
+	if !follower.db.ReadOnly() {
+		t.Fatalf("Both replicas were promoted")
+	}
+	if seq, err := leader.db.LastSeq(); err != nil || internalDB.Term(seq) != 1 {
+		t.Errorf("Term of the new leader: got seq %d, %v, want term 1", seq, err)
+	}
+	if term, err := follower.db.VotedTerm(); err != nil || term != 1 {
+		t.Errorf("VotedTerm() of the follower: got %d, %v, want 1", term, err)
+	}
+
+	// The other replica follows the new leader.
+	waitFor(t, 5*time.Second, "the announcement", func() bool { return follower.shards.Leader(0) == leader.addr })
+	setKey(t, leader.db, "b", "2")
+	waitFor(t, 5*time.Second, "the follower to replicate the new leader", func() bool { return hasKey(follower.db, "b", "2") })
+}
+
+func TestFailoverWithoutMajority(t *testing.T) {
+	nodes := startShard(t, 2)
+	r := nodes[1]
+	go replica.ClientLoop(r.db, r.shards, r.addr, &r.stats)
+	go replica.FailoverLoop(r.db, r.shards, r.addr)
+	setKey(t, nodes[0].db, "a", "1")
+	waitFor(t, 5*time.Second, "the replica to catch up", func() bool { return hasKey(r.db, "a", "1") })
+
+	// The other replica is down too, a single vote of two is no majority.
+	nodes[2].stop()
+	nodes[0].stop()
+	time.Sleep(5 * time.Second)
+	if !r.db.ReadOnly() {
+		t.Errorf("Replica was promoted without a majority of the votes")
+	}
+}
+
+func TestFailoverSingleReplica(t *testing.T) {
+	nodes := startShard(t, 1)
+	r := nodes[1]
+	go replica.ClientLoop(r.db, r.shards, r.addr, &r.stats)
+	go replica.FailoverLoop(r.db, r.shards, r.addr)
+	setKey(t, nodes[0].db, "a", "1")
+	waitFor(t, 5*time.Second, "the replica to catch up", func() bool { return hasKey(r.db, "a", "1") })
+
+	// The leader may only be unreachable from the replica, whose vote is one of two.
+	nodes[0].stop()
+	time.Sleep(5 * time.Second)
+	if !r.db.ReadOnly() {
+		t.Errorf("The only replica was promoted on its own vote")
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	nodes := startShard(t, 1)
+	old, r := nodes[0], nodes[1]
+	go replica.ClientLoop(old.db, old.shards, old.addr, &old.stats)
+	go replica.FailoverLoop(old.db, old.shards, old.addr)
+
+	// The replica was elected while the old leader was unreachable,
+	// the old leader holds a write the new leader never received.
+	setKey(t, old.db, "lost", "1")
+	if err := r.db.Promote(1); err != nil {
+		t.Fatalf("Promote(1): got %v, want nil error", err)
+	}
+	r.shards.SetLeader(0, r.addr)
+	setKey(t, r.db, "a", "1")
+
+	waitFor(t, 5*time.Second, "the old leader to step down", func() bool { return old.db.ReadOnly() })
+	if got := old.shards.Leader(0); got != r.addr {
+		t.Errorf("Leader after stepping down: got %q, want %q", got, r.addr)
+	}
+	if _, err := old.db.Set("b", []byte("2")); err == nil {
+		t.Errorf("Set on the old leader: got nil error, want non-nil error")
+	}
+
+	// It replicates the new leader and drops its own write.
+	waitFor(t, 5*time.Second, "the old leader to replicate the new one", func() bool {
+		return hasKey(old.db, "a", "1") && !hasKey(old.db, "lost", "1")
+	})
+}
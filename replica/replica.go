@@ -27,82 +27,266 @@ package replica
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
 	"github.com/Nicknamezz00/naive-distributed-kv/db"
 )
 
-// NextKeyValue contains the response for GetNextKeyForReplication.
-type NextKeyValue struct {
+// streamTimeout is how long the replica waits for a batch or a heartbeat
+// before it considers the stream broken and reconnects.
+const streamTimeout = 15 * time.Second
+
+// LogPositionHeader is the HTTP header carrying the log position of a snapshot.
+const LogPositionHeader = "X-Log-Position"
+
+// errTooFarBehind is returned when the leader no longer has the log entries
+// the replica needs, and the replica must bootstrap from a snapshot.
+var errTooFarBehind = errors.New("replica is too far behind the leader")
+
+// LogEntries contains the response for LogEntries and a single batch of StreamLog.
+type LogEntries struct {
+	Entries []*db.LogEntry
+	Err     string
+}
+
+// SnapshotEntry is a single key and value of the Snapshot response.
+type SnapshotEntry struct {
 	Key   string
-	Value string
-	Err   error
+	Value []byte
+	// ExpiresAt is the expiry time of the key in unix nanoseconds, 0 if it does not expire.
+	ExpiresAt int64 `json:",omitempty"`
+	// Version is the version of the key on the leader.
+	Version uint64 `json:",omitempty"`
+	// Modified is the modification time of the key in unix nanoseconds, 0 if it is unknown.
+	Modified int64 `json:",omitempty"`
+}
+
+// RegisterReplicas registers the replicas of the shard the node self leads with its database,
+// so that log entries are kept until they acknowledged them, see db.RegisterReplica.
+// Replicas of the shard in prev, if not nil, that are no longer replicas in shards
+// are unregistered. Names are normalized with config.NormalizeAddr, like the names
+// replicas acknowledge with.
+func RegisterReplicas(d *db.Database, shards, prev *config.Shards, self string) error {
+	self = config.NormalizeAddr(self)
+	want := make(map[string]bool)
+	for _, addr := range shards.ReplicaAddrs(shards.CurrentIdx()) {
+		if name := config.NormalizeAddr(addr); name != self {
+			want[name] = true
+		}
+	}
+	if prev != nil {
+		for _, addr := range prev.ReplicaAddrs(prev.CurrentIdx()) {
+			if name := config.NormalizeAddr(addr); !want[name] {
+				if err := d.UnregisterReplica(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for name := range want {
+		if err := d.RegisterReplica(name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type client struct {
 	db     *db.Database
+	shards *config.Shards
 	leader string // http url of leader node
+	name   string // name of this replica on the leader, its http address
+	stats  *Stats
 }
 
-// ClientLoop continuously downloads new keys from the master and applies them.
-func ClientLoop(db *db.Database, leader string) {
-	c := &client{db: db, leader: leader}
+// ClientLoop continuously receives new log entries pushed by the master and applies them.
+// Each replica acknowledges applied entries under its own name,
+// so replicas of the same shard do not interfere with each other.
+// A new replica, or one that fell too far behind, first copies a full snapshot.
+// The loop follows leader changes of the shard and idles while this node leads it,
+// a leader that steps down bootstraps from a snapshot of the new leader.
+// Progress and errors are recorded in stats, which may be nil.
+func ClientLoop(db *db.Database, shards *config.Shards, name string, stats *Stats) {
+	c := &client{db: db, shards: shards, name: name, stats: stats}
+
+	applied, err := db.AppliedSeq()
+	if err != nil {
+		log.Printf("AppliedSeq error: %v", err)
+	}
+	needSnapshot := applied == 0
+
 	for {
-		present, err := c.loop()
-		if err != nil {
-			log.Printf("Loop error: %v", err)
-			time.Sleep(time.Second)
+		if c.leader = shards.Leader(shards.CurrentIdx()); sameAddr(c.leader, name) || !db.ReadOnly() {
+			// The log of a leader may have diverged from the one of the next leader.
+			needSnapshot = true
+			time.Sleep(healthInterval)
+			continue
+		}
+		stats.update(func(s *ClientStats) { s.Leader = c.leader })
+
+		if needSnapshot {
+			if err := c.bootstrap(); err != nil {
+				log.Printf("Bootstrap error: %v", err)
+				stats.update(func(s *ClientStats) {
+					s.BootstrapErrors++
+					s.LastError = err.Error()
+				})
+				time.Sleep(time.Second)
+				continue
+			}
+			stats.update(func(s *ClientStats) { s.Bootstraps++ })
+			needSnapshot = false
+		}
+
+		err := c.stream()
+		if errors.Is(err, errTooFarBehind) {
+			log.Printf("Stream error: %v, bootstrapping from a snapshot", err)
+			needSnapshot = true
 			continue
 		}
-		if !present {
-			time.Sleep(time.Millisecond * 100)
+		if err != nil {
+			log.Printf("Stream error: %v", err)
+			stats.update(func(s *ClientStats) {
+				s.StreamErrors++
+				s.LastError = err.Error()
+			})
 		}
+		time.Sleep(time.Second)
 	}
 }
 
-func (c *client) loop() (present bool, err error) {
-	resp, err := http.Get("http://" + c.leader + "/get-old-key")
+// bootstrap replaces all local data with a snapshot of the leader.
+func (c *client) bootstrap() error {
+	u := url.Values{}
+	u.Set("replica", c.name)
+
+	resp, err := http.Get("http://" + c.leader + "/replication/snapshot?" + u.Encode())
 	if err != nil {
-		return false, err
+		return err
 	}
+	defer resp.Body.Close()
 
-	var res NextKeyValue
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return false, err
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(LogPositionHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot log position: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if res.Err != nil {
-		return false, err
+	log.Printf("Bootstrapping from snapshot of %q at seq=%d", c.leader, seq)
+
+	var count int
+	err = c.db.RestoreSnapshot(seq, func(put func(e db.KeyValue) error) error {
+		d := json.NewDecoder(resp.Body)
+		for {
+			var e SnapshotEntry
+			if err := d.Decode(&e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := put(db.KeyValue{Key: e.Key, Value: e.Value, ExpiresAt: e.ExpiresAt, Version: e.Version, Modified: e.Modified}); err != nil {
+				return err
+			}
+			count++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Bootstrapped %d keys from snapshot at seq=%d", count, seq)
+	return nil
+}
+
+// stream connects to the leader, resuming from the last applied sequence number,
+// and applies pushed batches until the stream breaks.
+func (c *client) stream() error {
+	applied, err := c.db.AppliedSeq()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := time.AfterFunc(streamTimeout, cancel)
+	defer timer.Stop()
+
+	u := url.Values{}
+	u.Set("replica", c.name)
+	u.Set("after", strconv.FormatUint(applied, 10))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+c.leader+"/replication/stream?"+u.Encode(), nil)
+	if err != nil {
+		return err
 	}
-	if res.Key == "" {
-		return false, nil
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	if err := c.db.SetReplica(res.Key, []byte(res.Value)); err != nil {
-		return false, err
+	if resp.StatusCode == http.StatusGone {
+		return errTooFarBehind
 	}
-	if err := c.deleteFromReplicationQueue(res.Key, res.Value); err != nil {
-		log.Printf("DeleteKeyFromReplication failed: %v", err)
+	if resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, result)
 	}
 
-	return true, nil
+	log.Printf("Streaming replication log from %q after seq=%d", c.leader, applied)
+
+	d := json.NewDecoder(resp.Body)
+	for {
+		var res LogEntries
+		if err := d.Decode(&res); err != nil {
+			return err
+		}
+		timer.Reset(streamTimeout)
+
+		if res.Err != "" {
+			return errors.New(res.Err)
+		}
+		if len(res.Entries) == 0 {
+			c.stats.update(func(s *ClientStats) { s.LastPull = time.Now() })
+			continue
+		}
+
+		if err := c.db.ApplyLogEntries(res.Entries); err != nil {
+			return err
+		}
+		c.stats.update(func(s *ClientStats) { s.LastPull = time.Now() })
+		if err := c.ackLog(res.Entries[len(res.Entries)-1].Seq); err != nil {
+			log.Printf("AckLog failed: %v", err)
+			c.stats.update(func(s *ClientStats) {
+				s.AckErrors++
+				s.LastError = err.Error()
+			})
+		}
+	}
 }
 
-func (c *client) deleteFromReplicationQueue(key, value string) error {
+func (c *client) ackLog(seq uint64) error {
 	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+	u.Set("replica", c.name)
+	u.Set("seq", strconv.FormatUint(seq, 10))
 
-	log.Printf("Deleting key=%q, value=%q from replica queue on %q", key, value, c.leader)
+	log.Printf("Acknowledging replication log up to seq=%d on %q", seq, c.leader)
 
-	resp, err := http.Get("http://" + c.leader + "/delete-replica-key?" + u.Encode())
+	resp, err := http.Get("http://" + c.leader + "/ack-log?" + u.Encode())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,201 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nicknamezz00/naive-distributed-kv/api"
+	"github.com/Nicknamezz00/naive-distributed-kv/config"
+	internalDB "github.com/Nicknamezz00/naive-distributed-kv/db"
+	"github.com/Nicknamezz00/naive-distributed-kv/replica"
+)
+
+func createTempDB(t *testing.T, readonly bool) *internalDB.Database {
+	t.Helper()
+
+	f, err := ioutil.TempFile(os.TempDir(), "replicatest")
+	if err != nil {
+		t.Fatalf("Cannot create temp db: %v", err)
+	}
+
+	name := f.Name()
+	f.Close()
+	t.Cleanup(func() { os.Remove(name) })
+
+	db, closeFunc, err := internalDB.NewDatabase(name, readonly)
+	if err != nil {
+		t.Fatalf("Cannot create a new database: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	return db
+}
+
+// node is a member of a shard started by startShard.
+type node struct {
+	db     *internalDB.Database
+	shards *config.Shards // the config of this node, changed by failovers
+	addr   string
+	ts     *httptest.Server
+	stats  replica.Stats
+}
+
+// stop makes the node unreachable.
+func (n *node) stop() {
+	n.ts.CloseClientConnections()
+	n.ts.Close()
+}
+
+// startShard starts the HTTP servers of a shard led by the first node
+// with the given number of replicas. Every node has its own config.
+func startShard(t *testing.T, replicas int) []*node {
+	t.Helper()
+	nodes := make([]*node, replicas+1)
+	muxes := make([]*http.ServeMux, len(nodes))
+	var addrs []string
+	for i := range nodes {
+		// Databases are created first, so that they are closed after the servers.
+		nodes[i] = &node{db: createTempDB(t, i > 0)}
+		muxes[i] = http.NewServeMux()
+	}
+	for i, n := range nodes {
+		n.ts = httptest.NewServer(muxes[i])
+		t.Cleanup(n.stop)
+		n.addr = strings.TrimPrefix(n.ts.URL, "http://")
+		addrs = append(addrs, n.addr)
+	}
+
+	cfg := &config.Shards{
+		Addrs:    map[int]string{0: addrs[0]},
+		Replicas: map[int][]string{0: addrs[1:]},
+		Count:    1,
+		CurIdx:   0,
+	}
+	for i, n := range nodes {
+		n.shards = cfg.Clone()
+		srv := api.NewServer(n.db, n.shards)
+		srv.SetReplicaStats(&n.stats)
+		mux := muxes[i]
+		mux.HandleFunc("/replication/stream", srv.StreamLog)
+		mux.HandleFunc("/replication/snapshot", srv.Snapshot)
+		mux.HandleFunc("/replication/position", srv.Position)
+		mux.HandleFunc("/replication/vote", srv.Vote)
+		mux.HandleFunc("/cluster/leader", srv.SetLeader)
+		mux.HandleFunc("/ack-log", srv.AckLog)
+		mux.HandleFunc("/anti-entropy/tree", srv.MerkleTree)
+		mux.HandleFunc("/anti-entropy/leaf", srv.MerkleLeaf)
+	}
+	return nodes
+}
+
+// waitFor fails the test if cond does not hold within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > timeout {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func setKey(t *testing.T, d *internalDB.Database, key, value string) {
+	t.Helper()
+	if _, err := d.Set(key, []byte(value)); err != nil {
+		t.Fatalf("Set(%q, %q) failed: %v", key, value, err)
+	}
+}
+
+// hasKey reports whether the key has the value in d.
+func hasKey(d *internalDB.Database, key, value string) bool {
+	got, err := d.Get(key)
+	return err == nil && string(got) == value
+}
+
+func replicaNames(t *testing.T, d *internalDB.Database) []string {
+	t.Helper()
+	names, err := d.Replicas()
+	if err != nil {
+		t.Fatalf("Replicas() failed: %v", err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRegisterReplicas(t *testing.T) {
+	db := createTempDB(t, false)
+	prev := &config.Shards{
+		Addrs:    map[int]string{0: "localhost:8080"},
+		Replicas: map[int][]string{0: {"localhost:8090", "Localhost:8091"}},
+		Count:    1,
+		CurIdx:   0,
+	}
+	if err := replica.RegisterReplicas(db, prev, nil, "localhost:8080"); err != nil {
+		t.Fatalf("RegisterReplicas: got %v, want nil error", err)
+	}
+	if got, want := replicaNames(t, db), []string{"127.0.0.1:8090", "127.0.0.1:8091"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Registered replicas: got %v, want %v", got, want)
+	}
+
+	// A replica removed from the config no longer keeps the log, the leader itself is never registered.
+	next := prev.Clone()
+	next.Replicas[0] = []string{"127.0.0.1:8090", "localhost:8080"}
+	if err := replica.RegisterReplicas(db, next, prev, "127.0.0.1:8080"); err != nil {
+		t.Fatalf("RegisterReplicas with a removed replica: got %v, want nil error", err)
+	}
+	if got, want := replicaNames(t, db), []string{"127.0.0.1:8090"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Registered replicas after the removal: got %v, want %v", got, want)
+	}
+}
+
+func TestClientLoop(t *testing.T) {
+	nodes := startShard(t, 1)
+	leader, r := nodes[0], nodes[1]
+	setKey(t, leader.db, "a", "1")
+
+	// A new replica bootstraps from a snapshot, then streams the log.
+	go replica.ClientLoop(r.db, r.shards, r.addr, &r.stats)
+	waitFor(t, 5*time.Second, "the snapshot", func() bool { return hasKey(r.db, "a", "1") })
+	setKey(t, leader.db, "b", "2")
+	waitFor(t, 5*time.Second, "the log", func() bool { return hasKey(r.db, "b", "2") })
+
+	if stats := r.stats.Get(); stats.Bootstraps != 1 || stats.Leader != leader.addr {
+		t.Errorf("Client stats: got %+v, want 1 bootstrap from %q", stats, leader.addr)
+	}
+	// The replica acknowledges under its own name, the leader keeps no log for it.
+	waitFor(t, 5*time.Second, "the acknowledgement", func() bool {
+		acks, queued, err := leader.db.ReplicaAcks()
+		return err == nil && acks[r.addr] == 2 && queued == 0
+	})
+}
@@ -0,0 +1,90 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2023 Runze Wu
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package replica
+
+import (
+	"sync"
+	"time"
+)
+
+// Status contains the response for ReplicationStatus.
+type Status struct {
+	// ReadOnly is true on replicas.
+	ReadOnly bool
+	// Seq is the last written sequence number on a leader
+	// and the last applied one on a replica.
+	Seq uint64
+
+	// QueueDepth is the number of log entries the leader keeps
+	// because not all replicas acknowledged them yet.
+	QueueDepth uint64
+	// Replicas holds the acknowledged position of each registered replica.
+	Replicas map[string]ReplicaStatus
+
+	// Client holds the statistics of the replication client on a replica.
+	Client *ClientStats
+}
+
+// ReplicaStatus is the acknowledged position of a single replica on the leader.
+type ReplicaStatus struct {
+	Acked uint64
+	Lag   uint64
+}
+
+// ClientStats holds the statistics of ClientLoop.
+type ClientStats struct {
+	Leader string
+	// LastPull is when the replica last applied a batch or received a heartbeat,
+	// the replica holds all writes the leader made before that.
+	LastPull        time.Time
+	LastError       string
+	StreamErrors    int
+	BootstrapErrors int
+	AckErrors       int
+	Bootstraps      int
+}
+
+// Stats collects ClientStats, it is safe for concurrent use.
+type Stats struct {
+	mu sync.Mutex
+	s  ClientStats
+}
+
+// Get returns a copy of the current statistics.
+func (s *Stats) Get() ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.s
+}
+
+func (s *Stats) update(fn func(s *ClientStats)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.s)
+}